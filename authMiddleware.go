@@ -0,0 +1,247 @@
+package main
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type contextKey string
+
+const (
+	userContextKey        contextKey = "user"
+	credentialsContextKey contextKey = "credentials"
+)
+
+// credentials records how a request authenticated. Access tokens from a
+// login carry every scope; API keys and tokens issued to OAuth clients only
+// the ones they were granted.
+type credentials struct {
+	apiKeyID      uuid.UUID
+	oauthClientID string
+	scopes        []string
+	// expiresAt is when an access token runs out; API keys don't.
+	expiresAt time.Time
+}
+
+func (c credentials) isAPIKey() bool {
+	return c.apiKeyID != uuid.Nil
+}
+
+func (c credentials) isOAuthClient() bool {
+	return c.oauthClientID != ""
+}
+
+// restricted reports whether the request was made by something other than
+// the user's own session.
+func (c credentials) restricted() bool {
+	return c.isAPIKey() || c.isOAuthClient()
+}
+
+func (c credentials) allows(scope string) bool {
+	return !c.restricted() || slices.Contains(c.scopes, scope)
+}
+
+// contextWithUser returns a copy of ctx carrying the authenticated user.
+func contextWithUser(ctx context.Context, user database.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// userFromContext returns the user put there by requireAuth or optionalAuth.
+func userFromContext(ctx context.Context) (database.User, bool) {
+	user, ok := ctx.Value(userContextKey).(database.User)
+	return user, ok
+}
+
+func contextWithCredentials(ctx context.Context, creds credentials) context.Context {
+	return context.WithValue(ctx, credentialsContextKey, creds)
+}
+
+func credentialsFromContext(ctx context.Context) (credentials, bool) {
+	creds, ok := ctx.Value(credentialsContextKey).(credentials)
+	return creds, ok
+}
+
+// respondUnauthorized answers with a 401 and the WWW-Authenticate challenge
+// from RFC 6750. tokenSent distinguishes a missing token from a bad one.
+func respondUnauthorized(w http.ResponseWriter, tokenSent bool, err error) {
+	challenge := `Bearer realm="chirpy"`
+	if tokenSent {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+}
+
+// invalidCredentials marks err as the client's fault: a missing, malformed,
+// expired or revoked credential, or one for a key or user that no longer
+// exists. Any other authentication error is a server error.
+func invalidCredentials(err error) error {
+	return fmt.Errorf("%w: %w", errInvalidCredentials, err)
+}
+
+// notFoundIsInvalid treats a credential whose key or user is gone as
+// invalid, leaving other lookup errors alone.
+func notFoundIsInvalid(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return invalidCredentials(err)
+	}
+	return err
+}
+
+// authenticate validates the bearer credential on r, either an access
+// token, one issued to an OAuth client, or an API key, and loads its user.
+// Suspended users get errSuspended.
+func (cfg *apiConfig) authenticate(r *http.Request) (database.User, credentials, error) {
+	user, creds, err := cfg.authenticateBearer(r)
+	if err != nil {
+		return database.User{}, credentials{}, err
+	}
+	if isSuspended(user, time.Now()) {
+		return user, credentials{}, errSuspended
+	}
+	return user, creds, nil
+}
+
+func (cfg *apiConfig) authenticateBearer(r *http.Request) (database.User, credentials, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return database.User{}, credentials{}, invalidCredentials(err)
+	}
+	if auth.IsAPIKey(token) {
+		return cfg.authenticateAPIKey(r.Context(), token)
+	}
+	claims, err := cfg.validateAccessToken(token)
+	if err != nil {
+		return database.User{}, credentials{}, invalidCredentials(err)
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return database.User{}, credentials{}, invalidCredentials(err)
+	}
+	creds := credentials{}
+	if claims.ExpiresAt != nil {
+		creds.expiresAt = claims.ExpiresAt.Time
+	}
+	if claims.IsThirdParty() {
+		revoked, err := cfg.oauthTokenRevoked(r.Context(), claims)
+		if err != nil {
+			return database.User{}, credentials{}, err
+		}
+		if revoked {
+			return database.User{}, credentials{}, fmt.Errorf("%w: oauth token has been revoked", errInvalidCredentials)
+		}
+		creds.oauthClientID = claims.ClientID
+		creds.scopes = claims.Scopes()
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
+	return user, creds, notFoundIsInvalid(err)
+}
+
+func (cfg *apiConfig) authenticateAPIKey(ctx context.Context, key string) (database.User, credentials, error) {
+	apiKey, err := cfg.db.GetAPIKeyByHash(ctx, auth.HashAPIKey(key))
+	if err != nil {
+		return database.User{}, credentials{}, notFoundIsInvalid(err)
+	}
+	if err := cfg.db.TouchAPIKey(ctx, apiKey.ID); err != nil {
+		return database.User{}, credentials{}, err
+	}
+	user, err := cfg.db.GetUserByID(ctx, apiKey.UserID)
+	return user, credentials{apiKeyID: apiKey.ID, scopes: apiKey.Scopes}, notFoundIsInvalid(err)
+}
+
+// requireAuth rejects requests without a valid access token or API key and
+// makes the user available through userFromContext.
+func (cfg *apiConfig) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, creds, err := cfg.authenticate(r)
+		if errors.Is(err, errSuspended) {
+			respondSuspended(w, user)
+			return
+		}
+		if errors.Is(err, errInvalidCredentials) {
+			respondUnauthorized(w, r.Header.Get("Authorization") != "", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check credentials", err)
+			return
+		}
+		ctx := contextWithCredentials(contextWithUser(r.Context(), user), creds)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// optionalAuth lets anonymous requests through but still rejects a token
+// that is present and invalid.
+func (cfg *apiConfig) optionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, creds, err := cfg.authenticate(r)
+		if errors.Is(err, errSuspended) {
+			respondSuspended(w, user)
+			return
+		}
+		if errors.Is(err, errInvalidCredentials) {
+			respondUnauthorized(w, true, err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check credentials", err)
+			return
+		}
+		ctx := contextWithCredentials(contextWithUser(r.Context(), user), creds)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireScope rejects authenticated requests whose credentials don't carry
+// scope. It goes after requireAuth or optionalAuth; anonymous requests are
+// left alone.
+func (cfg *apiConfig) requireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds, ok := credentialsFromContext(r.Context())
+		if ok && !creds.allows(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", scope=%q`, scope))
+			respondWithError(w, http.StatusForbidden, "Credentials are missing the "+scope+" scope", fmt.Errorf("credentials %+v lack scope %s", creds, scope))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireSession rejects API keys and OAuth client tokens, for endpoints only
+// a logged-in user may use. It goes after requireAuth.
+func (cfg *apiConfig) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if creds, _ := credentialsFromContext(r.Context()); creds.restricted() {
+			respondWithError(w, http.StatusForbidden, "Only a logged-in user can do this", errors.New("api key or oauth token used for a session-only endpoint"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareRequireRole only lets through logged-in users whose role is at
+// least role.
+func (cfg *apiConfig) middlewareRequireRole(role auth.Role, next http.Handler) http.Handler {
+	return cfg.requireAuth(cfg.requireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := userFromContext(r.Context())
+		if !auth.Role(user.Role).AtLeast(role) {
+			respondWithError(w, http.StatusForbidden, "Forbidden", fmt.Errorf("role %q needs at least %q", user.Role, role))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etagFor is a strong ETag for the JSON representation v, so it changes
+// whenever anything a client can see does.
+func etagFor(v any) string {
+	// Representations are plain structs and always marshal.
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setValidators sets the ETag and, when modified is known, Last-Modified.
+func setValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether a GET can be answered with 304. As in RFC
+// 9110, If-Modified-Since only counts when there is no If-None-Match.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if tags := r.Header.Values("If-None-Match"); len(tags) > 0 {
+		return etagMatches(tags, etag, false)
+	}
+	since := r.Header.Get("If-Modified-Since")
+	if since == "" || modified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(since)
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(t)
+}
+
+// preconditionFailed reports whether an If-Match header is present and
+// doesn't match the resource's current ETag. Requests without one go
+// ahead.
+func preconditionFailed(r *http.Request, etag string) bool {
+	tags := r.Header.Values("If-Match")
+	if len(tags) == 0 {
+		return false
+	}
+	return !etagMatches(tags, etag, true)
+}
+
+// respondNotModified ends a conditional GET whose validators were already
+// set.
+func respondNotModified(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// respondPreconditionFailed tells the client the resource changed since
+// it last read it.
+func respondPreconditionFailed(w http.ResponseWriter) {
+	respondWithError(w, http.StatusPreconditionFailed, "The resource has changed, fetch it again and retry", nil)
+}
+
+// etagMatches checks etag against header values listing ETags or "*".
+// Strong comparison never matches weak ETags.
+func etagMatches(headers []string, etag string, strong bool) bool {
+	for _, header := range headers {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return true
+			}
+			if weak, ok := strings.CutPrefix(tag, "W/"); ok {
+				if strong {
+					continue
+				}
+				tag = weak
+			}
+			if tag == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+	}
+	return false
+}
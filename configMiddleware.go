@@ -1,18 +1,125 @@
 package main
 
 import (
+	"chirpy/internal/auth"
 	"chirpy/internal/database"
+	"chirpy/internal/entitlements"
+	"chirpy/internal/events"
+	"chirpy/internal/lockout"
+	"chirpy/internal/oidc"
+	"chirpy/internal/ratelimit"
+	"chirpy/internal/stream"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
 type apiConfig struct {
 	fileserverHits atomic.Int32
-	db             *database.Queries
+	db             database.DBInterface
 	platform       string
 	secret         string
-	polkaKey       string
+	polka          auth.WebhookVerifier
+	jwtOptions     auth.ValidatorOptions
+	accountLockout *lockout.Tracker
+	ipLockout      *lockout.Tracker
+	passwords      *auth.PasswordHasher
+	passwordPolicy auth.PasswordPolicy
+	oidc           *oidc.Provider
+	entitlements   entitlements.Checker
+	events         *events.Bus
+	stream         *stream.Hub
+	// notificationStream carries notifications live, addressed by
+	// recipient.
+	notificationStream *stream.Hub
+	// rateLimits is nil when rate limiting is off.
+	rateLimits ratelimit.Store
+	// trustedProxies may set X-Forwarded-For.
+	trustedProxies []netip.Prefix
+	// idempotencyTTL is how long responses are kept for replay.
+	idempotencyTTL time.Duration
+}
+
+// clientIP is the address the request came from, without the port. When
+// that's a trusted proxy, it's the last address in X-Forwarded-For that
+// isn't.
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !cfg.isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !cfg.isTrustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
+// remoteHost is the address of the other end of r's connection.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (cfg *apiConfig) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range cfg.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of addresses and CIDR
+// ranges, such as "10.0.0.0/8, 127.0.0.1".
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// validateAccessToken checks token against cfg.jwtOptions and returns its
+// claims.
+func (cfg *apiConfig) validateAccessToken(token string) (*auth.Claims, error) {
+	return auth.ValidateJWTWithOptions(token, cfg.secret, cfg.jwtOptions)
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -25,7 +132,7 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 func (cfg *apiConfig) middlewareDevMode(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if cfg.platform != "dev" {
-			respondWithError(w, http.StatusUnauthorized, "This endpoint is reserved for dev mode", fmt.Errorf("trying to connect in dev mode"))
+			respondWithError(w, http.StatusForbidden, "This endpoint is reserved for dev mode", fmt.Errorf("trying to connect in dev mode"))
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -47,12 +154,12 @@ func (cfg *apiConfig) handleHits(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (cfg *apiConfig) handleReset(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	cfg.fileserverHits.Store(0)
-	err := cfg.db.ResetUsers(r.Context())
-	if err != nil {
+	if err := cfg.db.ResetUsers(r.Context()); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't reset users", err)
+		return
 	}
+	cfg.fileserverHits.Store(0)
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf("Hits: %v", cfg.fileserverHits.Load())))
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"chirpy/internal/moderation"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerUpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+
+	type parameters struct {
+		Role string `json:"role"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	role, err := auth.ParseRole(params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid role", err)
+		return
+	}
+
+	user, err := cfg.db.UpdateUserRole(r.Context(), database.UpdateUserRoleParams{
+		ID:   userID,
+		Role: string(role),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find user", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update role", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.userFromDB(user))
+}
+
+func (cfg *apiConfig) handlerModerateDeleteChirp(w http.ResponseWriter, r *http.Request) {
+	moderator, _ := userFromContext(r.Context())
+	chirpId, err := uuid.Parse(r.PathValue("chirpId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	chirp, err := cfg.db.GetChirpById(r.Context(), chirpId)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "couldn't find chirp", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chirp", err)
+		return
+	}
+	err = cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		if err := q.DeleteChirpById(r.Context(), chirp.ID); err != nil {
+			return err
+		}
+		if err := events.Record(r.Context(), q, events.ChirpDeleted, chirp.UserID, events.ChirpFromDB(chirp)); err != nil {
+			return err
+		}
+		return q.CreateModerationAction(r.Context(), database.CreateModerationActionParams{
+			ModeratorID:  moderator.ID,
+			Action:       string(moderation.ActionDeleteChirp),
+			TargetUserID: uuid.NullUUID{UUID: chirp.UserID, Valid: true},
+			ChirpID:      uuid.NullUUID{UUID: chirp.ID, Valid: true},
+		})
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't delete chirp", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find user", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	cfg.accountLockout.Reset(strings.ToLower(user.Email))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Key is only ever returned when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+func apiKeyFromDB(k database.ApiKey) APIKey {
+	res := APIKey{
+		ID:        k.ID,
+		CreatedAt: k.CreatedAt,
+		Name:      k.Name,
+		Prefix:    k.KeyPrefix,
+		Scopes:    k.Scopes,
+	}
+	if k.LastUsedAt.Valid {
+		res.LastUsedAt = &k.LastUsedAt.Time
+	}
+	return res
+}
+
+func (cfg *apiConfig) handlerCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	type parameters struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "API key needs a name", errors.New("empty api key name"))
+		return
+	}
+	if err := auth.ValidateScopes(params.Scopes); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	key, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate an API key", err)
+		return
+	}
+	apiKey, err := cfg.db.CreateAPIKey(r.Context(), database.CreateAPIKeyParams{
+		UserID:    user.ID,
+		Name:      params.Name,
+		KeyPrefix: key[:len(auth.APIKeyPrefix)+8],
+		KeyHash:   hash,
+		Scopes:    params.Scopes,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create the API key", err)
+		return
+	}
+
+	res := apiKeyFromDB(apiKey)
+	res.Key = key
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+func (cfg *apiConfig) handlerListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	dbKeys, err := cfg.db.ListAPIKeysForUser(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list API keys", err)
+		return
+	}
+	keys := make([]APIKey, len(dbKeys))
+	for i, k := range dbKeys {
+		keys[i] = apiKeyFromDB(k)
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (cfg *apiConfig) handlerRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	keyID, err := uuid.Parse(r.PathValue("keyId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	n, err := cfg.db.RevokeAPIKey(r.Context(), database.RevokeAPIKeyParams{
+		ID:     keyID,
+		UserID: user.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke the API key", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "Couldn't find API key", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxKeywordLength = 100
+
+type BlockedUser struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type MutedUser struct {
+	UserID    uuid.UUID  `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type KeywordMute struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Keyword   string     `json:"keyword"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func keywordMuteFromDB(m database.KeywordMute) KeywordMute {
+	return KeywordMute{
+		ID:        m.ID,
+		CreatedAt: m.CreatedAt,
+		Keyword:   m.Keyword,
+		ExpiresAt: nullTimePtr(m.ExpiresAt),
+	}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// expiryAfter turns an optional duration such as "24h" into when something
+// starting now ends; an empty one never does.
+func expiryAfter(duration string, now time.Time) (sql.NullTime, error) {
+	if duration == "" {
+		return sql.NullTime{}, nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return sql.NullTime{}, fmt.Errorf("invalid duration %q", duration)
+	}
+	return sql.NullTime{Time: now.Add(d), Valid: true}, nil
+}
+
+// targetUser reads the {userId} path value, which must be an existing user
+// other than the caller.
+func (cfg *apiConfig) targetUser(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	user, _ := userFromContext(r.Context())
+	targetID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return uuid.Nil, false
+	}
+	if targetID == user.ID {
+		respondWithError(w, http.StatusBadRequest, "You can't do that to yourself", errors.New("target is the caller"))
+		return uuid.Nil, false
+	}
+	if _, err := cfg.db.GetUserByID(r.Context(), targetID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, http.StatusNotFound, "Couldn't find user", err)
+			return uuid.Nil, false
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up user", err)
+		return uuid.Nil, false
+	}
+	return targetID, true
+}
+
+// handlerBlockUser hides the user and the caller from each other and stops
+// them messaging each other. Blocking twice is fine.
+func (cfg *apiConfig) handlerBlockUser(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	targetID, ok := cfg.targetUser(w, r)
+	if !ok {
+		return
+	}
+	err := cfg.db.BlockUser(r.Context(), database.BlockUserParams{
+		BlockerID: user.ID,
+		BlockedID: targetID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't block user", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerUnblockUser(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	targetID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	n, err := cfg.db.UnblockUser(r.Context(), database.UnblockUserParams{
+		BlockerID: user.ID,
+		BlockedID: targetID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't unblock user", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "You haven't blocked that user", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerListBlocks(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	blocks, err := cfg.db.ListBlockedUsers(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list blocks", err)
+		return
+	}
+	resp := make([]BlockedUser, len(blocks))
+	for i, b := range blocks {
+		resp[i] = BlockedUser{UserID: b.BlockedID, CreatedAt: b.CreatedAt}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerMuteUser hides the user from the caller only, for an optional
+// duration. Muting again replaces the duration.
+func (cfg *apiConfig) handlerMuteUser(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	targetID, ok := cfg.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	type parameters struct {
+		Duration string `json:"duration"`
+	}
+	params := parameters{}
+	// The body is optional.
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	expiresAt, err := expiryAfter(params.Duration, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	err = cfg.db.MuteUser(r.Context(), database.MuteUserParams{
+		MuterID:   user.ID,
+		MutedID:   targetID,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't mute user", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerUnmuteUser(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	targetID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	n, err := cfg.db.UnmuteUser(r.Context(), database.UnmuteUserParams{
+		MuterID: user.ID,
+		MutedID: targetID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't unmute user", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "You haven't muted that user", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerListMutes lists mutes that haven't expired.
+func (cfg *apiConfig) handlerListMutes(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	mutes, err := cfg.db.ListMutedUsers(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list mutes", err)
+		return
+	}
+	resp := make([]MutedUser, len(mutes))
+	for i, m := range mutes {
+		resp[i] = MutedUser{UserID: m.MutedID, CreatedAt: m.CreatedAt, ExpiresAt: nullTimePtr(m.ExpiresAt)}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerCreateKeywordMute hides chirps containing keyword, ignoring case,
+// for an optional duration.
+func (cfg *apiConfig) handlerCreateKeywordMute(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	type parameters struct {
+		Keyword  string `json:"keyword"`
+		Duration string `json:"duration"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	keyword := strings.TrimSpace(params.Keyword)
+	if keyword == "" || len([]rune(keyword)) > maxKeywordLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("keyword must be 1 to %d characters", maxKeywordLength), errors.New("invalid keyword"))
+		return
+	}
+	expiresAt, err := expiryAfter(params.Duration, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	mute, err := cfg.db.CreateKeywordMute(r.Context(), database.CreateKeywordMuteParams{
+		UserID:    user.ID,
+		Keyword:   keyword,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't mute keyword", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, keywordMuteFromDB(mute))
+}
+
+func (cfg *apiConfig) handlerListKeywordMutes(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	mutes, err := cfg.db.ListKeywordMutes(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list keyword mutes", err)
+		return
+	}
+	resp := make([]KeywordMute, len(mutes))
+	for i, m := range mutes {
+		resp[i] = keywordMuteFromDB(m)
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerDeleteKeywordMute(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("keywordMuteId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	n, err := cfg.db.DeleteKeywordMute(r.Context(), database.DeleteKeywordMuteParams{
+		ID:     id,
+		UserID: user.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete keyword mute", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "Couldn't find keyword mute", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
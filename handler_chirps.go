@@ -1,14 +1,19 @@
 package main
 
 import (
-	"chirpy/internal/auth"
 	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
@@ -25,21 +30,41 @@ func (cfg *apiConfig) handlerGetChirpById(w http.ResponseWriter, r *http.Request
 	v := r.PathValue("chirpId")
 	chirpId, err := uuid.Parse(v)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Coulnd't parse id", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
 		return
 	}
 	chirp, err := cfg.db.GetChirpById(r.Context(), chirpId)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
 		respondWithError(w, http.StatusNotFound, "couldn't find chrip", err)
 		return
 	}
-	respondWithJSON(w, http.StatusOK, Chirp{
-		ID:        chirp.ID,
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
-		Body:      chirp.Body,
-		UserId:    chirp.UserID,
-	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chirp", err)
+		return
+	}
+	// Blocks hide chirps both ways; mutes only hide them from lists.
+	if viewer, ok := userFromContext(r.Context()); ok {
+		blocked, err := cfg.db.IsBlockedBetween(r.Context(), database.IsBlockedBetweenParams{
+			UserA: viewer.ID,
+			UserB: chirp.UserID,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check blocks", err)
+			return
+		}
+		if blocked {
+			respondWithError(w, http.StatusNotFound, "couldn't find chrip", nil)
+			return
+		}
+	}
+	resp := chirpFromDB(chirp)
+	etag := etagFor(resp)
+	setValidators(w, etag, chirp.UpdatedAt)
+	if notModified(r, etag, chirp.UpdatedAt) {
+		respondNotModified(w)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
 }
 
 func (cfg *apiConfig) handlerGetAllChirps(w http.ResponseWriter, r *http.Request) {
@@ -49,7 +74,8 @@ func (cfg *apiConfig) handlerGetAllChirps(w http.ResponseWriter, r *http.Request
 	if s != "" {
 		authorId, err := uuid.Parse(s)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "invalid author id", err)
+			respondWithError(w, http.StatusBadRequest, "invalid author id", err)
+			return
 		}
 		dbChirps, err = cfg.db.GetAllChirpsFromAuthor(r.Context(), authorId)
 		if err != nil {
@@ -64,6 +90,16 @@ func (cfg *apiConfig) handlerGetAllChirps(w http.ResponseWriter, r *http.Request
 		}
 	}
 
+	viewer, _ := userFromContext(r.Context())
+	visible, err := cfg.visibilityFor(r.Context(), viewer.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't load blocks and mutes", err)
+		return
+	}
+	dbChirps = slices.DeleteFunc(dbChirps, func(c database.Chirp) bool {
+		return visible.hides(c.UserID, c.Body)
+	})
+
 	s = r.URL.Query().Get("sort")
 	if s == "desc" {
 		sort.Slice(dbChirps, func(i, j int) bool {
@@ -82,19 +118,21 @@ func (cfg *apiConfig) handlerGetAllChirps(w http.ResponseWriter, r *http.Request
 		}
 	}
 
+	// Deletes don't leave an updated_at behind, so lists only get an ETag.
+	etag := etagFor(chirps)
+	setValidators(w, etag, time.Time{})
+	if notModified(r, etag, time.Time{}) {
+		respondNotModified(w)
+		return
+	}
 	respondWithJSON(w, http.StatusOK, chirps)
 
 }
 
 func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.secret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		respondUnauthorized(w, false, errors.New("no user in request context"))
 		return
 	}
 
@@ -108,15 +146,23 @@ func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	cleanedBody, err := validateChirp(params.Body)
+	cleanedBody, err := validateChirp(params.Body, cfg.entitlementsFor(user).MaxChirpLength)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid chirp", err)
+		respondWithProblem(w, chirpProblem(err))
 		return
 	}
 
-	storedChirp, err := cfg.db.CreateChirp(r.Context(), database.CreateChirpParams{
-		Body:   cleanedBody,
-		UserID: userID,
+	var storedChirp database.Chirp
+	err = cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		storedChirp, err = q.CreateChirp(r.Context(), database.CreateChirpParams{
+			Body:   cleanedBody,
+			UserID: user.ID,
+		})
+		if err != nil {
+			return err
+		}
+		return events.Record(r.Context(), q, events.ChirpCreated, user.ID, events.ChirpFromDB(storedChirp))
 	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp", err)
@@ -130,53 +176,164 @@ func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request)
 		Body:      storedChirp.Body,
 		UserId:    storedChirp.UserID,
 	}
+	setValidators(w, etagFor(data), storedChirp.UpdatedAt)
 	respondWithJSON(w, http.StatusCreated, data)
 
 }
 
 func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.secret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		respondUnauthorized(w, false, errors.New("no user in request context"))
 		return
 	}
 
 	v := r.PathValue("chirpId")
 	chirpId, err := uuid.Parse(v)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Coulnd't parse id", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
 		return
 	}
 
 	chirp, err := cfg.db.GetChirpById(r.Context(), chirpId)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
 		respondWithError(w, http.StatusNotFound, "couldn't find chrip", err)
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chirp", err)
+		return
+	}
+
+	if chirp.UserID != user.ID {
+		respondWithError(w, http.StatusForbidden, "not your chirp", nil)
+		return
+	}
+	if preconditionFailed(r, etagFor(chirpFromDB(chirp))) {
+		respondPreconditionFailed(w)
+		return
+	}
 
-	if chirp.UserID != userID {
+	err = cfg.deleteChirp(r.Context(), chirp)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete chirp", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-		respondWithError(w, http.StatusForbidden, "not your chirp", err)
+// handlerUpdateChirp lets an author fix a chirp within their plan's edit
+// window.
+func (cfg *apiConfig) handlerUpdateChirp(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		respondUnauthorized(w, false, errors.New("no user in request context"))
 		return
 	}
 
-	err = cfg.db.DeleteChirpById(r.Context(), chirpId)
+	chirpId, err := uuid.Parse(r.PathValue("chirpId"))
 	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	chirp, err := cfg.db.GetChirpById(r.Context(), chirpId)
+	if errors.Is(err, sql.ErrNoRows) {
 		respondWithError(w, http.StatusNotFound, "couldn't find chrip", err)
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chirp", err)
+		return
+	}
+	if chirp.UserID != user.ID {
+		respondWithError(w, http.StatusForbidden, "not your chirp", nil)
+		return
+	}
+	if preconditionFailed(r, etagFor(chirpFromDB(chirp))) {
+		respondPreconditionFailed(w)
+		return
+	}
+	ent := cfg.entitlementsFor(user)
+	if !canEditChirp(chirp, ent.EditWindow.Duration, time.Now()) {
+		respondWithError(w, http.StatusForbidden, "This chirp can no longer be edited", fmt.Errorf("edit window of %v has passed", ent.EditWindow))
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	cleanedBody, err := validateChirp(params.Body, ent.MaxChirpLength)
+	if err != nil {
+		respondWithProblem(w, chirpProblem(err))
+		return
+	}
+
+	var updated database.Chirp
+	err = cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		updated, err = q.UpdateChirpBody(r.Context(), database.UpdateChirpBodyParams{
+			ID:        chirp.ID,
+			Body:      cleanedBody,
+			UpdatedAt: chirp.UpdatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		return events.Record(r.Context(), q, events.ChirpUpdated, user.ID, events.ChirpFromDB(updated))
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// Someone else updated the chirp after we read it.
+		respondPreconditionFailed(w)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update chirp", err)
+		return
+	}
+	resp := chirpFromDB(updated)
+	setValidators(w, etagFor(resp), updated.UpdatedAt)
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func chirpFromDB(c database.Chirp) Chirp {
+	return Chirp{
+		ID:        c.ID,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		Body:      c.Body,
+		UserId:    c.UserID,
+	}
+}
+
+// deleteChirp removes chirp and tells its author's integrations.
+func (cfg *apiConfig) deleteChirp(ctx context.Context, chirp database.Chirp) error {
+	return cfg.db.InTx(ctx, func(q database.DBInterface) error {
+		if err := q.DeleteChirpById(ctx, chirp.ID); err != nil {
+			return err
+		}
+		return events.Record(ctx, q, events.ChirpDeleted, chirp.UserID, events.ChirpFromDB(chirp))
+	})
+}
+
+// canEditChirp reports whether chirp was posted less than window ago.
+func canEditChirp(chirp database.Chirp, window time.Duration, now time.Time) bool {
+	return window > 0 && now.Sub(chirp.CreatedAt) < window
+}
+
+// chirpProblem reports a body validateChirp rejected.
+func chirpProblem(err error) *Problem {
+	return validationProblem("Invalid chirp", FieldError{Field: "body", Message: err.Error()})
 }
 
-func validateChirp(chirp string) (string, error) {
-	const maxChirpLength = 140
-	if len(chirp) > maxChirpLength {
-		return "", errors.New("chirp is too long")
+func validateChirp(chirp string, maxChirpLength int) (string, error) {
+	if utf8.RuneCountInString(chirp) > maxChirpLength {
+		return "", fmt.Errorf("chirp is too long, the limit is %d characters", maxChirpLength)
 	}
 
 	profanities := make(map[string]interface{})
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/pagination"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxConversationMembers includes the user starting the conversation.
+	maxConversationMembers = 10
+	maxMessageLength       = 1000
+	defaultMessageLimit    = 50
+	maxMessageLimit        = 100
+)
+
+type Conversation struct {
+	ID          uuid.UUID            `json:"id"`
+	CreatedAt   time.Time            `json:"created_at"`
+	UpdatedAt   time.Time            `json:"updated_at"`
+	Members     []ConversationMember `json:"members,omitempty"`
+	UnreadCount int64                `json:"unread_count"`
+}
+
+// ConversationMember's LastReadAt is their read receipt: they've seen
+// every message sent up to then.
+type ConversationMember struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	LastReadAt *time.Time `json:"last_read_at"`
+}
+
+type DirectMessage struct {
+	ID             uuid.UUID   `json:"id"`
+	CreatedAt      time.Time   `json:"created_at"`
+	ConversationID uuid.UUID   `json:"conversation_id"`
+	SenderID       uuid.UUID   `json:"sender_id"`
+	Body           string      `json:"body"`
+	ReadBy         []uuid.UUID `json:"read_by"`
+}
+
+func conversationMembersFromDB(members []database.ConversationMember) []ConversationMember {
+	out := make([]ConversationMember, len(members))
+	for i, m := range members {
+		out[i] = ConversationMember{UserID: m.UserID}
+		if m.LastReadAt.Valid {
+			out[i].LastReadAt = &m.LastReadAt.Time
+		}
+	}
+	return out
+}
+
+// directMessageFromDB fills in which of the other members have read m.
+func directMessageFromDB(m database.Message, members []database.ConversationMember) DirectMessage {
+	readBy := []uuid.UUID{}
+	for _, member := range members {
+		if member.UserID != m.SenderID && member.LastReadAt.Valid && !member.LastReadAt.Time.Before(m.CreatedAt) {
+			readBy = append(readBy, member.UserID)
+		}
+	}
+	return DirectMessage{
+		ID:             m.ID,
+		CreatedAt:      m.CreatedAt,
+		ConversationID: m.ConversationID,
+		SenderID:       m.SenderID,
+		Body:           m.Body,
+		ReadBy:         readBy,
+	}
+}
+
+// handlerCreateConversation starts a conversation with member_ids. Asking
+// for a one-to-one conversation that already exists returns it instead.
+func (cfg *apiConfig) handlerCreateConversation(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	type parameters struct {
+		MemberIDs []uuid.UUID `json:"member_ids"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	var others []uuid.UUID
+	for _, id := range params.MemberIDs {
+		if id != user.ID && !slices.Contains(others, id) {
+			others = append(others, id)
+		}
+	}
+	if len(others) == 0 {
+		respondWithError(w, http.StatusBadRequest, "A conversation needs someone else in it", errors.New("no other members"))
+		return
+	}
+	if len(others)+1 > maxConversationMembers {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("A conversation can have at most %d members", maxConversationMembers), errors.New("too many members"))
+		return
+	}
+	for _, id := range others {
+		if _, err := cfg.db.GetUserByID(r.Context(), id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondWithError(w, http.StatusNotFound, "Couldn't find user "+id.String(), err)
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't look up members", err)
+			return
+		}
+		blocked, err := cfg.db.IsBlockedBetween(r.Context(), database.IsBlockedBetweenParams{
+			UserA: user.ID,
+			UserB: id,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check blocks", err)
+			return
+		}
+		if blocked {
+			respondWithError(w, http.StatusForbidden, "You can't message user "+id.String(), errors.New("blocked"))
+			return
+		}
+	}
+
+	var conversation database.Conversation
+	code := http.StatusCreated
+	err := cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		if len(others) == 1 {
+			// The pair is unique, so of two requests racing to start the
+			// same conversation only one inserts it; the other finds it.
+			conversation, err = q.CreateDirectConversation(r.Context(), database.CreateDirectConversationParams{
+				CreatedBy: user.ID,
+				OtherID:   others[0],
+			})
+			if errors.Is(err, sql.ErrNoRows) {
+				code = http.StatusOK
+				conversation, err = q.FindDirectConversation(r.Context(), database.FindDirectConversationParams{
+					UserA: user.ID,
+					UserB: others[0],
+				})
+				return err
+			}
+		} else {
+			conversation, err = q.CreateConversation(r.Context(), uuid.NullUUID{UUID: user.ID, Valid: true})
+		}
+		if err != nil {
+			return err
+		}
+		for _, id := range append([]uuid.UUID{user.ID}, others...) {
+			err := q.AddConversationMember(r.Context(), database.AddConversationMemberParams{
+				ConversationID: conversation.ID,
+				UserID:         id,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create conversation", err)
+		return
+	}
+	cfg.respondWithConversation(w, r, code, conversation)
+}
+
+func (cfg *apiConfig) respondWithConversation(w http.ResponseWriter, r *http.Request, code int, c database.Conversation) {
+	members, err := cfg.db.ListConversationMembers(r.Context(), c.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list members", err)
+		return
+	}
+	respondWithJSON(w, code, Conversation{
+		ID:        c.ID,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		Members:   conversationMembersFromDB(members),
+	})
+}
+
+// handlerListConversations lists the user's conversations, most recently
+// active first, with how many messages they haven't read in each.
+func (cfg *apiConfig) handlerListConversations(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	rows, err := cfg.db.ListConversationsForUser(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list conversations", err)
+		return
+	}
+	conversations := make([]Conversation, len(rows))
+	for i, c := range rows {
+		conversations[i] = Conversation{
+			ID:          c.ID,
+			CreatedAt:   c.CreatedAt,
+			UpdatedAt:   c.UpdatedAt,
+			UnreadCount: c.UnreadCount,
+		}
+	}
+	respondWithJSON(w, http.StatusOK, conversations)
+}
+
+// conversationForRequest loads the {conversationId} conversation if the
+// user is one of its members. Anyone else is told it doesn't exist.
+func (cfg *apiConfig) conversationForRequest(w http.ResponseWriter, r *http.Request) (database.Conversation, bool) {
+	user, _ := userFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("conversationId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return database.Conversation{}, false
+	}
+	conversation, err := cfg.db.GetConversationForMember(r.Context(), database.GetConversationForMemberParams{
+		ID:     id,
+		UserID: user.ID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find conversation", err)
+		return database.Conversation{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get conversation", err)
+		return database.Conversation{}, false
+	}
+	return conversation, true
+}
+
+func (cfg *apiConfig) handlerGetConversation(w http.ResponseWriter, r *http.Request) {
+	conversation, ok := cfg.conversationForRequest(w, r)
+	if !ok {
+		return
+	}
+	cfg.respondWithConversation(w, r, http.StatusOK, conversation)
+}
+
+// handlerListMessages returns a conversation's messages newest first, a
+// page at a time; ?cursor= continues from a previous page's next_cursor.
+func (cfg *apiConfig) handlerListMessages(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Messages   []DirectMessage `json:"messages"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}
+	conversation, ok := cfg.conversationForRequest(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultMessageLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxMessageLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 100", errors.New("invalid limit"))
+			return
+		}
+	}
+	params := database.ListMessagesParams{
+		ConversationID: conversation.ID,
+		MaxResults:     int32(limit),
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		before, id, err := pagination.DecodeCursor(cursor)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+		params.BeforeTime = sql.NullTime{Time: before, Valid: true}
+		params.BeforeID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	dbMessages, err := cfg.db.ListMessages(r.Context(), params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list messages", err)
+		return
+	}
+	members, err := cfg.db.ListConversationMembers(r.Context(), conversation.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list members", err)
+		return
+	}
+	resp := response{Messages: make([]DirectMessage, len(dbMessages))}
+	for i, m := range dbMessages {
+		resp.Messages[i] = directMessageFromDB(m, members)
+	}
+	if len(dbMessages) == limit {
+		last := dbMessages[len(dbMessages)-1]
+		resp.NextCursor = pagination.EncodeCursor(last.CreatedAt, last.ID)
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerSendMessage(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	conversation, ok := cfg.conversationForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	if strings.TrimSpace(params.Body) == "" {
+		respondWithError(w, http.StatusBadRequest, "Message is empty", errors.New("empty message"))
+		return
+	}
+	if len([]rune(params.Body)) > maxMessageLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Message is too long, the limit is %d characters", maxMessageLength), errors.New("message too long"))
+		return
+	}
+	// A block between the sender and any member closes the conversation.
+	blocked, err := cfg.db.ConversationHasBlock(r.Context(), database.ConversationHasBlockParams{
+		UserID:         user.ID,
+		ConversationID: conversation.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check blocks", err)
+		return
+	}
+	if blocked {
+		respondWithError(w, http.StatusForbidden, "You can't message this conversation", errors.New("blocked"))
+		return
+	}
+
+	var message database.Message
+	err = cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		message, err = q.CreateMessage(r.Context(), database.CreateMessageParams{
+			ConversationID: conversation.ID,
+			SenderID:       user.ID,
+			Body:           params.Body,
+		})
+		if err != nil {
+			return err
+		}
+		if err := q.TouchConversation(r.Context(), conversation.ID); err != nil {
+			return err
+		}
+		// Senders have read their own message and everything before it.
+		return q.MarkConversationRead(r.Context(), database.MarkConversationReadParams{
+			ReadAt:         message.CreatedAt,
+			ConversationID: conversation.ID,
+			UserID:         user.ID,
+		})
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send message", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, directMessageFromDB(message, nil))
+}
+
+// handlerMarkConversationRead moves the user's read receipt up to the
+// latest message.
+func (cfg *apiConfig) handlerMarkConversationRead(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	conversation, ok := cfg.conversationForRequest(w, r)
+	if !ok {
+		return
+	}
+	latest, err := cfg.db.ListMessages(r.Context(), database.ListMessagesParams{
+		ConversationID: conversation.ID,
+		MaxResults:     1,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get the latest message", err)
+		return
+	}
+	if len(latest) > 0 {
+		err := cfg.db.MarkConversationRead(r.Context(), database.MarkConversationReadParams{
+			ReadAt:         latest[0].CreatedAt,
+			ConversationID: conversation.ID,
+			UserID:         user.ID,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't mark the conversation read", err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/entitlements"
+	"net/http"
+)
+
+func planFor(user database.User) entitlements.Plan {
+	if user.IsChirpyRed {
+		return entitlements.PlanRed
+	}
+	return entitlements.PlanFree
+}
+
+// entitlementsFor is what user's plan currently lets them do. Handlers
+// should check this rather than is_chirpy_red.
+func (cfg *apiConfig) entitlementsFor(user database.User) entitlements.Entitlements {
+	return cfg.entitlements.For(planFor(user))
+}
+
+// badgesFor never returns nil, so users without badges get an empty list.
+func (cfg *apiConfig) badgesFor(user database.User) []string {
+	badges := cfg.entitlementsFor(user).Badges
+	if badges == nil {
+		return []string{}
+	}
+	return badges
+}
+
+func (cfg *apiConfig) handlerGetEntitlements(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	type response struct {
+		Plan entitlements.Plan `json:"plan"`
+		entitlements.Entitlements
+	}
+	ent := cfg.entitlementsFor(user)
+	ent.Badges = cfg.badgesFor(user)
+	respondWithJSON(w, http.StatusOK, response{
+		Plan:         planFor(user),
+		Entitlements: ent,
+	})
+}
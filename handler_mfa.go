@@ -0,0 +1,274 @@
+package main
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+func (cfg *apiConfig) handlerEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	if user.TotpEnabled {
+		respondWithError(w, http.StatusConflict, "two-factor authentication is already enabled", nil)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't generate a secret", err)
+		return
+	}
+	err = cfg.db.SetUserTOTPSecret(r.Context(), database.SetUserTOTPSecretParams{
+		ID:         user.ID,
+		TotpSecret: sql.NullString{String: secret, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't save the secret", err)
+		return
+	}
+
+	type response struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(secret, user.Email),
+	})
+}
+
+func (cfg *apiConfig) handlerConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	if user.TotpEnabled || !user.TotpSecret.Valid {
+		respondWithError(w, http.StatusConflict, "no pending two-factor enrollment", nil)
+		return
+	}
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	if err := cfg.checkTOTPCode(r.Context(), user, params.Code); err != nil {
+		respondWithProblem(w, validationProblem("invalid code", FieldError{Field: "code", Message: "code doesn't match the authenticator"}))
+		return
+	}
+
+	// Two-factor only turns on along with recovery codes the user gets to
+	// see, so a failure part way can't lock them out.
+	var codes []string
+	err := cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		if err := q.EnableUserTOTP(r.Context(), user.ID); err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(r.Context(), q, user)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't enable two-factor authentication", err)
+		return
+	}
+
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+func (cfg *apiConfig) handlerDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	if !user.TotpEnabled {
+		respondWithError(w, http.StatusConflict, "two-factor authentication is not enabled", nil)
+		return
+	}
+
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	if err := cfg.checkSecondFactor(r.Context(), user, params.Code, params.RecoveryCode); err != nil {
+		// The session is fine; it just can't turn off two-factor without it.
+		respondWithError(w, http.StatusForbidden, "invalid code", err)
+		return
+	}
+
+	// The recovery codes go with two-factor, so none outlive it.
+	err := cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		if err := q.DisableUserTOTP(r.Context(), user.ID); err != nil {
+			return err
+		}
+		return q.DeleteRecoveryCodes(r.Context(), user.ID)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't disable two-factor authentication", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondWithMFAChallenge answers a login for a user with two-factor
+// authentication with a short-lived token for handlerLoginMFA instead of
+// a session.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user database.User) {
+	if isSuspended(user, time.Now()) {
+		respondSuspended(w, user)
+		return
+	}
+	mfaToken, err := auth.MakeMFAChallengeToken(user.ID, cfg.secret, 5*time.Minute)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't create an mfa challenge", err)
+		return
+	}
+	type mfaChallenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+	respondWithJSON(w, http.StatusOK, mfaChallenge{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	})
+}
+
+// handlerLoginMFA exchanges the challenge token from handlerLogin and a
+// second factor for the usual access and refresh tokens.
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+
+	opts := cfg.jwtOptions
+	opts.TokenType = auth.TokenTypeMFAChallenge
+	claims, err := auth.ValidateJWTWithOptions(params.MFAToken, cfg.secret, opts)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "invalid mfa token", err)
+		return
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "invalid mfa token", err)
+		return
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusUnauthorized, "invalid mfa token", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	email := strings.ToLower(user.Email)
+	if wait, ok := cfg.accountLockout.Check(email); !ok {
+		respondTooManyAttempts(w, wait)
+		return
+	}
+	if err := cfg.checkSecondFactor(r.Context(), user, params.Code, params.RecoveryCode); err != nil {
+		cfg.accountLockout.Fail(email)
+		respondWithError(w, http.StatusUnauthorized, "invalid code", err)
+		return
+	}
+	cfg.accountLockout.Reset(email)
+
+	cfg.respondWithSession(w, r, user)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused
+// recovery code, consuming whichever one was given.
+func (cfg *apiConfig) checkSecondFactor(ctx context.Context, user database.User, code, recoveryCode string) error {
+	if !user.TotpEnabled {
+		return errors.New("two-factor authentication is not enabled")
+	}
+	if code != "" {
+		return cfg.checkTOTPCode(ctx, user, code)
+	}
+	if recoveryCode == "" {
+		return errors.New("no code given")
+	}
+	n, err := cfg.db.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+		UserID:   user.ID,
+		CodeHash: auth.HashRecoveryCode(recoveryCode),
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("unknown or used recovery code")
+	}
+	return nil
+}
+
+// checkTOTPCode validates code and records its time step so the same code
+// can't be replayed.
+func (cfg *apiConfig) checkTOTPCode(ctx context.Context, user database.User, code string) error {
+	if !user.TotpSecret.Valid {
+		return errors.New("no totp secret")
+	}
+	step, err := auth.ValidateTOTP(user.TotpSecret.String, code, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := cfg.db.UseUserTOTPStep(ctx, database.UseUserTOTPStepParams{
+		ID:           user.ID,
+		TotpLastStep: sql.NullInt64{Int64: step, Valid: true},
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("totp code for step %d already used", step)
+	}
+	return nil
+}
+
+// replaceRecoveryCodes discards user's recovery codes and stores hashes of
+// a fresh set, returning the plain codes to be shown once.
+func replaceRecoveryCodes(ctx context.Context, q database.DBInterface, user database.User) ([]string, error) {
+	if err := q.DeleteRecoveryCodes(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		err := q.CreateRecoveryCode(ctx, database.CreateRecoveryCodeParams{
+			UserID:   user.ID,
+			CodeHash: auth.HashRecoveryCode(code),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
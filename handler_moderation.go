@@ -0,0 +1,442 @@
+package main
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"chirpy/internal/moderation"
+	"chirpy/internal/pagination"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultModerationLimit = 20
+	maxModerationLimit     = 100
+)
+
+var (
+	errSuspended   = errors.New("account is suspended")
+	errReportTaken = errors.New("report is resolved or claimed by another moderator")
+)
+
+type ModerationAction struct {
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ModeratorID  uuid.UUID  `json:"moderator_id"`
+	Action       string     `json:"action"`
+	ReportID     *uuid.UUID `json:"report_id"`
+	TargetUserID *uuid.UUID `json:"target_user_id"`
+	ChirpID      *uuid.UUID `json:"chirp_id"`
+	Note         string     `json:"note"`
+}
+
+func moderationActionFromDB(a database.ModerationAction) ModerationAction {
+	return ModerationAction{
+		ID:           a.ID,
+		CreatedAt:    a.CreatedAt,
+		ModeratorID:  a.ModeratorID,
+		Action:       a.Action,
+		ReportID:     nullUUIDPtr(a.ReportID),
+		TargetUserID: nullUUIDPtr(a.TargetUserID),
+		ChirpID:      nullUUIDPtr(a.ChirpID),
+		Note:         a.Note,
+	}
+}
+
+// isSuspended reports whether user is suspended at now.
+func isSuspended(user database.User, now time.Time) bool {
+	return user.SuspendedAt.Valid && (!user.SuspendedUntil.Valid || now.Before(user.SuspendedUntil.Time))
+}
+
+func respondSuspended(w http.ResponseWriter, user database.User) {
+	msg := "Your account is suspended"
+	if user.SuspendedUntil.Valid {
+		msg += " until " + user.SuspendedUntil.Time.UTC().Format(time.RFC3339)
+	}
+	respondWithError(w, http.StatusForbidden, msg, errSuspended)
+}
+
+// handlerListReports pages through the moderation queue, oldest first.
+// ?status= picks open (the default), claimed or resolved reports.
+func (cfg *apiConfig) handlerListReports(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Reports    []Report `json:"reports"`
+		NextCursor string   `json:"next_cursor,omitempty"`
+	}
+	query := r.URL.Query()
+
+	status := moderation.StatusOpen
+	if s := query.Get("status"); s != "" {
+		var err error
+		status, err = moderation.ParseStatus(s)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid status", err)
+			return
+		}
+	}
+	limit := defaultModerationLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxModerationLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 100", errors.New("invalid limit"))
+			return
+		}
+	}
+	params := database.ListReportsParams{
+		Status:     sql.NullString{String: string(status), Valid: true},
+		MaxResults: int32(limit),
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, id, err := pagination.DecodeCursor(cursor)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+		params.AfterTime = sql.NullTime{Time: after, Valid: true}
+		params.AfterID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	reports, err := cfg.db.ListReports(r.Context(), params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list reports", err)
+		return
+	}
+	resp := response{Reports: make([]Report, len(reports))}
+	for i, report := range reports {
+		resp.Reports[i] = reportFromDB(report)
+	}
+	if len(reports) == limit {
+		last := reports[len(reports)-1]
+		resp.NextCursor = pagination.EncodeCursor(last.CreatedAt, last.ID)
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// reportForRequest loads the {reportId} report, responding with an error
+// if it can't.
+func (cfg *apiConfig) reportForRequest(w http.ResponseWriter, r *http.Request) (database.Report, bool) {
+	id, err := uuid.Parse(r.PathValue("reportId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return database.Report{}, false
+	}
+	report, err := cfg.db.GetReport(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find report", err)
+		return database.Report{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up report", err)
+		return database.Report{}, false
+	}
+	return report, true
+}
+
+func (cfg *apiConfig) handlerGetReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := cfg.reportForRequest(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reportFromDB(report))
+}
+
+// handlerClaimReport assigns an open report to the moderator so others
+// leave it alone. Claiming a report you already hold is fine.
+func (cfg *apiConfig) handlerClaimReport(w http.ResponseWriter, r *http.Request) {
+	moderator, _ := userFromContext(r.Context())
+	report, ok := cfg.reportForRequest(w, r)
+	if !ok {
+		return
+	}
+	if report.Status == string(moderation.StatusClaimed) && report.ClaimedBy.UUID == moderator.ID {
+		respondWithJSON(w, http.StatusOK, reportFromDB(report))
+		return
+	}
+
+	var claimed database.Report
+	err := cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		claimed, err = q.ClaimReport(r.Context(), database.ClaimReportParams{
+			ID:        report.ID,
+			ClaimedBy: uuid.NullUUID{UUID: moderator.ID, Valid: true},
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return errReportTaken
+		}
+		if err != nil {
+			return err
+		}
+		return q.CreateModerationAction(r.Context(), database.CreateModerationActionParams{
+			ModeratorID:  moderator.ID,
+			Action:       string(moderation.ActionClaim),
+			ReportID:     uuid.NullUUID{UUID: report.ID, Valid: true},
+			TargetUserID: uuid.NullUUID{UUID: report.ReportedUserID, Valid: true},
+			ChirpID:      report.ChirpID,
+		})
+	})
+	if errors.Is(err, errReportTaken) {
+		respondWithError(w, http.StatusConflict, "Report is already claimed or resolved", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't claim report", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reportFromDB(claimed))
+}
+
+// handlerUnclaimReport puts a claimed report back in the queue. The
+// moderator holding it can let it go, and an admin can take it from a
+// moderator who isn't getting to it, so someone else can claim it.
+func (cfg *apiConfig) handlerUnclaimReport(w http.ResponseWriter, r *http.Request) {
+	moderator, _ := userFromContext(r.Context())
+	report, ok := cfg.reportForRequest(w, r)
+	if !ok {
+		return
+	}
+	if report.Status != string(moderation.StatusClaimed) {
+		respondWithError(w, http.StatusConflict, "Report isn't claimed", errReportTaken)
+		return
+	}
+	if report.ClaimedBy.UUID != moderator.ID && !auth.Role(moderator.Role).AtLeast(auth.RoleAdmin) {
+		respondWithError(w, http.StatusForbidden, "Only the moderator holding a report or an admin can unclaim it", nil)
+		return
+	}
+
+	var unclaimed database.Report
+	err := cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		unclaimed, err = q.UnclaimReport(r.Context(), database.UnclaimReportParams{
+			ID:        report.ID,
+			ClaimedBy: report.ClaimedBy,
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return errReportTaken
+		}
+		if err != nil {
+			return err
+		}
+		return q.CreateModerationAction(r.Context(), database.CreateModerationActionParams{
+			ModeratorID:  moderator.ID,
+			Action:       string(moderation.ActionUnclaim),
+			ReportID:     uuid.NullUUID{UUID: report.ID, Valid: true},
+			TargetUserID: uuid.NullUUID{UUID: report.ReportedUserID, Valid: true},
+			ChirpID:      report.ChirpID,
+		})
+	})
+	if errors.Is(err, errReportTaken) {
+		respondWithError(w, http.StatusConflict, "Report was resolved or unclaimed in the meantime", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't unclaim report", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reportFromDB(unclaimed))
+}
+
+// handlerResolveReport closes a report that is open or claimed by the
+// moderator, by dismissing it, hiding the reported chirp or suspending the
+// reported user, and records what was done in the audit trail.
+func (cfg *apiConfig) handlerResolveReport(w http.ResponseWriter, r *http.Request) {
+	moderator, _ := userFromContext(r.Context())
+
+	type parameters struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+		// Duration limits a suspension, e.g. "72h"; without one it lasts
+		// until it's lifted.
+		Duration string `json:"duration"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	action, err := moderation.ParseResolution(params.Action)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "action must be dismiss, hide_chirp or suspend_user", err)
+		return
+	}
+	suspendedUntil, err := expiryAfter(params.Duration, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	report, ok := cfg.reportForRequest(w, r)
+	if !ok {
+		return
+	}
+	if action == moderation.ActionHideChirp && !report.ChirpID.Valid {
+		respondWithError(w, http.StatusBadRequest, "This report isn't about a chirp", errors.New("no chirp to hide"))
+		return
+	}
+	if action == moderation.ActionSuspendUser {
+		target, err := cfg.db.GetUserByID(r.Context(), report.ReportedUserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, http.StatusNotFound, "Couldn't find user", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+			return
+		}
+		if auth.Role(target.Role).AtLeast(auth.Role(moderator.Role)) {
+			respondWithError(w, http.StatusForbidden, "You can't suspend a user with your role or higher", fmt.Errorf("%s can't suspend %s", moderator.Role, target.Role))
+			return
+		}
+	}
+
+	var resolved database.Report
+	err = cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		resolved, err = q.ResolveReport(r.Context(), database.ResolveReportParams{
+			Resolution:  sql.NullString{String: string(action), Valid: true},
+			ModeratorID: uuid.NullUUID{UUID: moderator.ID, Valid: true},
+			ID:          report.ID,
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return errReportTaken
+		}
+		if err != nil {
+			return err
+		}
+		switch action {
+		case moderation.ActionHideChirp:
+			// The chirp may already be hidden or deleted; either way it's
+			// gone. Otherwise subscribers hear it was deleted, so streams
+			// and webhooks drop it.
+			chirp, err := q.HideChirp(r.Context(), report.ChirpID.UUID)
+			if errors.Is(err, sql.ErrNoRows) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := events.Record(r.Context(), q, events.ChirpDeleted, chirp.UserID, events.ChirpFromDB(chirp)); err != nil {
+				return err
+			}
+		case moderation.ActionSuspendUser:
+			_, err := q.SuspendUser(r.Context(), database.SuspendUserParams{
+				ID:             report.ReportedUserID,
+				SuspendedUntil: suspendedUntil,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return q.CreateModerationAction(r.Context(), database.CreateModerationActionParams{
+			ModeratorID:  moderator.ID,
+			Action:       string(action),
+			ReportID:     uuid.NullUUID{UUID: report.ID, Valid: true},
+			TargetUserID: uuid.NullUUID{UUID: report.ReportedUserID, Valid: true},
+			ChirpID:      report.ChirpID,
+			Note:         params.Note,
+		})
+	})
+	if errors.Is(err, errReportTaken) {
+		respondWithError(w, http.StatusConflict, "Report is already resolved or claimed by another moderator", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve report", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reportFromDB(resolved))
+}
+
+// handlerUnsuspendUser lifts a user's suspension early.
+func (cfg *apiConfig) handlerUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	moderator, _ := userFromContext(r.Context())
+	userID, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	var n int64
+	err = cfg.db.InTx(r.Context(), func(q database.DBInterface) error {
+		var err error
+		n, err = q.UnsuspendUser(r.Context(), userID)
+		if err != nil || n == 0 {
+			return err
+		}
+		return q.CreateModerationAction(r.Context(), database.CreateModerationActionParams{
+			ModeratorID:  moderator.ID,
+			Action:       string(moderation.ActionUnsuspendUser),
+			TargetUserID: uuid.NullUUID{UUID: userID, Valid: true},
+		})
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lift suspension", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "That user isn't suspended", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerListModerationActions pages through the audit trail, newest
+// first. ?user_id= narrows it to actions taken against one user.
+func (cfg *apiConfig) handlerListModerationActions(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Actions    []ModerationAction `json:"actions"`
+		NextCursor string             `json:"next_cursor,omitempty"`
+	}
+	query := r.URL.Query()
+
+	limit := defaultModerationLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxModerationLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 100", errors.New("invalid limit"))
+			return
+		}
+	}
+	params := database.ListModerationActionsParams{MaxResults: int32(limit)}
+	if s := query.Get("user_id"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't parse user_id", err)
+			return
+		}
+		params.TargetUserID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		before, id, err := pagination.DecodeCursor(cursor)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+		params.BeforeTime = sql.NullTime{Time: before, Valid: true}
+		params.BeforeID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	actions, err := cfg.db.ListModerationActions(r.Context(), params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list moderation actions", err)
+		return
+	}
+	resp := response{Actions: make([]ModerationAction, len(actions))}
+	for i, a := range actions {
+		resp.Actions[i] = moderationActionFromDB(a)
+	}
+	if len(actions) == limit {
+		last := actions[len(actions)-1]
+		resp.NextCursor = pagination.EncodeCursor(last.CreatedAt, last.ID)
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/notifications"
+	"chirpy/internal/pagination"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultNotificationLimit = 20
+	maxNotificationLimit     = 100
+)
+
+type Notification struct {
+	ID        uuid.UUID   `json:"id"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Type      string      `json:"type"`
+	SubjectID uuid.UUID   `json:"subject_id"`
+	ActorIDs  []uuid.UUID `json:"actor_ids"`
+	// Count is how many events were coalesced into this notification.
+	Count   int    `json:"count"`
+	Message string `json:"message"`
+	Read    bool   `json:"read"`
+}
+
+func notificationFromDB(n database.Notification) Notification {
+	actors := n.ActorIds
+	if actors == nil {
+		actors = []uuid.UUID{}
+	}
+	return Notification{
+		ID:        n.ID,
+		CreatedAt: n.CreatedAt,
+		UpdatedAt: n.UpdatedAt,
+		Type:      n.Kind,
+		SubjectID: n.SubjectID,
+		ActorIDs:  actors,
+		Count:     len(n.EventIds),
+		Message:   notifications.Message(notifications.Kind(n.Kind)),
+		Read:      n.ReadAt.Valid,
+	}
+}
+
+// handlerListNotifications returns the user's notifications, most recently
+// updated first, a page at a time. ?unread=true leaves out read ones and
+// ?cursor= continues from a previous page's next_cursor.
+func (cfg *apiConfig) handlerListNotifications(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Notifications []Notification `json:"notifications"`
+		UnreadCount   int64          `json:"unread_count"`
+		NextCursor    string         `json:"next_cursor,omitempty"`
+	}
+	user, _ := userFromContext(r.Context())
+	query := r.URL.Query()
+
+	limit := defaultNotificationLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxNotificationLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 100", errors.New("invalid limit"))
+			return
+		}
+	}
+	params := database.ListNotificationsParams{
+		UserID:     user.ID,
+		UnreadOnly: query.Get("unread") == "true",
+		MaxResults: int32(limit),
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		before, id, err := pagination.DecodeCursor(cursor)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+		params.BeforeTime = sql.NullTime{Time: before, Valid: true}
+		params.BeforeID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	dbNotifications, err := cfg.db.ListNotifications(r.Context(), params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list notifications", err)
+		return
+	}
+	unread, err := cfg.db.CountUnreadNotifications(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count notifications", err)
+		return
+	}
+
+	resp := response{
+		Notifications: make([]Notification, len(dbNotifications)),
+		UnreadCount:   unread,
+	}
+	for i, n := range dbNotifications {
+		resp.Notifications[i] = notificationFromDB(n)
+	}
+	if len(dbNotifications) == limit {
+		last := dbNotifications[len(dbNotifications)-1]
+		resp.NextCursor = pagination.EncodeCursor(last.UpdatedAt, last.ID)
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerMarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("notificationId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	n, err := cfg.db.MarkNotificationRead(r.Context(), database.MarkNotificationReadParams{
+		ID:     id,
+		UserID: user.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't mark the notification read", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "Couldn't find notification", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerMarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	if _, err := cfg.db.MarkAllNotificationsRead(r.Context(), user.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't mark notifications read", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
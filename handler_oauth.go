@@ -0,0 +1,548 @@
+package main
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	oauthCodeTTL        = 5 * time.Minute
+	oauthAccessTokenTTL = time.Hour
+)
+
+type OAuthClient struct {
+	ID           uuid.UUID `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	// ClientSecret is only ever returned when a confidential client is
+	// registered.
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+func oauthClientFromDB(c database.OauthClient) OAuthClient {
+	return OAuthClient{
+		ID:           c.ID,
+		CreatedAt:    c.CreatedAt,
+		Name:         c.Name,
+		RedirectURIs: c.RedirectUris,
+		Confidential: c.SecretHash.Valid,
+	}
+}
+
+// validateRedirectURI only allows absolute https URIs, or http ones on the
+// loopback interface for native apps, without a fragment.
+func validateRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Fragment != "" || u.Host == "" {
+		return fmt.Errorf("redirect uri %q must be absolute and have no fragment", raw)
+	}
+	switch {
+	case u.Scheme == "https":
+		return nil
+	case u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1" || u.Hostname() == "::1"):
+		return nil
+	}
+	return fmt.Errorf("redirect uri %q must use https", raw)
+}
+
+func (cfg *apiConfig) handlerCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Client needs a name", errors.New("empty oauth client name"))
+		return
+	}
+	if len(params.RedirectURIs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Client needs at least one redirect uri", errors.New("no redirect uris"))
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+	}
+
+	var secret string
+	var secretHash sql.NullString
+	if params.Confidential {
+		var hash string
+		var err error
+		secret, hash, err = auth.GenerateOAuthSecret()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate a client secret", err)
+			return
+		}
+		secretHash = sql.NullString{String: hash, Valid: true}
+	}
+
+	client, err := cfg.db.CreateOAuthClient(r.Context(), database.CreateOAuthClientParams{
+		OwnerID:      user.ID,
+		Name:         params.Name,
+		RedirectUris: params.RedirectURIs,
+		SecretHash:   secretHash,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't register the client", err)
+		return
+	}
+
+	res := oauthClientFromDB(client)
+	res.ClientSecret = secret
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+func (cfg *apiConfig) handlerListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	dbClients, err := cfg.db.ListOAuthClientsForOwner(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list clients", err)
+		return
+	}
+	clients := make([]OAuthClient, len(dbClients))
+	for i, c := range dbClients {
+		clients[i] = oauthClientFromDB(c)
+	}
+	respondWithJSON(w, http.StatusOK, clients)
+}
+
+func (cfg *apiConfig) handlerDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	clientID, err := uuid.Parse(r.PathValue("clientId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	n, err := cfg.db.DeleteOAuthClient(r.Context(), database.DeleteOAuthClientParams{
+		ID:      clientID,
+		OwnerID: user.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete the client", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "Couldn't find client", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeRequest is an RFC 6749 authorization request, carried through
+// the consent form as hidden fields.
+type authorizeRequest struct {
+	Client        database.OauthClient
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// oauthRedirectError can be reported back to the client's redirect uri.
+type oauthRedirectError struct {
+	code        string
+	description string
+}
+
+func (e oauthRedirectError) Error() string {
+	return e.code + ": " + e.description
+}
+
+// parseAuthorizeRequest reads an authorization request from the query or
+// posted form. Errors before the redirect uri is known to belong to the
+// client must not be redirected and are returned as plain errors; later
+// ones are an oauthRedirectError.
+func (cfg *apiConfig) parseAuthorizeRequest(r *http.Request) (authorizeRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return authorizeRequest{}, err
+	}
+	clientID, err := uuid.Parse(r.Form.Get("client_id"))
+	if err != nil {
+		return authorizeRequest{}, fmt.Errorf("invalid client_id: %w", err)
+	}
+	client, err := cfg.db.GetOAuthClient(r.Context(), clientID)
+	if err != nil {
+		return authorizeRequest{}, fmt.Errorf("unknown client: %w", err)
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if !slices.Contains(client.RedirectUris, redirectURI) {
+		return authorizeRequest{}, fmt.Errorf("redirect uri %q isn't registered for the client", redirectURI)
+	}
+
+	req := authorizeRequest{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		Scopes:        strings.Fields(r.Form.Get("scope")),
+		State:         r.Form.Get("state"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+	}
+	if rt := r.Form.Get("response_type"); rt != "code" {
+		return req, oauthRedirectError{"unsupported_response_type", "only the code response type is supported"}
+	}
+	if req.CodeChallenge == "" || r.Form.Get("code_challenge_method") != "S256" {
+		return req, oauthRedirectError{"invalid_request", "a S256 PKCE code challenge is required"}
+	}
+	if err := auth.ValidateScopes(req.Scopes); err != nil {
+		return req, oauthRedirectError{"invalid_scope", err.Error()}
+	}
+	return req, nil
+}
+
+// redirect sends the user agent back to the client with params and the
+// request's state.
+func (req authorizeRequest) redirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	u, _ := url.Parse(req.RedirectURI)
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+	<head><title>Authorize {{.Client.Name}}</title></head>
+	<body>
+		<h1>{{.Client.Name}} wants to use your Chirpy account</h1>
+		<p>It is asking to:</p>
+		<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+		{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+		<form method="post" action="/oauth/authorize">
+			<input type="hidden" name="response_type" value="code">
+			<input type="hidden" name="client_id" value="{{.Client.ID}}">
+			<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+			<input type="hidden" name="scope" value="{{.Scope}}">
+			<input type="hidden" name="state" value="{{.State}}">
+			<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+			<input type="hidden" name="code_challenge_method" value="S256">
+			<label>Email <input type="email" name="email" required></label>
+			<label>Password <input type="password" name="password" required></label>
+			<label>Two-factor code, if enabled <input type="text" name="code" autocomplete="one-time-code"></label>
+			<button type="submit" name="action" value="approve">Allow</button>
+			<button type="submit" name="action" value="deny" formnovalidate>Deny</button>
+		</form>
+	</body>
+</html>
+`))
+
+func renderConsent(w http.ResponseWriter, status int, req authorizeRequest, message string) {
+	data := struct {
+		authorizeRequest
+		Scope string
+		Error string
+	}{req, strings.Join(req.Scopes, " "), message}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	consentTemplate.Execute(w, data)
+}
+
+func (cfg *apiConfig) handlerOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, err := cfg.parseAuthorizeRequest(r)
+	var redirectErr oauthRedirectError
+	if errors.As(err, &redirectErr) {
+		req.redirect(w, r, url.Values{"error": {redirectErr.code}, "error_description": {redirectErr.description}})
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid authorization request", err)
+		return
+	}
+	renderConsent(w, http.StatusOK, req, "")
+}
+
+// handlerOAuthApprove handles the consent form: the user signs in and
+// allows or denies the client.
+func (cfg *apiConfig) handlerOAuthApprove(w http.ResponseWriter, r *http.Request) {
+	req, err := cfg.parseAuthorizeRequest(r)
+	var redirectErr oauthRedirectError
+	if errors.As(err, &redirectErr) {
+		req.redirect(w, r, url.Values{"error": {redirectErr.code}, "error_description": {redirectErr.description}})
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid authorization request", err)
+		return
+	}
+	if r.PostForm.Get("action") != "approve" {
+		req.redirect(w, r, url.Values{"error": {"access_denied"}})
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	user, err := cfg.checkPassword(r, email, r.PostForm.Get("password"))
+	var locked lockedOutError
+	if errors.As(err, &locked) {
+		setRetryAfter(w, locked.wait)
+		renderConsent(w, http.StatusTooManyRequests, req, "Too many failed login attempts, try again later.")
+		return
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		renderConsent(w, http.StatusUnauthorized, req, "Invalid email or password.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check credentials", err)
+		return
+	}
+	if isSuspended(user, time.Now()) {
+		renderConsent(w, http.StatusForbidden, req, "This account is suspended.")
+		return
+	}
+	if user.TotpEnabled {
+		if err := cfg.checkSecondFactor(r.Context(), user, r.PostForm.Get("code"), ""); err != nil {
+			cfg.accountLockout.Fail(strings.ToLower(email))
+			renderConsent(w, http.StatusUnauthorized, req, "Invalid two-factor code.")
+			return
+		}
+	}
+	cfg.accountLockout.Reset(strings.ToLower(email))
+
+	code, codeHash, err := auth.GenerateOAuthSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create an authorization code", err)
+		return
+	}
+	err = cfg.db.CreateAuthorizationCode(r.Context(), database.CreateAuthorizationCodeParams{
+		CodeHash:      codeHash,
+		ClientID:      req.Client.ID,
+		UserID:        user.ID,
+		RedirectUri:   req.RedirectURI,
+		Scopes:        req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create an authorization code", err)
+		return
+	}
+	req.redirect(w, r, url.Values{"code": {code}})
+}
+
+// respondWithOAuthError writes an error response as RFC 6749 section 5.2
+// lays it out.
+func respondWithOAuthError(w http.ResponseWriter, code int, errCode, description string) {
+	type oauthError struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, oauthError{Error: errCode, ErrorDescription: description})
+}
+
+// authenticateOAuthClient identifies the client calling a token endpoint,
+// from HTTP Basic credentials or the client_id and client_secret form
+// fields. Confidential clients must present their secret.
+func (cfg *apiConfig) authenticateOAuthClient(r *http.Request) (database.OauthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	clientID, err := uuid.Parse(id)
+	if err != nil {
+		return database.OauthClient{}, err
+	}
+	client, err := cfg.db.GetOAuthClient(r.Context(), clientID)
+	if err != nil {
+		return database.OauthClient{}, err
+	}
+	if client.SecretHash.Valid && !auth.CheckOAuthSecret(secret, client.SecretHash.String) {
+		return database.OauthClient{}, errors.New("wrong client secret")
+	}
+	return client, nil
+}
+
+func (cfg *apiConfig) handlerOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "couldn't parse the form")
+		return
+	}
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		respondWithOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code, err := cfg.db.UseAuthorizationCode(r.Context(), auth.HashOAuthSecret(r.PostForm.Get("code")))
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "unknown, used or expired code")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up the code", err)
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectUri != r.PostForm.Get("redirect_uri") {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "code was issued to another client or redirect uri")
+		return
+	}
+	if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "code verifier doesn't match the challenge")
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(r.Context(), code.UserID)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "user no longer exists")
+		return
+	}
+	if isSuspended(user, time.Now()) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "user is suspended")
+		return
+	}
+	token, err := auth.MakeOAuthAccessToken(user.ID, auth.Role(user.Role), client.ID, code.Scopes, cfg.secret, oauthAccessTokenTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create a token", err)
+		return
+	}
+
+	type response struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		Scope       string `json:"scope"`
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, response{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthAccessTokenTTL.Seconds()),
+		Scope:       strings.Join(code.Scopes, " "),
+	})
+}
+
+// clientToken parses the token form field and returns its claims if it is
+// a live token issued to client.
+func (cfg *apiConfig) clientToken(r *http.Request, client database.OauthClient) (*auth.Claims, bool) {
+	claims, err := cfg.validateAccessToken(r.PostForm.Get("token"))
+	if err != nil || claims.ClientID != client.ID.String() {
+		return nil, false
+	}
+	revoked, err := cfg.oauthTokenRevoked(r.Context(), claims)
+	if err != nil || revoked {
+		return nil, false
+	}
+	return claims, true
+}
+
+// oauthTokenRevoked reports whether a third-party token was revoked, on
+// its own or by deleting the client it was issued to.
+func (cfg *apiConfig) oauthTokenRevoked(ctx context.Context, claims *auth.Claims) (bool, error) {
+	clientID, err := uuid.Parse(claims.ClientID)
+	if err != nil {
+		return false, invalidCredentials(err)
+	}
+	return cfg.db.IsOAuthTokenRevoked(ctx, database.IsOAuthTokenRevokedParams{
+		Jti:      claims.ID,
+		ClientID: clientID,
+	})
+}
+
+// handlerOAuthIntrospect implements RFC 7662. Clients can only introspect
+// their own tokens; anything else is reported inactive.
+func (cfg *apiConfig) handlerOAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "couldn't parse the form")
+		return
+	}
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	type response struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+		JTI       string `json:"jti,omitempty"`
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	claims, ok := cfg.clientToken(r, client)
+	if !ok {
+		respondWithJSON(w, http.StatusOK, response{Active: false})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Subject:   claims.Subject,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt.Unix(),
+		IssuedAt:  claims.IssuedAt.Unix(),
+		JTI:       claims.ID,
+	})
+}
+
+// handlerOAuthRevoke implements RFC 7009: it answers 200 whether or not the
+// token was valid.
+func (cfg *apiConfig) handlerOAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "couldn't parse the form")
+		return
+	}
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	if claims, ok := cfg.clientToken(r, client); ok {
+		err := cfg.db.RevokeOAuthToken(r.Context(), database.RevokeOAuthTokenParams{
+			Jti:       claims.ID,
+			ExpiresAt: claims.ExpiresAt.Time,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't revoke the token", err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
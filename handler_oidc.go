@@ -0,0 +1,101 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/oidc"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// noPasswordHash is stored for users created through an identity provider.
+// No password matches it, the same as the column default.
+const noPasswordHash = "unset"
+
+var errUnverifiedEmail = errors.New("identity provider didn't verify the email address")
+
+func (cfg *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, err := cfg.oidc.AuthCodeURL(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "couldn't reach the identity provider", err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if providerErr := q.Get("error"); providerErr != "" {
+		respondWithError(w, http.StatusUnauthorized, "login was cancelled or denied", fmt.Errorf("identity provider error: %s", providerErr))
+		return
+	}
+
+	idToken, err := cfg.oidc.Exchange(r.Context(), q.Get("state"), q.Get("code"))
+	if errors.Is(err, oidc.ErrUnknownState) {
+		respondWithError(w, http.StatusUnauthorized, "couldn't verify the login", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "couldn't complete the login with the identity provider", err)
+		return
+	}
+
+	user, err := cfg.userForIdentity(r.Context(), idToken)
+	if errors.Is(err, errUnverifiedEmail) {
+		respondWithError(w, http.StatusForbidden, "a verified email address is required", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't find or create the user", err)
+		return
+	}
+
+	if user.TotpEnabled {
+		cfg.respondWithMFAChallenge(w, user)
+		return
+	}
+	cfg.respondWithSession(w, r, user)
+}
+
+// userForIdentity returns the user linked to idToken's identity, linking
+// it by verified email to an existing user, or to a new one, the first time
+// it's seen.
+func (cfg *apiConfig) userForIdentity(ctx context.Context, idToken *oidc.IDToken) (database.User, error) {
+	identity, err := cfg.db.GetUserIdentity(ctx, database.GetUserIdentityParams{
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+	})
+	if err == nil {
+		return cfg.db.GetUserByID(ctx, identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, err
+	}
+
+	if !idToken.EmailVerified || idToken.Email == "" {
+		return database.User{}, errUnverifiedEmail
+	}
+	user, err := cfg.db.GetUserByEmail(ctx, idToken.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = cfg.db.CreateUser(ctx, database.CreateUserParams{
+			Email:          idToken.Email,
+			HashedPassword: noPasswordHash,
+		})
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+
+	_, err = cfg.db.CreateUserIdentity(ctx, database.CreateUserIdentityParams{
+		UserID:  user.ID,
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Email:   idToken.Email,
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// polkaWebhookSource identifies Polka's events in webhook_events.
+const polkaWebhookSource = "polka"
+
+// maxWebhookBytes bounds how much of a webhook body is read and signed.
+const maxWebhookBytes = 1 << 20
+
+func (cfg *apiConfig) handlerPolkaWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "couldn't read the webhook", err)
+		return
+	}
+	if err := cfg.polka.Verify(r.Header, body); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "invalid webhook signature", err)
+		return
+	}
+
+	type parameters struct {
+		ID    string `json:"id"`
+		Event string `json:"event"`
+		Data  struct {
+			UserID      string     `json:"user_id"`
+			PeriodStart *time.Time `json:"period_start"`
+			PeriodEnd   *time.Time `json:"period_end"`
+		} `json:"data"`
+	}
+	params := parameters{}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "couldn't decode the webhook", err)
+		return
+	}
+	if params.ID == "" {
+		respondWithError(w, http.StatusBadRequest, "webhook has no event id", errors.New("missing webhook event id"))
+		return
+	}
+
+	if _, ok := polkaEventStatus[params.Event]; !ok {
+		slog.Info("ignoring polka event", "event_id", params.ID, "type", params.Event)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id, err := uuid.Parse(params.Data.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "webhook has an invalid user_id", err)
+		return
+	}
+	err = cfg.applySubscriptionEvent(r.Context(), params.ID, id, params.Event, params.Data.PeriodStart, params.Data.PeriodEnd)
+	if errors.Is(err, errDuplicateWebhookEvent) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "couldn't find the user", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "couldn't apply the subscription change", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/moderation"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxReportDetailsLength = 1000
+
+type Report struct {
+	ID             uuid.UUID  `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	ReporterID     uuid.UUID  `json:"reporter_id"`
+	ReportedUserID uuid.UUID  `json:"reported_user_id"`
+	ChirpID        *uuid.UUID `json:"chirp_id"`
+	Reason         string     `json:"reason"`
+	Details        string     `json:"details"`
+	Status         string     `json:"status"`
+	ClaimedBy      *uuid.UUID `json:"claimed_by"`
+	ClaimedAt      *time.Time `json:"claimed_at"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+	Resolution     string     `json:"resolution,omitempty"`
+}
+
+func reportFromDB(r database.Report) Report {
+	return Report{
+		ID:             r.ID,
+		CreatedAt:      r.CreatedAt,
+		UpdatedAt:      r.UpdatedAt,
+		ReporterID:     r.ReporterID,
+		ReportedUserID: r.ReportedUserID,
+		ChirpID:        nullUUIDPtr(r.ChirpID),
+		Reason:         r.Reason,
+		Details:        r.Details,
+		Status:         r.Status,
+		ClaimedBy:      nullUUIDPtr(r.ClaimedBy),
+		ClaimedAt:      nullTimePtr(r.ClaimedAt),
+		ResolvedAt:     nullTimePtr(r.ResolvedAt),
+		Resolution:     r.Resolution.String,
+	}
+}
+
+func nullUUIDPtr(id uuid.NullUUID) *uuid.UUID {
+	if !id.Valid {
+		return nil
+	}
+	return &id.UUID
+}
+
+// handlerCreateReport files a report about a chirp or a user for the
+// moderation queue. Reporting a chirp reports its author too.
+func (cfg *apiConfig) handlerCreateReport(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	type parameters struct {
+		ChirpID uuid.NullUUID `json:"chirp_id"`
+		UserID  uuid.NullUUID `json:"user_id"`
+		Reason  string        `json:"reason"`
+		Details string        `json:"details"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	if params.ChirpID.Valid == params.UserID.Valid {
+		respondWithError(w, http.StatusBadRequest, "Report either a chirp_id or a user_id", errors.New("need exactly one report target"))
+		return
+	}
+	reason, err := moderation.ParseReason(params.Reason)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid reason", err)
+		return
+	}
+	if len([]rune(params.Details)) > maxReportDetailsLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("details must be at most %d characters", maxReportDetailsLength), errors.New("details too long"))
+		return
+	}
+
+	reportedID := params.UserID.UUID
+	if params.ChirpID.Valid {
+		chirp, err := cfg.db.GetChirpById(r.Context(), params.ChirpID.UUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, http.StatusNotFound, "couldn't find chirp", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get chirp", err)
+			return
+		}
+		reportedID = chirp.UserID
+	} else if _, err := cfg.db.GetUserByID(r.Context(), reportedID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, http.StatusNotFound, "Couldn't find user", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up user", err)
+		return
+	}
+	if reportedID == user.ID {
+		respondWithError(w, http.StatusBadRequest, "You can't report yourself", errors.New("self report"))
+		return
+	}
+
+	report, err := cfg.db.CreateReport(r.Context(), database.CreateReportParams{
+		ReporterID:     user.ID,
+		ReportedUserID: reportedID,
+		ChirpID:        params.ChirpID,
+		Reason:         string(reason),
+		Details:        params.Details,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create report", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, reportFromDB(report))
+}
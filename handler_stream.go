@@ -0,0 +1,145 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"chirpy/internal/stream"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// streamHeartbeat keeps idle connections from being closed by proxies.
+	streamHeartbeat = 15 * time.Second
+	// streamReplayLimit caps how many missed events a reconnect replays.
+	streamReplayLimit = 500
+)
+
+// handlerStream sends chirp events as Server-Sent Events: every chirp, or
+// one author's with ?author_id=. A client reconnecting with Last-Event-ID
+// first gets the events it missed. Authors the viewer had blocked or muted
+// when the stream opened are left out. There's no home timeline: it would
+// need follows, which Chirpy doesn't have.
+func (cfg *apiConfig) handlerStream(w http.ResponseWriter, r *http.Request) {
+	var filter stream.Filter
+	if s := r.URL.Query().Get("author_id"); s != "" {
+		authorID, err := uuid.Parse(s)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't parse author_id", err)
+			return
+		}
+		filter.AuthorID = authorID
+	}
+	var lastEventID uuid.UUID
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't parse Last-Event-ID", err)
+			return
+		}
+		lastEventID = id
+	}
+
+	viewer, _ := userFromContext(r.Context())
+	visible, err := cfg.visibilityFor(r.Context(), viewer.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't load blocks and mutes", err)
+		return
+	}
+	filter.Hide = visible.hidesMessage
+
+	// Subscribe before replaying so nothing published in between is lost;
+	// anything that shows up in both is only sent once.
+	sub, err := cfg.stream.Subscribe(filter)
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, "The stream is shutting down", err)
+		return
+	}
+	defer cfg.stream.Unsubscribe(sub)
+
+	var missed []stream.Message
+	if lastEventID != uuid.Nil {
+		missed, err = cfg.missedStreamMessages(r.Context(), filter, lastEventID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't replay missed events", err)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	// Streams outlive any server write timeout.
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+
+	sent := make(map[string]bool, len(missed))
+	for _, m := range missed {
+		writeStreamMessage(w, m)
+		sent[m.ID] = true
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case m, ok := <-sub.C:
+			if !ok {
+				// Dropped for lagging or shutting down; the client
+				// reconnects and resumes from the last id it got.
+				return
+			}
+			if sent[m.ID] {
+				delete(sent, m.ID)
+				continue
+			}
+			writeStreamMessage(w, m)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// missedStreamMessages are the streamed events after lastEventID that
+// match filter, oldest first.
+func (cfg *apiConfig) missedStreamMessages(ctx context.Context, filter stream.Filter, lastEventID uuid.UUID) ([]stream.Message, error) {
+	types := make([]string, len(stream.Types))
+	for i, t := range stream.Types {
+		types[i] = string(t)
+	}
+	rows, err := cfg.db.ListOutboxEventsAfter(ctx, database.ListOutboxEventsAfterParams{
+		EventTypes: types,
+		UserID:     uuid.NullUUID{UUID: filter.AuthorID, Valid: filter.AuthorID != uuid.Nil},
+		AfterID:    lastEventID,
+		MaxEvents:  streamReplayLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var missed []stream.Message
+	for _, row := range rows {
+		if m, ok := stream.FromEvent(events.FromOutbox(row)); ok && filter.Match(m) {
+			missed = append(missed, m)
+		}
+	}
+	return missed, nil
+}
+
+func writeStreamMessage(w io.Writer, m stream.Message) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", m.ID, m.Event, m.Data)
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"chirpy/internal/auth"
 	"chirpy/internal/database"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,23 +25,43 @@ type User struct {
 	Token        string    `json:"token"`
 	RefreshToken string    `json:"refresh_token"`
 	IsChirpyRed  bool      `json:"is_chirpy_red"`
+	Role         string    `json:"role"`
+	Badges       []string  `json:"badges"`
 }
 
 func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
 	tokenFromHeader, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "refresh tokenneeded in the request headers", err)
+		respondWithError(w, http.StatusUnauthorized, "refresh token needed in the request headers", err)
 		return
 	}
 	refreshToken, err := cfg.db.GetRefreshToken(r.Context(), tokenFromHeader)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
 	if err != nil || refreshToken.ExpiresAt.Before(time.Now()) || (refreshToken.RevokedAt.Valid && !refreshToken.RevokedAt.Time.IsZero()) {
 		respondWithError(w, http.StatusUnauthorized, "invalid refresh token", err)
 		return
 	}
 
-	token, err := auth.MakeJWT(refreshToken.UserID, cfg.secret, time.Duration(60*60)*time.Second)
+	user, err := cfg.db.GetUserByID(r.Context(), refreshToken.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusUnauthorized, "invalid refresh token", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if isSuspended(user, time.Now()) {
+		respondSuspended(w, user)
+		return
+	}
+
+	token, err := auth.MakeAccessToken(user.ID, auth.Role(user.Role), cfg.secret, time.Duration(60*60)*time.Second)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "couldn't create a new token for this user", err)
+		respondWithError(w, http.StatusInternalServerError, "couldn't create a new token for this user", err)
 		return
 	}
 	type Res struct {
@@ -50,12 +76,12 @@ func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	tokenFromHeader, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "refresh tokenneeded in the request headers", err)
+		respondWithError(w, http.StatusUnauthorized, "refresh token needed in the request headers", err)
 		return
 	}
 	err = cfg.db.RevokeToken(r.Context(), tokenFromHeader)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "invalid refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke refresh token", err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -69,29 +95,118 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 
-	err := decoder.Decode(&params)
-	if len(params.Email) < 5 || len(params.Password) < 3 {
-		respondWithError(w, http.StatusUnauthorized, "Email or Password failed validation", fmt.Errorf("email or password failed validation"))
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode the request", err)
 		return
 	}
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't decode the request", err)
+	if p := credentialsProblem(params.Email, params.Password); p != nil {
+		respondWithProblem(w, p)
+		return
+	}
+	user, err := cfg.checkPassword(r, params.Email, params.Password)
+	var locked lockedOutError
+	if errors.As(err, &locked) {
+		respondTooManyAttempts(w, locked.wait)
+		return
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		respondWithError(w, http.StatusUnauthorized, "invalid credentials", err)
 		return
 	}
-	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find user with provided email", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check credentials", err)
+		return
+	}
+
+	if user.TotpEnabled {
+		cfg.respondWithMFAChallenge(w, user)
 		return
 	}
-	err = auth.CheckPasswordHash(params.Password, user.HashedPassword)
+
+	cfg.accountLockout.Reset(strings.ToLower(params.Email))
+	cfg.respondWithSession(w, r, user)
+}
+
+// errInvalidCredentials is a login or bearer credential the client got
+// wrong, as opposed to the server failing to check it.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// lockedOutError is returned by checkPassword while the client or account
+// is locked out.
+type lockedOutError struct {
+	wait time.Duration
+}
+
+func (e lockedOutError) Error() string {
+	return fmt.Sprintf("login locked for %v", e.wait)
+}
+
+// checkPassword verifies email and password against the lockout trackers
+// and the stored hash, upgrading the hash when needed. The account lockout
+// is left for the caller to reset once every factor has been checked.
+// Wrong credentials are errInvalidCredentials; any other error is the
+// server's fault.
+func (cfg *apiConfig) checkPassword(r *http.Request, email, password string) (database.User, error) {
+	ip := cfg.clientIP(r)
+	lockKey := strings.ToLower(email)
+	if wait, ok := cfg.ipLockout.Check(ip); !ok {
+		return database.User{}, lockedOutError{wait}
+	}
+	if wait, ok := cfg.accountLockout.Check(lockKey); !ok {
+		return database.User{}, lockedOutError{wait}
+	}
+
+	user, err := cfg.db.GetUserByEmail(r.Context(), email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		// An outage isn't a wrong guess, so it mustn't count towards a lock.
+		return database.User{}, err
+	}
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect password", err)
+		err = errors.Join(err, cfg.passwords.CheckDummy(password))
+	} else {
+		err = cfg.passwords.Check(password, user.HashedPassword)
+	}
+	if err != nil {
+		cfg.ipLockout.Fail(ip)
+		cfg.accountLockout.Fail(lockKey)
+		return database.User{}, fmt.Errorf("%w: %w", errInvalidCredentials, err)
+	}
+
+	cfg.rehashPassword(r, user, password)
+	return user, nil
+}
+
+// rehashPassword upgrades a stored hash made with outdated parameters or
+// from a truncated password. The login goes ahead whether or not this
+// succeeds.
+func (cfg *apiConfig) rehashPassword(r *http.Request, user database.User, password string) {
+	hash, ok, err := cfg.passwords.Rehash(password, user.HashedPassword)
+	if err != nil {
+		slog.Error("rehashing password", "user_id", user.ID, "err", err)
+		return
+	}
+	if !ok {
 		return
 	}
+	err = cfg.db.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+		ID:             user.ID,
+		HashedPassword: hash,
+	})
+	if err != nil {
+		slog.Error("storing rehashed password", "user_id", user.ID, "err", err)
+	}
+}
 
-	token, err := auth.MakeJWT(user.ID, cfg.secret, time.Duration(60*60)*time.Second)
+// respondWithSession issues a fresh access and refresh token pair for user,
+// unless they're suspended.
+func (cfg *apiConfig) respondWithSession(w http.ResponseWriter, r *http.Request, user database.User) {
+	if isSuspended(user, time.Now()) {
+		respondSuspended(w, user)
+		return
+	}
+	token, err := auth.MakeAccessToken(user.ID, auth.Role(user.Role), cfg.secret, time.Duration(60*60)*time.Second)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create an access token", err)
 		return
 	}
 
@@ -120,11 +235,58 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		Token:        token,
 		RefreshToken: refreshToken.Token,
 		IsChirpyRed:  user.IsChirpyRed,
+		Role:         user.Role,
+		Badges:       cfg.badgesFor(user),
 	}
 
 	respondWithJSON(w, http.StatusOK, data)
 }
 
+func respondTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	setRetryAfter(w, wait)
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts", fmt.Errorf("login locked for %v", wait))
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// checkPasswordPolicy responds with every broken password rule and returns
+// false if password isn't acceptable.
+func (cfg *apiConfig) checkPasswordPolicy(w http.ResponseWriter, password, email string) bool {
+	violations, err := cfg.passwordPolicy.Validate(password, email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check password", err)
+		return false
+	}
+	if len(violations) == 0 {
+		return true
+	}
+
+	fields := make([]FieldError, len(violations))
+	for i, v := range violations {
+		fields[i] = FieldError{Field: "password", Code: v.Rule, Message: "password " + v.Message}
+	}
+	respondWithProblem(w, validationProblem("Password doesn't meet the password policy", fields...))
+	return false
+}
+
+// credentialsProblem checks the shape of an email and password, returning
+// nil if they look usable.
+func credentialsProblem(email, password string) *Problem {
+	var fields []FieldError
+	if len(email) < 5 {
+		fields = append(fields, FieldError{Field: "email", Code: "min_length", Message: "email must be at least 5 characters"})
+	}
+	if len(password) < 3 {
+		fields = append(fields, FieldError{Field: "password", Code: "min_length", Message: "password must be at least 3 characters"})
+	}
+	if fields == nil {
+		return nil
+	}
+	return validationProblem("Email or Password failed validation", fields...)
+}
+
 func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
@@ -133,17 +295,23 @@ func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request)
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 
-	err := decoder.Decode(&params)
-	if len(params.Email) < 5 || len(params.Password) < 3 {
-		respondWithError(w, http.StatusInternalServerError, "Email or Password failed validation", fmt.Errorf("email or password failed validation"))
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode the request", err)
 		return
 	}
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode the request", err)
+	if p := credentialsProblem(params.Email, params.Password); p != nil {
+		respondWithProblem(w, p)
+		return
+	}
+	if !cfg.checkPasswordPolicy(w, params.Password, params.Email) {
 		return
 	}
 
-	pw, err := auth.HashPassword(params.Password)
+	pw, err := cfg.passwords.Hash(params.Password)
+	if errors.Is(err, auth.ErrPasswordTooLong) {
+		respondWithProblem(w, validationProblem("Password is too long", FieldError{Field: "password", Code: "max_length", Message: err.Error()}))
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't secure password", err)
 		return
@@ -153,7 +321,10 @@ func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request)
 		Email:          params.Email,
 		HashedPassword: pw,
 	})
-
+	if database.IsUniqueViolation(err) {
+		respondWithError(w, http.StatusConflict, "That email is already registered", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create a user", err)
 		return
@@ -165,106 +336,116 @@ func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request)
 		UpdatedAt:   user.UpdatedAt,
 		Email:       user.Email,
 		IsChirpyRed: user.IsChirpyRed,
+		Role:        user.Role,
+		Badges:      cfg.badgesFor(user),
 	}
 
 	respondWithJSON(w, http.StatusCreated, data)
 }
 
-func (cfg *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) {
+// userFromDB is user as the API shows it, without tokens.
+func (cfg *apiConfig) userFromDB(user database.User) User {
+	return User{
+		ID:          user.ID,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		Role:        user.Role,
+		Badges:      cfg.badgesFor(user),
+	}
+}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+// handlerGetCurrentUser returns the signed-in user with validators for
+// conditional requests, so a client can fetch an ETag before updating.
+func (cfg *apiConfig) handlerGetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	resp := cfg.userFromDB(user)
+	etag := etagFor(resp)
+	setValidators(w, etag, user.UpdatedAt)
+	if notModified(r, etag, user.UpdatedAt) {
+		respondNotModified(w)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.secret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := userFromContext(r.Context())
+	if !ok {
+		respondUnauthorized(w, false, fmt.Errorf("no user in request context"))
+		return
+	}
+	if preconditionFailed(r, etagFor(cfg.userFromDB(authUser))) {
+		respondPreconditionFailed(w)
 		return
 	}
 
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// CurrentPassword confirms it's really the user changing their
+		// credentials. Users who only log in through an identity provider
+		// have none yet.
+		CurrentPassword string `json:"current_password"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 
-	err = decoder.Decode(&params)
-	if len(params.Email) < 5 || len(params.Password) < 3 {
-		respondWithError(w, http.StatusInternalServerError, "Email or Password failed validation", fmt.Errorf("email or password failed validation"))
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode the request", err)
 		return
 	}
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode the request", err)
+	if authUser.HashedPassword != noPasswordHash {
+		lockKey := strings.ToLower(authUser.Email)
+		if wait, ok := cfg.accountLockout.Check(lockKey); !ok {
+			respondTooManyAttempts(w, wait)
+			return
+		}
+		if err := cfg.passwords.Check(params.CurrentPassword, authUser.HashedPassword); err != nil {
+			cfg.accountLockout.Fail(lockKey)
+			respondWithError(w, http.StatusForbidden, "Current password is incorrect", err)
+			return
+		}
+	}
+	if p := credentialsProblem(params.Email, params.Password); p != nil {
+		respondWithProblem(w, p)
+		return
+	}
+	if !cfg.checkPasswordPolicy(w, params.Password, params.Email) {
 		return
 	}
 
-	pw, err := auth.HashPassword(params.Password)
+	pw, err := cfg.passwords.Hash(params.Password)
+	if errors.Is(err, auth.ErrPasswordTooLong) {
+		respondWithProblem(w, validationProblem("Password is too long", FieldError{Field: "password", Code: "max_length", Message: err.Error()}))
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't secure password", err)
 		return
 	}
 	user, err := cfg.db.UpdateUser(r.Context(), database.UpdateUserParams{
-		ID:             userID,
+		ID:             authUser.ID,
 		Email:          params.Email,
 		HashedPassword: pw,
+		UpdatedAt:      authUser.UpdatedAt,
 	})
-
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create a user", err)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The user changed between authenticating and updating.
+		respondPreconditionFailed(w)
 		return
 	}
-
-	data := User{
-		ID:          user.ID,
-		CreatedAt:   user.CreatedAt,
-		UpdatedAt:   user.UpdatedAt,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
-	}
-
-	respondWithJSON(w, http.StatusOK, data)
-}
-
-func (cfg *apiConfig) handlerUpgradeUser(w http.ResponseWriter, r *http.Request) {
-	headerKey, err := auth.GetPolkaApiKey(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "coudln't find api key", err)
-		return
-	}
-	if headerKey != cfg.polkaKey {
-		respondWithError(w, http.StatusUnauthorized, "mismatched keys", err)
+	if database.IsUniqueViolation(err) {
+		respondWithError(w, http.StatusConflict, "That email is already registered", err)
 		return
 	}
-	type parameters struct {
-		Event string `json:"event"`
-		Data  struct {
-			UserID string `json:"user_id"`
-		} `json:"data"`
-	}
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-
-	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "couldn't upgrade user", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update the user", err)
 		return
 	}
 
-	if params.Event != "user.upgraded" {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	id, err := uuid.Parse(params.Data.UserID)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	err = cfg.db.UpgradeUser(r.Context(), id)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	w.WriteHeader(http.StatusNoContent)
+	data := cfg.userFromDB(user)
+	setValidators(w, etagFor(data), user.UpdatedAt)
+	respondWithJSON(w, http.StatusOK, data)
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/webhooks"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxDeliveryLogLimit = 100
+
+type WebhookEndpoint struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	// Secret is only ever returned when the endpoint is registered.
+	Secret string `json:"secret,omitempty"`
+}
+
+func webhookEndpointFromDB(e database.WebhookEndpoint) WebhookEndpoint {
+	return WebhookEndpoint{
+		ID:        e.ID,
+		CreatedAt: e.CreatedAt,
+		URL:       e.Url,
+		Events:    e.Events,
+	}
+}
+
+type WebhookDelivery struct {
+	ID               uuid.UUID  `json:"id"`
+	CreatedAt        time.Time  `json:"created_at"`
+	EventID          uuid.UUID  `json:"event_id"`
+	EventType        string     `json:"event_type"`
+	Status           string     `json:"status"`
+	Attempts         int32      `json:"attempts"`
+	NextAttemptAt    *time.Time `json:"next_attempt_at"`
+	LastResponseCode *int32     `json:"last_response_code"`
+	LastError        *string    `json:"last_error"`
+	DeliveredAt      *time.Time `json:"delivered_at"`
+}
+
+func webhookDeliveryFromDB(d database.WebhookDelivery) WebhookDelivery {
+	res := WebhookDelivery{
+		ID:        d.ID,
+		CreatedAt: d.CreatedAt,
+		EventID:   d.EventID,
+		EventType: d.EventType,
+		Status:    d.Status,
+		Attempts:  d.Attempts,
+	}
+	if d.Status == webhooks.StatusPending {
+		res.NextAttemptAt = &d.NextAttemptAt
+	}
+	if d.LastResponseCode.Valid {
+		res.LastResponseCode = &d.LastResponseCode.Int32
+	}
+	if d.LastError.Valid {
+		res.LastError = &d.LastError.String
+	}
+	if d.DeliveredAt.Valid {
+		res.DeliveredAt = &d.DeliveredAt.Time
+	}
+	return res
+}
+
+// handlerCreateWebhook registers an endpoint for the user's own events. Like
+// account changes it needs a logged-in session: an endpoint receives
+// everything about its owner, which is more than any API key scope grants.
+func (cfg *apiConfig) handlerCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode request", err)
+		return
+	}
+	if err := webhooks.ValidateURL(params.URL, cfg.platform == "dev"); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if err := webhooks.ValidateEvents(params.Events); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	secret, err := webhooks.GenerateSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate a signing secret", err)
+		return
+	}
+	endpoint, err := cfg.db.CreateWebhookEndpoint(r.Context(), database.CreateWebhookEndpointParams{
+		OwnerID: user.ID,
+		Url:     params.URL,
+		Events:  params.Events,
+		Secret:  secret,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't register the webhook", err)
+		return
+	}
+
+	res := webhookEndpointFromDB(endpoint)
+	res.Secret = endpoint.Secret
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+func (cfg *apiConfig) handlerListWebhooks(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	dbEndpoints, err := cfg.db.ListWebhookEndpointsForOwner(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list webhooks", err)
+		return
+	}
+	endpoints := make([]WebhookEndpoint, len(dbEndpoints))
+	for i, e := range dbEndpoints {
+		endpoints[i] = webhookEndpointFromDB(e)
+	}
+	respondWithJSON(w, http.StatusOK, endpoints)
+}
+
+func (cfg *apiConfig) handlerDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	endpointID, err := uuid.Parse(r.PathValue("webhookId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	n, err := cfg.db.DeleteWebhookEndpoint(r.Context(), database.DeleteWebhookEndpointParams{
+		ID:      endpointID,
+		OwnerID: user.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete the webhook", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "Couldn't find webhook", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerListWebhookDeliveries is the delivery log of one endpoint, newest
+// first.
+func (cfg *apiConfig) handlerListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	endpointID, err := uuid.Parse(r.PathValue("webhookId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse id", err)
+		return
+	}
+	limit := maxDeliveryLogLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxDeliveryLogLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 100", errors.New("invalid limit"))
+			return
+		}
+	}
+
+	// Someone else's endpoint is as missing as one that doesn't exist.
+	endpoint, err := cfg.db.GetWebhookEndpoint(r.Context(), endpointID)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && endpoint.OwnerID != user.ID {
+		respondWithError(w, http.StatusNotFound, "Couldn't find webhook", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get the webhook", err)
+		return
+	}
+
+	dbDeliveries, err := cfg.db.ListWebhookDeliveries(r.Context(), database.ListWebhookDeliveriesParams{
+		EndpointID: endpointID,
+		OwnerID:    user.ID,
+		Limit:      int32(limit),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list deliveries", err)
+		return
+	}
+	deliveries := make([]WebhookDelivery, len(dbDeliveries))
+	for i, d := range dbDeliveries {
+		deliveries[i] = webhookDeliveryFromDB(d)
+	}
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
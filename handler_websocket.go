@@ -0,0 +1,334 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/notifications"
+	"chirpy/internal/stream"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// The WebSocket protocol is JSON text messages. Clients send
+//
+//	{"type": "subscribe", "id": "1", "channel": "timeline"}
+//	{"type": "unsubscribe", "id": "2", "channel": "timeline"}
+//	{"type": "ping", "id": "3"}
+//
+// where id is optional and echoed back in the reply. Channels are
+// "timeline", "timeline:<authorId>", "thread:<chirpId>" and
+// "notifications". The server answers with "subscribed", "unsubscribed",
+// "pong" or "error" (with an "error" field), and delivers
+//
+//	{"type": "event", "channel": "timeline", "event": "chirp.created",
+//	 "event_id": "...", "data": {...}}
+const (
+	wsMaxMessageSize   = 4096
+	wsMaxSubscriptions = 20
+	wsSendBuffer       = 64
+	wsWriteWait        = 10 * time.Second
+	wsPongWait         = 60 * time.Second
+	wsPingInterval     = 50 * time.Second
+
+	// wsCloseTokenExpired tells the client to reconnect with a fresh token.
+	wsCloseTokenExpired = 4001
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Connections authenticate with a bearer token rather than cookies, so
+	// another site can't ride on a browser's session.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type wsClientMessage struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Channel string `json:"channel,omitempty"`
+}
+
+type wsServerMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	EventID string          `json:"event_id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type wsSession struct {
+	cfg  *apiConfig
+	conn *websocket.Conn
+	user database.User
+	out  chan wsServerMessage
+	// visible is the user's blocks and mutes as of connecting.
+	visible visibility
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeMsg  []byte
+
+	mu   sync.Mutex
+	subs map[string]*stream.Subscriber
+}
+
+// handlerWebSocket upgrades to a WebSocket carrying live timelines,
+// threads and notifications. The connection lasts as long as the access
+// token it was opened with.
+func (cfg *apiConfig) handlerWebSocket(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	creds, _ := credentialsFromContext(r.Context())
+	visible, err := cfg.visibilityFor(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't load blocks and mutes", err)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded.
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &wsSession{
+		cfg:     cfg,
+		conn:    conn,
+		user:    user,
+		out:     make(chan wsServerMessage, wsSendBuffer),
+		visible: visible,
+		ctx:     ctx,
+		cancel:  cancel,
+		subs:    make(map[string]*stream.Subscriber),
+	}
+	defer s.unsubscribeAll()
+
+	if !creds.expiresAt.IsZero() {
+		expiry := time.AfterFunc(time.Until(creds.expiresAt), func() {
+			s.close(wsCloseTokenExpired, "access token expired")
+		})
+		defer expiry.Stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeLoop()
+	}()
+	s.readLoop()
+	s.close(websocket.CloseNormalClosure, "")
+	<-done
+}
+
+// close ends the session, sending code and text to the client.
+func (s *wsSession) close(code int, text string) {
+	s.closeOnce.Do(func() {
+		s.closeMsg = websocket.FormatCloseMessage(code, text)
+		s.cancel()
+	})
+}
+
+func (s *wsSession) readLoop() {
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		var msg wsClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.send(wsServerMessage{Type: "error", Error: "Messages must be JSON objects"})
+			continue
+		}
+		s.handle(msg)
+	}
+}
+
+// writeLoop is the only writer to the connection.
+func (s *wsSession) writeLoop() {
+	defer s.conn.Close()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.conn.WriteControl(websocket.CloseMessage, s.closeMsg, time.Now().Add(wsWriteWait))
+			return
+		case msg := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := s.conn.WriteJSON(msg); err != nil {
+				s.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				s.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		}
+	}
+}
+
+// send queues msg without blocking. A client that can't keep up is
+// disconnected rather than buffered for without limit.
+func (s *wsSession) send(msg wsServerMessage) {
+	select {
+	case s.out <- msg:
+	case <-s.ctx.Done():
+	default:
+		s.close(websocket.ClosePolicyViolation, "client is reading too slowly")
+	}
+}
+
+func (s *wsSession) handle(msg wsClientMessage) {
+	switch msg.Type {
+	case "ping":
+		s.send(wsServerMessage{Type: "pong", ID: msg.ID})
+	case "subscribe":
+		if err := s.subscribe(msg.Channel); err != nil {
+			s.send(wsServerMessage{Type: "error", ID: msg.ID, Channel: msg.Channel, Error: err.Error()})
+			return
+		}
+		s.send(wsServerMessage{Type: "subscribed", ID: msg.ID, Channel: msg.Channel})
+	case "unsubscribe":
+		s.unsubscribe(msg.Channel)
+		s.send(wsServerMessage{Type: "unsubscribed", ID: msg.ID, Channel: msg.Channel})
+	default:
+		s.send(wsServerMessage{Type: "error", ID: msg.ID, Error: "Unknown message type"})
+	}
+}
+
+// errNoHomeTimeline answers the home channel. A home timeline is the chirps
+// of the people you follow, and Chirpy has no follows yet, so the channel
+// is left out rather than standing in for the global one.
+var errNoHomeTimeline = errors.New("There's no home timeline until Chirpy has follows")
+
+// wsChannel resolves a channel name to the hub and filter that feed it.
+func (cfg *apiConfig) wsChannel(channel string, user database.User) (*stream.Hub, stream.Filter, error) {
+	name, arg, _ := strings.Cut(channel, ":")
+	switch {
+	case channel == "timeline":
+		return cfg.stream, stream.Filter{}, nil
+	case channel == "home":
+		return nil, stream.Filter{}, errNoHomeTimeline
+	case channel == "notifications":
+		return cfg.notificationStream, stream.Filter{AuthorID: user.ID}, nil
+	case name == "timeline" || name == "thread":
+		id, err := uuid.Parse(arg)
+		if err != nil {
+			return nil, stream.Filter{}, errors.New("Couldn't parse the channel's id")
+		}
+		if name == "thread" {
+			return cfg.stream, stream.Filter{ChirpID: id}, nil
+		}
+		return cfg.stream, stream.Filter{AuthorID: id}, nil
+	}
+	return nil, stream.Filter{}, errors.New("Unknown channel")
+}
+
+func (s *wsSession) subscribe(channel string) error {
+	hub, filter, err := s.cfg.wsChannel(channel, s.user)
+	if err != nil {
+		return err
+	}
+	if hub == s.cfg.stream {
+		filter.Hide = s.visible.hidesMessage
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[channel]; ok {
+		return nil
+	}
+	if len(s.subs) >= wsMaxSubscriptions {
+		return errors.New("Too many subscriptions")
+	}
+	sub, err := hub.Subscribe(filter)
+	if err != nil {
+		return errors.New("The server is shutting down")
+	}
+	s.subs[channel] = sub
+	go s.forward(channel, sub)
+	return nil
+}
+
+// forward relays one subscription's messages until it ends.
+func (s *wsSession) forward(channel string, sub *stream.Subscriber) {
+	for m := range sub.C {
+		s.send(wsServerMessage{
+			Type:    "event",
+			Channel: channel,
+			Event:   m.Event,
+			EventID: m.ID,
+			Data:    m.Data,
+		})
+	}
+	switch {
+	case errors.Is(sub.Err(), stream.ErrLagged):
+		s.mu.Lock()
+		if s.subs[channel] == sub {
+			delete(s.subs, channel)
+		}
+		s.mu.Unlock()
+		s.send(wsServerMessage{Type: "unsubscribed", Channel: channel, Error: "Fell too far behind; subscribe again"})
+	case errors.Is(sub.Err(), stream.ErrClosed):
+		s.close(websocket.CloseGoingAway, "server shutting down")
+	}
+}
+
+func (s *wsSession) unsubscribe(channel string) {
+	s.mu.Lock()
+	sub, ok := s.subs[channel]
+	delete(s.subs, channel)
+	s.mu.Unlock()
+	if ok {
+		s.hubFor(channel).Unsubscribe(sub)
+	}
+}
+
+func (s *wsSession) unsubscribeAll() {
+	s.mu.Lock()
+	subs := s.subs
+	s.subs = map[string]*stream.Subscriber{}
+	s.mu.Unlock()
+	for channel, sub := range subs {
+		s.hubFor(channel).Unsubscribe(sub)
+	}
+}
+
+func (s *wsSession) hubFor(channel string) *stream.Hub {
+	if channel == "notifications" {
+		return s.cfg.notificationStream
+	}
+	return s.cfg.stream
+}
+
+// liveNotification pushes a newly recorded notification to the user's
+// WebSocket connections.
+func (cfg *apiConfig) liveNotification(n notifications.Notification) {
+	data, err := json.Marshal(struct {
+		Type      string    `json:"type"`
+		SubjectID uuid.UUID `json:"subject_id"`
+		Message   string    `json:"message"`
+	}{string(n.Kind), n.SubjectID, notifications.Message(n.Kind)})
+	if err != nil {
+		return
+	}
+	cfg.notificationStream.Publish(stream.Message{
+		ID:       n.EventID.String(),
+		Event:    "notification",
+		AuthorID: n.UserID,
+		Data:     data,
+	})
+}
@@ -1,14 +1,33 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"chirpy/internal/auth"
 	"chirpy/internal/database"
+	"chirpy/internal/entitlements"
+	"chirpy/internal/events"
+	"chirpy/internal/lockout"
+	"chirpy/internal/notifications"
+	"chirpy/internal/oidc"
+	"chirpy/internal/pagination"
+	"chirpy/internal/ratelimit"
+	"chirpy/internal/stream"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 // Test handlerCreateChirp
@@ -16,7 +35,14 @@ func TestHandlerCreateChirp(t *testing.T) {
 	// Create an apiConfig with a mock DB
 	mockDB := &database.MockDB{}
 	cfg := apiConfig{
-		db: mockDB,
+		db:           mockDB,
+		secret:       "testSecret",
+		jwtOptions:   auth.DefaultValidatorOptions(),
+		entitlements: entitlements.Default(),
+	}
+	token, err := auth.MakeJWT(uuid.New(), cfg.secret, time.Minute)
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
 	}
 
 	// Build a sample request
@@ -27,12 +53,13 @@ func TestHandlerCreateChirp(t *testing.T) {
 	}
 	// Usually you'd set headers if needed, e.g. content-type.
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	// Create a ResponseRecorder to capture the handler's response
 	rr := httptest.NewRecorder()
 
-	// Call the handler
-	http.HandlerFunc(cfg.handlerCreateChirp).ServeHTTP(rr, req)
+	// Call the handler behind the auth middleware
+	cfg.requireAuth(http.HandlerFunc(cfg.handlerCreateChirp)).ServeHTTP(rr, req)
 
 	// Check status code
 	if status := rr.Code; status != http.StatusCreated {
@@ -79,3 +106,1439 @@ func TestHandlerGetAllChirps(t *testing.T) {
 		t.Error("expected at least one chirp from mock data, got zero")
 	}
 }
+
+func TestRequireAuth(t *testing.T) {
+	cfg := apiConfig{
+		db:         &database.MockDB{},
+		secret:     "testSecret",
+		jwtOptions: auth.DefaultValidatorOptions(),
+	}
+	userID := uuid.New()
+	validToken, err := auth.MakeJWT(userID, cfg.secret, time.Minute)
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+	suspendedToken, err := auth.MakeJWT(database.MockSuspendedUser, cfg.secret, time.Minute)
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+	deletedToken, err := auth.MakeJWT(database.MockDeletedUser, cfg.secret, time.Minute)
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+	unavailableToken, err := auth.MakeJWT(database.MockUnavailableUser, cfg.secret, time.Minute)
+	if err != nil {
+		t.Fatalf("could not create token: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantCode      int
+		wantChallenge string
+	}{
+		{"missing token", "", http.StatusUnauthorized, `Bearer realm="chirpy"`},
+		{"invalid token", "Bearer not-a-jwt", http.StatusUnauthorized, `Bearer realm="chirpy", error="invalid_token"`},
+		{"valid token", "Bearer " + validToken, http.StatusOK, ""},
+		{"suspended user", "Bearer " + suspendedToken, http.StatusForbidden, ""},
+		{"deleted user", "Bearer " + deletedToken, http.StatusUnauthorized, `Bearer realm="chirpy", error="invalid_token"`},
+		{"user lookup fails", "Bearer " + unavailableToken, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUser database.User
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser, _ = userFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			cfg.requireAuth(next).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d", tt.wantCode, rr.Code)
+			}
+			if got := rr.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("expected challenge %q, got %q", tt.wantChallenge, got)
+			}
+			if tt.wantCode == http.StatusOK && gotUser.ID != userID {
+				t.Errorf("expected user %v in context, got %v", userID, gotUser.ID)
+			}
+		})
+	}
+
+	t.Run("optional auth lets anonymous requests through", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		cfg.optionalAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := userFromContext(r.Context()); ok {
+				t.Error("expected no user in context")
+			}
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(rr, httptest.NewRequest("GET", "/", strings.NewReader("")))
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", rr.Code)
+		}
+	})
+}
+
+func TestHandlerLoginLockout(t *testing.T) {
+	policy := lockout.Policy{
+		Threshold: 3,
+		BaseDelay: time.Minute,
+		MaxDelay:  time.Hour,
+		Window:    time.Hour,
+	}
+	passwords, err := auth.NewPasswordHasher(auth.AlgorithmArgon2id, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := apiConfig{
+		db:             &database.MockDB{},
+		secret:         "testSecret",
+		accountLockout: lockout.NewTracker(policy),
+		ipLockout:      lockout.NewTracker(policy),
+		passwords:      passwords,
+	}
+
+	loginAs := func(email string) *httptest.ResponseRecorder {
+		payload := `{"email": "` + email + `", "password": "wrongPassword"}`
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(payload))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(cfg.handlerLogin).ServeHTTP(rr, req)
+		return rr
+	}
+	login := func() *httptest.ResponseRecorder { return loginAs("someone@example.com") }
+
+	// Database errors aren't wrong guesses and mustn't lock anyone out.
+	for i := 0; i < policy.Threshold+1; i++ {
+		if rr := loginAs(database.MockUnavailableEmail); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected 500 while the database is down, got %d", rr.Code)
+		}
+	}
+
+	for i := 0; i < policy.Threshold; i++ {
+		rr := login()
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), "invalid credentials") {
+			t.Errorf("attempt %d: expected uniform error message, got %s", i+1, rr.Body.String())
+		}
+	}
+
+	rr := login()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once locked, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After of 60, got %q", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestHandlerCreateUserPasswordPolicy(t *testing.T) {
+	passwords, err := auth.NewPasswordHasher(auth.AlgorithmArgon2id, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := apiConfig{
+		db:             &database.MockDB{},
+		passwords:      passwords,
+		passwordPolicy: auth.DefaultPasswordPolicy(),
+	}
+
+	payload := `{"email": "someone@example.com", "password": "someone"}`
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(payload))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(cfg.handlerCreateUser).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+	var res Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	if res.Type != problemValidation {
+		t.Errorf("expected a validation problem, got %q", res.Type)
+	}
+	var rules []string
+	for _, v := range res.Errors {
+		if v.Field != "password" {
+			t.Errorf("expected only password errors, got one for %q", v.Field)
+		}
+		rules = append(rules, v.Code)
+	}
+	if strings.Join(rules, ",") != "min_length,min_entropy,not_email" {
+		t.Errorf("expected min_length, min_entropy and not_email violations, got %v", rules)
+	}
+}
+
+func TestUserForIdentity(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}}
+	ctx := context.Background()
+
+	user, err := cfg.userForIdentity(ctx, &oidc.IDToken{
+		Issuer:        "https://idp.example.com",
+		Subject:       "abc",
+		Email:         "someone@example.com",
+		EmailVerified: true,
+	})
+	if err != nil {
+		t.Fatalf("expected identity to be linked by email: %v", err)
+	}
+	if user.Email != "someone@example.com" {
+		t.Errorf("expected linked user to have the verified email, got %q", user.Email)
+	}
+
+	_, err = cfg.userForIdentity(ctx, &oidc.IDToken{
+		Issuer:  "https://idp.example.com",
+		Subject: "def",
+		Email:   "someone@example.com",
+	})
+	if !errors.Is(err, errUnverifiedEmail) {
+		t.Errorf("expected errUnverifiedEmail, got %v", err)
+	}
+}
+
+func TestHandlerOIDCCallback(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 srv.URL,
+				"authorization_endpoint": srv.URL + "/authorize",
+				"token_endpoint":         srv.URL + "/token",
+				"jwks_uri":               srv.URL + "/jwks",
+			})
+			return
+		}
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	cfg := apiConfig{db: &database.MockDB{}, oidc: oidc.NewProvider(oidc.Config{Issuer: srv.URL, ClientID: "chirpy"})}
+
+	authURL, err := cfg.oidc.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := func(state string) int {
+		req := httptest.NewRequest("GET", "/api/auth/oidc/callback?code=abc&state="+url.QueryEscape(state), nil)
+		rr := httptest.NewRecorder()
+		cfg.handlerOIDCCallback(rr, req)
+		return rr.Code
+	}
+	if code := callback("unknown"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown state, got %d", code)
+	}
+	if code := callback(u.Query().Get("state")); code != http.StatusBadGateway {
+		t.Errorf("expected 502 when the identity provider fails, got %d", code)
+	}
+}
+
+func TestHandlerLoginMFAUserLookup(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}, secret: "testSecret", jwtOptions: auth.DefaultValidatorOptions()}
+	tests := []struct {
+		name     string
+		userID   uuid.UUID
+		wantCode int
+	}{
+		{"deleted user", database.MockDeletedUser, http.StatusUnauthorized},
+		{"database down", database.MockUnavailableUser, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := auth.MakeMFAChallengeToken(tt.userID, cfg.secret, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("POST", "/api/login/mfa", strings.NewReader(`{"mfa_token":"`+token+`","code":"123456"}`))
+			rr := httptest.NewRecorder()
+			cfg.handlerLoginMFA(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	cfg := apiConfig{
+		db:         &database.MockDB{},
+		secret:     "testSecret",
+		jwtOptions: auth.DefaultValidatorOptions(),
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		key      string
+		scope    string
+		wantCode int
+	}{
+		{"scope granted", database.MockAPIKey, auth.ScopeChirpsRead, http.StatusOK},
+		{"scope missing", database.MockAPIKey, auth.ScopeChirpsWrite, http.StatusForbidden},
+		{"unknown key", "chirpy_unknown", auth.ScopeChirpsRead, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			rr := httptest.NewRecorder()
+			cfg.requireAuth(cfg.requireScope(tt.scope, ok)).ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected %d, got %d", tt.wantCode, rr.Code)
+			}
+		})
+	}
+
+	t.Run("api keys can't manage api keys", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/keys", nil)
+		req.Header.Set("Authorization", "Bearer "+database.MockAPIKey)
+		rr := httptest.NewRecorder()
+		cfg.requireAuth(cfg.requireSession(ok)).ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", rr.Code)
+		}
+	})
+}
+
+func TestOAuthTokens(t *testing.T) {
+	cfg := apiConfig{
+		db:         &database.MockDB{},
+		secret:     "testSecret",
+		jwtOptions: auth.DefaultValidatorOptions(),
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	clientID := uuid.New()
+	token, err := auth.MakeOAuthAccessToken(uuid.New(), auth.RoleUser, clientID, []string{auth.ScopeChirpsRead}, cfg.secret, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		wantCode int
+	}{
+		{"granted scope", cfg.requireAuth(cfg.requireScope(auth.ScopeChirpsRead, ok)), http.StatusOK},
+		{"missing scope", cfg.requireAuth(cfg.requireScope(auth.ScopeChirpsWrite, ok)), http.StatusForbidden},
+		{"session-only endpoint", cfg.requireAuth(cfg.requireSession(ok)), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected %d, got %d", tt.wantCode, rr.Code)
+			}
+		})
+	}
+
+	t.Run("client deleted", func(t *testing.T) {
+		del := httptest.NewRequest("DELETE", "/api/oauth/clients/"+clientID.String(), nil)
+		del.SetPathValue("clientId", clientID.String())
+		del = del.WithContext(contextWithUser(del.Context(), database.User{ID: uuid.New()}))
+		rr := httptest.NewRecorder()
+		cfg.handlerDeleteOAuthClient(rr, del)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected the client to be deleted, got %d", rr.Code)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr = httptest.NewRecorder()
+		cfg.requireAuth(cfg.requireScope(auth.ScopeChirpsRead, ok)).ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected the deleted client's token to be rejected, got %d", rr.Code)
+		}
+	})
+}
+
+func TestOAuthAuthorize(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}}
+	clientID := uuid.New().String()
+
+	tests := []struct {
+		name         string
+		query        string
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:     "consent page",
+			query:    "response_type=code&client_id=" + clientID + "&redirect_uri=" + database.MockOAuthRedirectURI + "&scope=chirps:read&state=xyz&code_challenge=abc&code_challenge_method=S256",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "unregistered redirect uri is not followed",
+			query:    "response_type=code&client_id=" + clientID + "&redirect_uri=https://evil.example/&scope=chirps:read&code_challenge=abc&code_challenge_method=S256",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:         "missing pkce",
+			query:        "response_type=code&client_id=" + clientID + "&redirect_uri=" + database.MockOAuthRedirectURI + "&scope=chirps:read&state=xyz",
+			wantCode:     http.StatusFound,
+			wantLocation: database.MockOAuthRedirectURI + "?error=invalid_request",
+		},
+		{
+			name:         "unknown scope",
+			query:        "response_type=code&client_id=" + clientID + "&redirect_uri=" + database.MockOAuthRedirectURI + "&scope=admin&code_challenge=abc&code_challenge_method=S256",
+			wantCode:     http.StatusFound,
+			wantLocation: database.MockOAuthRedirectURI + "?error=invalid_scope",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/oauth/authorize?"+tt.query, nil)
+			rr := httptest.NewRecorder()
+			cfg.handlerOAuthAuthorize(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d", tt.wantCode, rr.Code)
+			}
+			if loc := rr.Header().Get("Location"); !strings.HasPrefix(loc, tt.wantLocation) {
+				t.Errorf("expected redirect to %q, got %q", tt.wantLocation, loc)
+			}
+		})
+	}
+}
+
+func TestHandlerPolkaWebhook(t *testing.T) {
+	cfg := apiConfig{
+		db:    &database.MockDB{},
+		polka: auth.NewWebhookVerifier("polka-key", auth.DefaultWebhookTolerance),
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		name     string
+		body     string
+		key      string
+		wantCode int
+	}{
+		{"signed upgrade", `{"id":"evt_1","event":"user.upgraded","data":{"user_id":"` + uuid.NewString() + `"}}`, "polka-key", http.StatusNoContent},
+		{"wrong key", `{"id":"evt_2","event":"user.upgraded","data":{"user_id":"` + uuid.NewString() + `"}}`, "guessed-key", http.StatusUnauthorized},
+		{"missing event id", `{"event":"user.upgraded","data":{"user_id":"` + uuid.NewString() + `"}}`, "polka-key", http.StatusBadRequest},
+		{"renewal", `{"id":"evt_3","event":"user.renewed","data":{"user_id":"` + uuid.NewString() + `","period_end":"2030-01-01T00:00:00Z"}}`, "polka-key", http.StatusNoContent},
+		{"payment failed", `{"id":"evt_4","event":"user.payment_failed","data":{"user_id":"` + uuid.NewString() + `"}}`, "polka-key", http.StatusNoContent},
+		{"malformed user id", `{"id":"evt_5","event":"user.refunded","data":{"user_id":"not-a-uuid"}}`, "polka-key", http.StatusBadRequest},
+		{"refund for unknown user", `{"id":"evt_7","event":"user.refunded","data":{"user_id":"` + database.MockDeletedUser.String() + `"}}`, "polka-key", http.StatusNotFound},
+		{"database down", `{"id":"evt_8","event":"user.upgraded","data":{"user_id":"` + database.MockUnavailableUser.String() + `"}}`, "polka-key", http.StatusInternalServerError},
+		{"unhandled event", `{"id":"evt_6","event":"user.renamed","data":{"user_id":"not-a-uuid"}}`, "polka-key", http.StatusNoContent},
+		{"redelivered event", `{"id":"` + database.MockDuplicateWebhookEvent + `","event":"user.upgraded","data":{"user_id":"` + uuid.NewString() + `"}}`, "polka-key", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/polka/webhooks", strings.NewReader(tt.body))
+			req.Header.Set(auth.WebhookTimestampHeader, now)
+			req.Header.Set(auth.WebhookSignatureHeader, auth.SignWebhook(tt.key, now, []byte(tt.body)))
+			rr := httptest.NewRecorder()
+			cfg.handlerPolkaWebhook(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected %d, got %d", tt.wantCode, rr.Code)
+			}
+		})
+	}
+}
+
+func TestSubscriptionPeriod(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := now.Add(-time.Hour)
+	end := now.AddDate(1, 0, 0)
+
+	tests := []struct {
+		name      string
+		start     *time.Time
+		end       *time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"no period given", nil, nil, now, now.Add(defaultSubscriptionPeriod)},
+		{"start given", &start, nil, start, start.Add(defaultSubscriptionPeriod)},
+		{"both given", &start, &end, start, end},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStart, gotEnd := subscriptionPeriod(tt.start, tt.end, now)
+			if !gotStart.Equal(tt.wantStart) || !gotEnd.Equal(tt.wantEnd) {
+				t.Errorf("expected %v to %v, got %v to %v", tt.wantStart, tt.wantEnd, gotStart, gotEnd)
+			}
+		})
+	}
+}
+
+func TestChirpEntitlements(t *testing.T) {
+	cfg := apiConfig{entitlements: entitlements.Default()}
+	free := database.User{}
+	red := database.User{IsChirpyRed: true}
+	long := strings.Repeat("a", 200)
+
+	if _, err := validateChirp(long, cfg.entitlementsFor(free).MaxChirpLength); err == nil {
+		t.Error("expected a 200 character chirp to be too long on the free plan")
+	}
+	if _, err := validateChirp(long, cfg.entitlementsFor(red).MaxChirpLength); err != nil {
+		t.Errorf("expected a 200 character chirp to fit on Chirpy Red: %v", err)
+	}
+	// Limits count characters, not bytes.
+	if _, err := validateChirp(strings.Repeat("é", 140), cfg.entitlementsFor(free).MaxChirpLength); err != nil {
+		t.Errorf("expected 140 two-byte characters to fit on the free plan: %v", err)
+	}
+
+	policy := cfg.planRateLimit(red, chirpRateLimit)
+	if policy.Limit != 120 || policy.Period != time.Minute {
+		t.Errorf("expected Chirpy Red to raise the chirp rate limit, got %+v", policy)
+	}
+	if policy := cfg.planRateLimit(free, chirpRateLimit); policy != chirpRateLimit {
+		t.Errorf("expected the free plan to keep the default rate limit, got %+v", policy)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		user   database.User
+		posted time.Time
+		want   bool
+	}{
+		{"free users can't edit", free, now.Add(-time.Second), false},
+		{"red user within window", red, now.Add(-time.Minute), true},
+		{"red user after window", red, now.Add(-time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirp := database.Chirp{CreatedAt: tt.posted}
+			if got := canEditChirp(chirp, cfg.entitlementsFor(tt.user).EditWindow.Duration, now); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandlerCreateWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		platform string
+		body     string
+		wantCode int
+	}{
+		{"https endpoint", "prod", `{"url":"https://example.com/hooks","events":["chirp.created"]}`, http.StatusCreated},
+		{"plain http outside dev", "prod", `{"url":"http://example.com/hooks","events":["chirp.created"]}`, http.StatusBadRequest},
+		{"plain http in dev", "dev", `{"url":"http://localhost:9000/hooks","events":["chirp.deleted"]}`, http.StatusCreated},
+		{"unknown event", "prod", `{"url":"https://example.com/hooks","events":["user.deleted"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{db: &database.MockDB{}, platform: tt.platform}
+			req := httptest.NewRequest("POST", "/api/webhooks", strings.NewReader(tt.body))
+			req = req.WithContext(contextWithUser(req.Context(), database.User{ID: uuid.New()}))
+			rr := httptest.NewRecorder()
+			cfg.handlerCreateWebhook(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+			if rr.Code == http.StatusCreated && !strings.Contains(rr.Body.String(), `"secret":"whsec_`) {
+				t.Errorf("expected the signing secret in the response, got %s", rr.Body)
+			}
+		})
+	}
+}
+
+func TestHandlerListWebhookDeliveries(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       uuid.UUID
+		endpointID string
+		wantCode   int
+	}{
+		{"own endpoint", database.MockChirpAuthor, database.MockWebhookEndpoint.String(), http.StatusOK},
+		{"someone else's endpoint", uuid.New(), database.MockWebhookEndpoint.String(), http.StatusNotFound},
+		{"unknown endpoint", database.MockChirpAuthor, uuid.NewString(), http.StatusNotFound},
+		{"malformed id", database.MockChirpAuthor, "nope", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{db: &database.MockDB{}}
+			req := httptest.NewRequest("GET", "/api/webhooks/"+tt.endpointID+"/deliveries", nil)
+			req.SetPathValue("webhookId", tt.endpointID)
+			req = req.WithContext(contextWithUser(req.Context(), database.User{ID: tt.user}))
+			rr := httptest.NewRecorder()
+			cfg.handlerListWebhookDeliveries(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestHandlerListNotifications(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+	}{
+		{"first page", "", http.StatusOK},
+		{"unread only", "?unread=true&limit=5", http.StatusOK},
+		{"valid cursor", "?cursor=" + pagination.EncodeCursor(time.Now(), uuid.New()), http.StatusOK},
+		{"bad cursor", "?cursor=nope", http.StatusBadRequest},
+		{"limit too large", "?limit=500", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{db: &database.MockDB{}}
+			req := httptest.NewRequest("GET", "/api/notifications"+tt.query, nil)
+			req = req.WithContext(contextWithUser(req.Context(), database.User{ID: uuid.New()}))
+			rr := httptest.NewRecorder()
+			cfg.handlerListNotifications(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+			if rr.Code == http.StatusOK && rr.Body.String() != `{"notifications":[],"unread_count":0}` {
+				t.Errorf("unexpected body %s", rr.Body)
+			}
+		})
+	}
+}
+
+func TestRelayOutbox(t *testing.T) {
+	db := &database.MockDB{}
+	cfg := &apiConfig{db: db, events: events.NewBus()}
+	published := map[events.Type]int{}
+	cfg.events.Subscribe("test", func(ctx context.Context, ev events.Event) error {
+		published[ev.Type]++
+		if ev.Type == events.ChirpDeleted {
+			return errors.New("subscriber is down")
+		}
+		return nil
+	})
+	ctx := context.Background()
+	for _, typ := range []events.Type{events.ChirpCreated, events.ChirpDeleted} {
+		if err := events.Record(ctx, db, typ, uuid.New(), struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range outboxMaxAttempts + 2 {
+		cfg.relayOutbox(ctx)
+	}
+	if published[events.ChirpCreated] != 1 {
+		t.Errorf("expected a published event to be marked processed, published it %d times", published[events.ChirpCreated])
+	}
+	if published[events.ChirpDeleted] != outboxMaxAttempts {
+		t.Errorf("expected a failing event to be parked after %d attempts, published it %d times", outboxMaxAttempts, published[events.ChirpDeleted])
+	}
+}
+
+func TestHandlerStream(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}, stream: stream.NewHub(stream.DefaultBuffer)}
+	srv := httptest.NewServer(http.HandlerFunc(cfg.handlerStream))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?author_id=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad author_id to be rejected, got %d", resp.StatusCode)
+	}
+
+	author := uuid.New()
+	resp, err = http.Get(srv.URL + "?author_id=" + author.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != "retry: 3000\n" {
+		t.Fatalf("unexpected first line %q", line)
+	}
+
+	eventID := uuid.New()
+	cfg.stream.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpCreated, UserID: uuid.New(), Payload: []byte(`{}`)})
+	cfg.stream.Handle(context.Background(), events.Event{ID: eventID, Type: events.ChirpCreated, UserID: author, Payload: []byte(`{"body":"hi"}`)})
+
+	var got []string
+	for len(got) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			got = append(got, line)
+		}
+	}
+	want := []string{"id: " + eventID.String(), "event: chirp.created", `data: {"body":"hi"}`}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %q, got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestHandlerWebSocket(t *testing.T) {
+	cfg := apiConfig{
+		db:                 &database.MockDB{},
+		stream:             stream.NewHub(stream.DefaultBuffer),
+		notificationStream: stream.NewHub(stream.DefaultBuffer),
+	}
+	user := database.User{ID: uuid.New()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg.handlerWebSocket(w, r.WithContext(contextWithUser(r.Context(), user)))
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	roundTrip := func(msg string) wsServerMessage {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		var reply wsServerMessage
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	if reply := roundTrip(`{"type":"ping","id":"1"}`); reply.Type != "pong" || reply.ID != "1" {
+		t.Errorf("expected a pong, got %+v", reply)
+	}
+	if reply := roundTrip(`{"type":"subscribe","id":"2","channel":"thread:nope"}`); reply.Type != "error" {
+		t.Errorf("expected a bad channel to be refused, got %+v", reply)
+	}
+	if reply := roundTrip(`{"type":"subscribe","channel":"home"}`); reply.Type != "error" || !strings.Contains(reply.Error, "follows") {
+		t.Errorf("expected the home timeline to be refused, got %+v", reply)
+	}
+	if reply := roundTrip(`not json`); reply.Type != "error" {
+		t.Errorf("expected an error for a malformed message, got %+v", reply)
+	}
+	if reply := roundTrip(`{"type":"subscribe","id":"3","channel":"notifications"}`); reply.Type != "subscribed" || reply.Channel != "notifications" {
+		t.Fatalf("expected to be subscribed, got %+v", reply)
+	}
+
+	// Someone else's notification isn't delivered; the user's own is.
+	cfg.liveNotification(notifications.Notification{UserID: uuid.New(), Kind: notifications.KindRedUpgrade, EventID: uuid.New()})
+	eventID := uuid.New()
+	cfg.liveNotification(notifications.Notification{UserID: user.ID, Kind: notifications.KindRedUpgrade, EventID: eventID})
+	var event wsServerMessage
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != "event" || event.Channel != "notifications" || event.EventID != eventID.String() || !strings.Contains(string(event.Data), "Welcome to Chirpy Red!") {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	cfg.stream.Close()
+	cfg.notificationStream.Close()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected the server to close the connection on shutdown, got %v", err)
+	}
+}
+
+func TestHandlerCreateConversation(t *testing.T) {
+	user := database.User{ID: uuid.New()}
+	many := make([]string, maxConversationMembers)
+	for i := range many {
+		many[i] = `"` + uuid.NewString() + `"`
+	}
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"one-to-one", `{"member_ids":["` + uuid.NewString() + `"]}`, http.StatusCreated},
+		{"existing one-to-one", `{"member_ids":["` + database.MockChirpAuthor.String() + `"]}`, http.StatusOK},
+		{"group", `{"member_ids":["` + uuid.NewString() + `","` + database.MockChirpAuthor.String() + `"]}`, http.StatusCreated},
+		{"only yourself", `{"member_ids":["` + user.ID.String() + `"]}`, http.StatusBadRequest},
+		{"nobody", `{"member_ids":[]}`, http.StatusBadRequest},
+		{"too many members", `{"member_ids":[` + strings.Join(many, ",") + `]}`, http.StatusBadRequest},
+		{"blocked member", `{"member_ids":["` + database.MockBlockedUser.String() + `"]}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{db: &database.MockDB{}}
+			req := httptest.NewRequest("POST", "/api/conversations", strings.NewReader(tt.body))
+			req = req.WithContext(contextWithUser(req.Context(), user))
+			rr := httptest.NewRecorder()
+			cfg.handlerCreateConversation(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestConversationRequiresMembership(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}}
+	handlers := map[string]http.HandlerFunc{
+		"get":      cfg.handlerGetConversation,
+		"messages": cfg.handlerListMessages,
+		"send":     cfg.handlerSendMessage,
+		"read":     cfg.handlerMarkConversationRead,
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", strings.NewReader(`{"body":"hi"}`))
+			req.SetPathValue("conversationId", uuid.NewString())
+			req = req.WithContext(contextWithUser(req.Context(), database.User{ID: uuid.New()}))
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("expected %d for a non-member, got %d", http.StatusNotFound, rr.Code)
+			}
+		})
+	}
+}
+
+func TestDirectMessageReadBy(t *testing.T) {
+	sender, reader, behind := uuid.New(), uuid.New(), uuid.New()
+	sent := time.Now()
+	members := []database.ConversationMember{
+		{UserID: sender, LastReadAt: sql.NullTime{Time: sent, Valid: true}},
+		{UserID: reader, LastReadAt: sql.NullTime{Time: sent.Add(time.Second), Valid: true}},
+		{UserID: behind, LastReadAt: sql.NullTime{Time: sent.Add(-time.Second), Valid: true}},
+	}
+	got := directMessageFromDB(database.Message{SenderID: sender, CreatedAt: sent}, members)
+	if len(got.ReadBy) != 1 || got.ReadBy[0] != reader {
+		t.Errorf("expected only %s to have read it, got %v", reader, got.ReadBy)
+	}
+}
+
+func TestHandlerBlocksAndMutes(t *testing.T) {
+	user := database.User{ID: uuid.New()}
+	cfg := apiConfig{db: &database.MockDB{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /api/blocks/{userId}", cfg.handlerBlockUser)
+	mux.HandleFunc("PUT /api/mutes/{userId}", cfg.handlerMuteUser)
+	mux.HandleFunc("POST /api/mutes/keywords", cfg.handlerCreateKeywordMute)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{"block", "PUT", "/api/blocks/" + uuid.NewString(), "", http.StatusNoContent},
+		{"block yourself", "PUT", "/api/blocks/" + user.ID.String(), "", http.StatusBadRequest},
+		{"block bad id", "PUT", "/api/blocks/nope", "", http.StatusBadRequest},
+		{"mute forever", "PUT", "/api/mutes/" + uuid.NewString(), "", http.StatusNoContent},
+		{"mute for a day", "PUT", "/api/mutes/" + uuid.NewString(), `{"duration":"24h"}`, http.StatusNoContent},
+		{"mute for negative time", "PUT", "/api/mutes/" + uuid.NewString(), `{"duration":"-1h"}`, http.StatusBadRequest},
+		{"mute yourself", "PUT", "/api/mutes/" + user.ID.String(), "", http.StatusBadRequest},
+		{"keyword", "POST", "/api/mutes/keywords", `{"keyword":"spoilers"}`, http.StatusCreated},
+		{"blank keyword", "POST", "/api/mutes/keywords", `{"keyword":"  "}`, http.StatusBadRequest},
+		{"long keyword", "POST", "/api/mutes/keywords", `{"keyword":"` + strings.Repeat("a", maxKeywordLength+1) + `"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req = req.WithContext(contextWithUser(req.Context(), user))
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestVisibilityHides(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}}
+	visible, err := cfg.visibilityFor(context.Background(), uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !visible.hides(database.MockBlockedUser, "hello") {
+		t.Error("expected a blocked author's chirp to be hidden")
+	}
+	if visible.hides(uuid.New(), "hello") {
+		t.Error("expected another author's chirp to be visible")
+	}
+	anonymous, err := cfg.visibilityFor(context.Background(), uuid.Nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anonymous.hides(database.MockBlockedUser, "hello") {
+		t.Error("expected anonymous viewers to see everything")
+	}
+}
+
+func TestIsSuspended(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		user database.User
+		want bool
+	}{
+		{"never suspended", database.User{}, false},
+		{"suspended indefinitely", database.User{SuspendedAt: sql.NullTime{Time: now, Valid: true}}, true},
+		{"suspension running", database.User{
+			SuspendedAt:    sql.NullTime{Time: now, Valid: true},
+			SuspendedUntil: sql.NullTime{Time: now.Add(time.Hour), Valid: true},
+		}, true},
+		{"suspension over", database.User{
+			SuspendedAt:    sql.NullTime{Time: now.Add(-2 * time.Hour), Valid: true},
+			SuspendedUntil: sql.NullTime{Time: now.Add(-time.Hour), Valid: true},
+		}, false},
+	}
+	for _, tt := range tests {
+		if got := isSuspended(tt.user, now); got != tt.want {
+			t.Errorf("%s: isSuspended = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	t.Run("no session for suspended users", func(t *testing.T) {
+		cfg := apiConfig{db: &database.MockDB{}, secret: "testSecret"}
+		req := httptest.NewRequest("POST", "/api/login", nil)
+		rr := httptest.NewRecorder()
+		cfg.respondWithSession(rr, req, tests[1].user)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", rr.Code)
+		}
+	})
+}
+
+func TestHandlerCreateReport(t *testing.T) {
+	user := database.User{ID: uuid.New()}
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"chirp", `{"chirp_id":"` + uuid.NewString() + `","reason":"spam"}`, http.StatusCreated},
+		{"user", `{"user_id":"` + uuid.NewString() + `","reason":"harassment","details":"see their replies"}`, http.StatusCreated},
+		{"both", `{"chirp_id":"` + uuid.NewString() + `","user_id":"` + uuid.NewString() + `","reason":"spam"}`, http.StatusBadRequest},
+		{"neither", `{"reason":"spam"}`, http.StatusBadRequest},
+		{"unknown reason", `{"user_id":"` + uuid.NewString() + `","reason":"boring"}`, http.StatusBadRequest},
+		{"yourself", `{"user_id":"` + user.ID.String() + `","reason":"spam"}`, http.StatusBadRequest},
+		{"long details", `{"user_id":"` + uuid.NewString() + `","reason":"other","details":"` + strings.Repeat("a", maxReportDetailsLength+1) + `"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{db: &database.MockDB{}}
+			req := httptest.NewRequest("POST", "/api/reports", strings.NewReader(tt.body))
+			req = req.WithContext(contextWithUser(req.Context(), user))
+			rr := httptest.NewRecorder()
+			cfg.handlerCreateReport(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestHandlerResolveReport(t *testing.T) {
+	moderator := database.User{ID: uuid.New(), Role: string(auth.RoleModerator)}
+	cfg := apiConfig{db: &database.MockDB{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/reports/{reportId}/resolve", cfg.handlerResolveReport)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"dismiss", `{"action":"dismiss"}`, http.StatusOK},
+		{"hide chirp", `{"action":"hide_chirp","note":"spam link"}`, http.StatusOK},
+		{"suspend for a week", `{"action":"suspend_user","duration":"168h"}`, http.StatusOK},
+		{"claim isn't a resolution", `{"action":"claim"}`, http.StatusBadRequest},
+		{"negative duration", `{"action":"suspend_user","duration":"-1h"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/reports/"+uuid.NewString()+"/resolve", strings.NewReader(tt.body))
+			req = req.WithContext(contextWithUser(req.Context(), moderator))
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var report Report
+			if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Status != "resolved" || report.ClaimedBy == nil || *report.ClaimedBy != moderator.ID {
+				t.Errorf("expected the report resolved by the moderator, got %+v", report)
+			}
+		})
+	}
+
+	t.Run("hiding a chirp announces it", func(t *testing.T) {
+		db := &database.MockDB{}
+		cfg := apiConfig{db: db, events: events.NewBus()}
+		var deleted []uuid.UUID
+		cfg.events.Subscribe("test", func(ctx context.Context, ev events.Event) error {
+			deleted = append(deleted, ev.UserID)
+			return nil
+		}, events.ChirpDeleted)
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /admin/reports/{reportId}/resolve", cfg.handlerResolveReport)
+		req := httptest.NewRequest("POST", "/admin/reports/"+uuid.NewString()+"/resolve", strings.NewReader(`{"action":"hide_chirp"}`))
+		req = req.WithContext(contextWithUser(req.Context(), moderator))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body)
+		}
+		if err := cfg.relayOutbox(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if len(deleted) != 1 || deleted[0] != database.MockChirpAuthor {
+			t.Errorf("expected a chirp.deleted event for the hidden chirp, got %v", deleted)
+		}
+	})
+}
+
+func TestHandlerUnclaimReport(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/reports/{reportId}/unclaim", cfg.handlerUnclaimReport)
+
+	tests := []struct {
+		name     string
+		report   uuid.UUID
+		user     database.User
+		wantCode int
+	}{
+		{"by the holder", database.MockClaimedReport, database.User{ID: database.MockModerator, Role: string(auth.RoleModerator)}, http.StatusOK},
+		{"by an admin", database.MockClaimedReport, database.User{ID: uuid.New(), Role: string(auth.RoleAdmin)}, http.StatusOK},
+		{"by another moderator", database.MockClaimedReport, database.User{ID: uuid.New(), Role: string(auth.RoleModerator)}, http.StatusForbidden},
+		{"an open report", uuid.New(), database.User{ID: database.MockModerator, Role: string(auth.RoleModerator)}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/reports/"+tt.report.String()+"/unclaim", nil)
+			req = req.WithContext(contextWithUser(req.Context(), tt.user))
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var report Report
+			if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Status != "open" || report.ClaimedBy != nil {
+				t.Errorf("expected the report back in the queue, got %+v", report)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := apiConfig{rateLimits: ratelimit.NewMemoryStore()}
+	policy := ratelimit.Policy{Name: "test", Limit: 2, Period: time.Minute}
+	handler := cfg.rateLimit(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func(remoteAddr string, user *database.User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if user != nil {
+			req = req.WithContext(contextWithUser(req.Context(), *user))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 1; i >= 0; i-- {
+		rr := do("192.0.2.1:1234", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(i) {
+			t.Errorf("expected %d remaining, got %q", i, got)
+		}
+	}
+	rr := do("192.0.2.1:1234", nil)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "30" || rr.Header().Get("RateLimit-Policy") != "2;w=60" {
+		t.Errorf("unexpected headers %v", rr.Header())
+	}
+
+	if rr := do("192.0.2.2:1234", nil); rr.Code != http.StatusOK {
+		t.Errorf("expected another IP to have its own limit, got %d", rr.Code)
+	}
+	user := database.User{ID: uuid.New()}
+	if rr := do("192.0.2.1:1234", &user); rr.Code != http.StatusOK {
+		t.Errorf("expected a user to be limited apart from their IP, got %d", rr.Code)
+	}
+}
+
+func TestFailureLog(t *testing.T) {
+	l := &failureLog{every: time.Minute}
+	now := time.Now()
+	if _, ok := l.record(now); !ok {
+		t.Fatal("expected the first failure to be logged")
+	}
+	for i := range 3 {
+		if _, ok := l.record(now.Add(time.Duration(i) * time.Second)); ok {
+			t.Fatal("expected failures within a minute to be counted, not logged")
+		}
+	}
+	missed, ok := l.record(now.Add(time.Minute))
+	if !ok || missed != 3 {
+		t.Errorf("expected the next failure a minute later to be logged with 3 missed, got %d, %v", missed, ok)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := apiConfig{trustedProxies: proxies}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted peer can't forward", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"trusted proxy", "127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"chain of proxies", "10.0.0.2:1234", "203.0.113.9, 198.51.100.7, 10.0.0.1", "198.51.100.7"},
+		{"only proxies", "10.0.0.2:1234", "10.0.0.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := cfg.clientIP(req); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/99"); err == nil {
+		t.Error("expected a bad range to be rejected")
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}}
+	calls := 0
+	handler := cfg.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Location", "/api/chirps/"+strconv.Itoa(calls))
+		w.Header().Set("ETag", `"`+strconv.Itoa(calls)+`"`)
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(10-calls))
+		respondWithJSON(w, http.StatusCreated, map[string]any{"call": calls, "body": string(body)})
+	}))
+	user := database.User{ID: uuid.New()}
+	do := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(body))
+		req = req.WithContext(contextWithUser(req.Context(), user))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := do("abc", `{"body":"hi"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", first.Code)
+	}
+	retry := do("abc", `{"body":"hi"}`)
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("expected the first response replayed, got %d %s", retry.Code, retry.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected replay headers %v", retry.Header())
+	}
+	if retry.Header().Get("Location") != "/api/chirps/1" || retry.Header().Get("ETag") != `"1"` {
+		t.Errorf("expected the handler's headers replayed, got %v", retry.Header())
+	}
+	if retry.Header().Get("RateLimit-Remaining") != "" {
+		t.Errorf("expected headers about the first request itself not to be replayed, got %v", retry.Header())
+	}
+	if calls != 1 {
+		t.Errorf("expected the handler to run once, ran %d times", calls)
+	}
+
+	if rr := do("abc", `{"body":"bye"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a different body, got %d", rr.Code)
+	}
+	if rr := do("def", `{"body":"hi"}`); rr.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("expected a new key to run the handler, got %d after %d calls", rr.Code, calls)
+	}
+	do("", `{"body":"hi"}`)
+	do("", `{"body":"hi"}`)
+	if calls != 4 {
+		t.Errorf("expected requests without a key to always run, ran %d times", calls)
+	}
+	if rr := do(strings.Repeat("k", maxIdempotencyKey+1), `{}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a long key, got %d", rr.Code)
+	}
+}
+
+func TestConditionalChirpRequests(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}, entitlements: entitlements.Default()}
+	chirpID := uuid.New()
+	author := database.User{ID: database.MockChirpAuthor}
+	do := func(handler http.HandlerFunc, method string, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/chirps/"+chirpID.String(), strings.NewReader(`{"body":"edited"}`))
+		req.SetPathValue("chirpId", chirpID.String())
+		req = req.WithContext(contextWithUser(req.Context(), author))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	first := do(cfg.handlerGetChirpById, "GET", "", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d %q", first.Code, etag)
+	}
+	if got := first.Header().Get("Last-Modified"); got != database.MockUpdatedAt.Format(http.TimeFormat) {
+		t.Errorf("unexpected Last-Modified %q", got)
+	}
+	if rr := do(cfg.handlerGetChirpById, "GET", "If-None-Match", etag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("expected an empty 304 for a matching ETag, got %d %s", rr.Code, rr.Body)
+	}
+	if rr := do(cfg.handlerGetChirpById, "GET", "If-None-Match", `"stale"`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for a stale ETag, got %d", rr.Code)
+	}
+	if rr := do(cfg.handlerGetChirpById, "GET", "If-Modified-Since", database.MockUpdatedAt.Format(http.TimeFormat)); rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 when not modified since, got %d", rr.Code)
+	}
+
+	if rr := do(cfg.handlerUpdateChirp, "PUT", "If-Match", `"stale"`); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 updating with a stale ETag, got %d", rr.Code)
+	}
+	if rr := do(cfg.handlerDeleteChirp, "DELETE", "If-Match", `"stale"`); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 deleting with a stale ETag, got %d", rr.Code)
+	}
+	if rr := do(cfg.handlerDeleteChirp, "DELETE", "If-Match", etag); rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204 deleting with the current ETag, got %d", rr.Code)
+	}
+}
+
+func TestHandlerUpdateUserCurrentPassword(t *testing.T) {
+	passwords, err := auth.NewPasswordHasher(auth.AlgorithmArgon2id, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := apiConfig{
+		db:             &database.MockDB{},
+		entitlements:   entitlements.Default(),
+		passwords:      passwords,
+		accountLockout: lockout.NewTracker(lockout.Policy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}),
+	}
+	hash, err := passwords.Hash("old password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(user database.User, current string) int {
+		body := `{"email":"new@example.com","password":"correct horse battery staple","current_password":"` + current + `"}`
+		req := httptest.NewRequest("PUT", "/api/users", strings.NewReader(body))
+		req = req.WithContext(contextWithUser(req.Context(), user))
+		rr := httptest.NewRecorder()
+		cfg.handlerUpdateUser(rr, req)
+		return rr.Code
+	}
+
+	user := database.User{ID: uuid.New(), Email: "old@example.com", HashedPassword: hash}
+	if code := update(user, "old password"); code != http.StatusOK {
+		t.Errorf("expected 200 with the current password, got %d", code)
+	}
+	if code := update(user, "guess"); code != http.StatusForbidden {
+		t.Errorf("expected 403 with a wrong current password, got %d", code)
+	}
+	if code := update(user, ""); code != http.StatusForbidden {
+		t.Errorf("expected 403 without the current password, got %d", code)
+	}
+	update(user, "another guess")
+	if code := update(user, "old password"); code != http.StatusTooManyRequests {
+		t.Errorf("expected wrong guesses to lock the account, got %d", code)
+	}
+	oidcUser := database.User{ID: uuid.New(), Email: "sso@example.com", HashedPassword: noPasswordHash}
+	if code := update(oidcUser, ""); code != http.StatusOK {
+		t.Errorf("expected a user without a password to set one, got %d", code)
+	}
+}
+
+func TestConditionalUserRequests(t *testing.T) {
+	passwords, err := auth.NewPasswordHasher(auth.AlgorithmArgon2id, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := apiConfig{
+		db:             &database.MockDB{},
+		entitlements:   entitlements.Default(),
+		passwords:      passwords,
+		accountLockout: lockout.NewTracker(lockout.Policy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}),
+	}
+	user, _ := cfg.db.GetUserByID(context.Background(), uuid.New())
+	user.HashedPassword, err = passwords.Hash("old password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(handler http.HandlerFunc, method string, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/users", strings.NewReader(`{"email":"new@example.com","password":"correct horse battery staple","current_password":"old password"}`))
+		req = req.WithContext(contextWithUser(req.Context(), user))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	me := do(cfg.handlerGetCurrentUser, "GET", "", "")
+	etag := me.Header().Get("ETag")
+	if me.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d %q", me.Code, etag)
+	}
+	if rr := do(cfg.handlerGetCurrentUser, "GET", "If-None-Match", "W/"+etag); rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a weakly matching ETag, got %d", rr.Code)
+	}
+	if rr := do(cfg.handlerUpdateUser, "PUT", "If-Match", "W/"+etag); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for a weak ETag, got %d", rr.Code)
+	}
+	if rr := do(cfg.handlerUpdateUser, "PUT", "If-Match", `"stale", `+etag); rr.Code != http.StatusOK || rr.Header().Get("ETag") == "" {
+		t.Errorf("expected 200 with a new ETag when one matches, got %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}}
+	handler := cfg.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError(w, http.StatusNotFound, "couldn't find chrip", errors.New("no rows"))
+	}))
+	req := httptest.NewRequest("GET", "/api/chirps/x", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("expected application/problem+json, got %q", ct)
+	}
+	var p Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	want := Problem{Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound, Detail: "couldn't find chrip", RequestID: rr.Header().Get(requestIDHeader)}
+	if p.Type != want.Type || p.Title != want.Title || p.Status != want.Status || p.Detail != want.Detail || p.RequestID != want.RequestID || p.RequestID == "" {
+		t.Errorf("expected %+v, got %+v", want, p)
+	}
+	if strings.Contains(rr.Body.String(), "no rows") {
+		t.Errorf("the cause leaked into the response: %s", rr.Body)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := apiConfig{trustedProxies: proxies}
+	handler := cfg.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		name   string
+		remote string
+		id     string
+		kept   bool
+	}{
+		{"from a trusted proxy", "10.0.0.1:1234", "req-123", true},
+		{"from a client", "192.0.2.1:1234", "req-123", false},
+		{"with spaces", "10.0.0.1:1234", "req 123", false},
+		{"too long", "10.0.0.1:1234", strings.Repeat("a", maxRequestID+1), false},
+		{"missing", "10.0.0.1:1234", "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remote
+			if tc.id != "" {
+				req.Header.Set(requestIDHeader, tc.id)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			got := rr.Header().Get(requestIDHeader)
+			if got == "" || (got == tc.id) != tc.kept {
+				t.Errorf("expected kept=%v for %q, got %q", tc.kept, tc.id, got)
+			}
+		})
+	}
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	cfg := apiConfig{db: &database.MockDB{}, passwordPolicy: auth.DefaultPasswordPolicy()}
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+		fields  []string
+	}{
+		{"chirp with a bad id", cfg.handlerGetChirpById, "GET", "/api/chirps/nope", "", http.StatusBadRequest, nil},
+		{"chirps with a bad author", cfg.handlerGetAllChirps, "GET", "/api/chirps?author_id=nope", "", http.StatusBadRequest, nil},
+		{"sign-up that isn't JSON", cfg.handlerCreateUser, "POST", "/api/users", "{", http.StatusBadRequest, nil},
+		{"sign-up with short fields", cfg.handlerCreateUser, "POST", "/api/users", `{"email":"a@b","password":"p"}`, http.StatusBadRequest, []string{"email", "password"}},
+		{"login with a short email", cfg.handlerLogin, "POST", "/api/login", `{"email":"a@b","password":"secret"}`, http.StatusBadRequest, []string{"email"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			req.SetPathValue("chirpId", "nope")
+			rr := httptest.NewRecorder()
+			tc.handler(rr, req)
+			if rr.Code != tc.status {
+				t.Fatalf("expected %d, got %d %s", tc.status, rr.Code, rr.Body)
+			}
+			var p Problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+				t.Fatalf("could not unmarshal response: %v", err)
+			}
+			var fields []string
+			for _, f := range p.Errors {
+				fields = append(fields, f.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tc.fields, ",") {
+				t.Errorf("expected errors for %v, got %v", tc.fields, fields)
+			}
+		})
+	}
+}
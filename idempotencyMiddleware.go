@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"chirpy/internal/database"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKey     = 255
+	// maxIdempotentBody bounds the request bodies read to fingerprint them.
+	maxIdempotentBody = 1 << 20
+	// idempotencyAbandoned is how long a request may run before a retry
+	// with its key assumes it died and starts over.
+	idempotencyAbandoned = time.Minute
+)
+
+// replayedHeaders are the response headers handlers set that a replay
+// repeats. The rest, like X-Request-Id and RateLimit-*, describe the
+// retry itself.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag", "Last-Modified"}
+
+// idempotencyRecorder keeps a copy of the response it writes.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// storedHeaders picks the replayedHeaders out of h.
+func storedHeaders(h http.Header) json.RawMessage {
+	stored := http.Header{}
+	for _, name := range replayedHeaders {
+		if v := h.Values(name); len(v) > 0 {
+			stored[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	// A header is a map of string slices and always marshals.
+	data, _ := json.Marshal(stored)
+	return data
+}
+
+// requestFingerprint identifies a request by its method, path and body.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent lets clients retry next safely by sending an Idempotency-Key
+// header: the first response is stored for cfg.idempotencyTTL and replayed
+// to retries with the same key and body. Keys belong to a user, so it goes
+// after requireAuth. Server errors aren't stored, so those can be retried.
+//
+// Only POSTs a retry would duplicate use it. Responses that show a secret
+// once (API keys, OAuth clients, webhook endpoints, tokens, TOTP enrollment)
+// aren't stored, so those endpoints don't take keys. Nor does sign-up, which
+// has no user to scope keys to; a repeat is refused as a duplicate email.
+// The rest, like marking things read, are already safe to repeat.
+func (cfg *apiConfig) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		user, ok := userFromContext(r.Context())
+		if key == "" || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKey), errors.New("idempotency key too long"))
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't read request", err)
+			return
+		}
+		if len(body) > maxIdempotentBody {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request body is too large", errors.New("idempotent request body too large"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ttl := cfg.idempotencyTTL
+		if ttl == 0 {
+			ttl = defaultIdempotencyTTL
+		}
+		scope := user.ID.String()
+		fingerprint := requestFingerprint(r, body)
+		now := time.Now()
+		claimed, err := cfg.db.ClaimIdempotencyKey(r.Context(), database.ClaimIdempotencyKeyParams{
+			Scope:           scope,
+			Key:             key,
+			Fingerprint:     fingerprint,
+			ExpiresAt:       now.Add(ttl),
+			AbandonedBefore: now.Add(-idempotencyAbandoned),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check Idempotency-Key", err)
+			return
+		}
+		if claimed == 0 {
+			cfg.replayIdempotent(w, r, scope, key, fingerprint)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// The client may have gone; the outcome still needs recording.
+		ctx := context.WithoutCancel(r.Context())
+		if rec.status >= 500 || rec.status == 0 {
+			err = cfg.db.DeleteIdempotencyKey(ctx, database.DeleteIdempotencyKeyParams{Scope: scope, Key: key})
+		} else {
+			err = cfg.db.CompleteIdempotencyKey(ctx, database.CompleteIdempotencyKeyParams{
+				Scope:           scope,
+				Key:             key,
+				StatusCode:      sql.NullInt32{Int32: int32(rec.status), Valid: true},
+				ResponseBody:    rec.body.Bytes(),
+				ResponseHeaders: storedHeaders(rec.Header()),
+			})
+		}
+		if err != nil {
+			slog.Error("recording idempotent response", "scope", scope, "key", key, "err", err)
+		}
+	})
+}
+
+// replayIdempotent answers a retry with the stored response, if the first
+// request has finished and was the same as this one.
+func (cfg *apiConfig) replayIdempotent(w http.ResponseWriter, r *http.Request, scope, key, fingerprint string) {
+	stored, err := cfg.db.GetIdempotencyKey(r.Context(), database.GetIdempotencyKeyParams{Scope: scope, Key: key})
+	if errors.Is(err, sql.ErrNoRows) {
+		// The first request failed and gave the key up in the meantime.
+		respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key just failed; retry it", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check Idempotency-Key", err)
+		return
+	}
+	if stored.Fingerprint != fingerprint {
+		respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request", errors.New("idempotency key reused"))
+		return
+	}
+	if !stored.StatusCode.Valid {
+		w.Header().Set("Retry-After", "1")
+		respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress", errors.New("idempotent request in progress"))
+		return
+	}
+	var headers http.Header
+	if err := json.Unmarshal(stored.ResponseHeaders, &headers); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't replay response", err)
+		return
+	}
+	for name, values := range headers {
+		w.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(stored.StatusCode.Int32))
+	w.Write(stored.ResponseBody)
+}
+
+// expireIdempotencyKeys forgets responses older than their TTL.
+func (cfg *apiConfig) expireIdempotencyKeys(ctx context.Context) error {
+	_, err := cfg.db.DeleteExpiredIdempotencyKeys(ctx)
+	return err
+}
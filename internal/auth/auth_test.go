@@ -2,11 +2,20 @@ package auth_test
 
 import (
 	"chirpy/internal/auth"
+	"encoding/base32"
 	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestMakeRefreshToken(t *testing.T) {
@@ -92,3 +101,550 @@ func TestMakeAndValidateJWT(t *testing.T) {
 		}
 	})
 }
+
+func TestValidateJWTWithOptions(t *testing.T) {
+	const secret = "mySecret123"
+	userID := uuid.New()
+	opts := auth.DefaultValidatorOptions()
+	opts.Leeway = 30 * time.Second
+
+	sign := func(t *testing.T, method jwt.SigningMethod, claims *auth.Claims) string {
+		t.Helper()
+		ss, err := jwt.NewWithClaims(method, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return ss
+	}
+	validClaims := func(issuedAt time.Time, expiresIn time.Duration) *auth.Claims {
+		return &auth.Claims{
+			TokenType: auth.TokenTypeAccess,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    auth.TokenIssuer,
+				Audience:  jwt.ClaimStrings{auth.TokenAudience},
+				Subject:   userID.String(),
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				ExpiresAt: jwt.NewNumericDate(issuedAt.Add(expiresIn)),
+			},
+		}
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		wantErr error
+	}{
+		{
+			name: "valid token",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, validClaims(now, time.Hour))
+			},
+		},
+		{
+			name: "expired within leeway",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, validClaims(now.Add(-time.Minute), time.Minute-10*time.Second))
+			},
+		},
+		{
+			name: "expired beyond leeway",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, validClaims(now.Add(-time.Hour), time.Minute))
+			},
+			wantErr: jwt.ErrTokenExpired,
+		},
+		{
+			name: "missing expiry",
+			token: func(t *testing.T) string {
+				c := validClaims(now, time.Hour)
+				c.ExpiresAt = nil
+				return sign(t, jwt.SigningMethodHS256, c)
+			},
+			wantErr: jwt.ErrTokenRequiredClaimMissing,
+		},
+		{
+			name: "issued in the future",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, validClaims(now.Add(time.Hour), time.Hour))
+			},
+			wantErr: jwt.ErrTokenUsedBeforeIssued,
+		},
+		{
+			name: "wrong issuer",
+			token: func(t *testing.T) string {
+				c := validClaims(now, time.Hour)
+				c.Issuer = "not-chirpy"
+				return sign(t, jwt.SigningMethodHS256, c)
+			},
+			wantErr: jwt.ErrTokenInvalidIssuer,
+		},
+		{
+			name: "wrong audience",
+			token: func(t *testing.T) string {
+				c := validClaims(now, time.Hour)
+				c.Audience = jwt.ClaimStrings{"someone-else"}
+				return sign(t, jwt.SigningMethodHS256, c)
+			},
+			wantErr: jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name: "missing token type",
+			token: func(t *testing.T) string {
+				c := validClaims(now, time.Hour)
+				c.TokenType = ""
+				return sign(t, jwt.SigningMethodHS256, c)
+			},
+			wantErr: auth.ErrInvalidTokenType,
+		},
+		{
+			name: "wrong token type",
+			token: func(t *testing.T) string {
+				c := validClaims(now, time.Hour)
+				c.TokenType = "refresh"
+				return sign(t, jwt.SigningMethodHS256, c)
+			},
+			wantErr: auth.ErrInvalidTokenType,
+		},
+		{
+			name: "older than max age",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, validClaims(now.Add(-48*time.Hour), 72*time.Hour))
+			},
+			wantErr: auth.ErrTokenTooOld,
+		},
+		{
+			name: "unexpected signing method",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS512, validClaims(now, time.Hour))
+			},
+			wantErr: jwt.ErrTokenSignatureInvalid,
+		},
+		{
+			name: "wrong secret",
+			token: func(t *testing.T) string {
+				ss, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims(now, time.Hour)).SignedString([]byte("wrongSecret"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ss
+			},
+			wantErr: jwt.ErrTokenSignatureInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := auth.ValidateJWTWithOptions(tt.token(t), secret, opts)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("expected token to validate: %v", err)
+				}
+				if id, _ := claims.UserID(); id != userID {
+					t.Errorf("expected subject %v, got %v", userID, id)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	t.Run("role claim round-trip", func(t *testing.T) {
+		userID := uuid.New()
+		token, err := auth.MakeAccessToken(userID, auth.RoleModerator, "mySecret123", time.Minute)
+		if err != nil {
+			t.Fatalf("expected to create a JWT: %v", err)
+		}
+		claims, err := auth.ValidateJWTWithOptions(token, "mySecret123", auth.DefaultValidatorOptions())
+		if err != nil {
+			t.Fatalf("expected to validate jwt: %v", err)
+		}
+		if claims.Role != auth.RoleModerator {
+			t.Errorf("expected role %q, got %q", auth.RoleModerator, claims.Role)
+		}
+	})
+
+	tests := []struct {
+		role auth.Role
+		min  auth.Role
+		want bool
+	}{
+		{auth.RoleUser, auth.RoleUser, true},
+		{auth.RoleUser, auth.RoleModerator, false},
+		{auth.RoleModerator, auth.RoleModerator, true},
+		{auth.RoleModerator, auth.RoleAdmin, false},
+		{auth.RoleAdmin, auth.RoleModerator, true},
+		{auth.Role(""), auth.RoleUser, false},
+		{auth.Role("root"), auth.RoleUser, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.AtLeast(tt.min); got != tt.want {
+			t.Errorf("%q.AtLeast(%q) = %v, want %v", tt.role, tt.min, got, tt.want)
+		}
+	}
+
+	if _, err := auth.ParseRole("superuser"); err == nil {
+		t.Error("expected error for unknown role")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B vectors for the SHA1 seed, truncated to six digits.
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, v := range vectors {
+		got, err := auth.TOTPCode(secret, auth.TOTPStep(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != v.want {
+			t.Errorf("TOTPCode at %d = %s, want %s", v.unix, got, v.want)
+		}
+	}
+
+	t.Run("validate allows one step of skew", func(t *testing.T) {
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		step := auth.TOTPStep(now)
+		for _, offset := range []int64{-1, 0, 1} {
+			code, _ := auth.TOTPCode(secret, step+offset)
+			got, err := auth.ValidateTOTP(secret, code, now)
+			if err != nil {
+				t.Errorf("offset %d: expected code to validate: %v", offset, err)
+			}
+			if got != step+offset {
+				t.Errorf("offset %d: expected step %d, got %d", offset, step+offset, got)
+			}
+		}
+		code, _ := auth.TOTPCode(secret, step+3)
+		if _, err := auth.ValidateTOTP(secret, code, now); !errors.Is(err, auth.ErrInvalidTOTPCode) {
+			t.Errorf("expected ErrInvalidTOTPCode, got %v", err)
+		}
+	})
+
+	t.Run("provisioning uri", func(t *testing.T) {
+		uri := auth.TOTPProvisioningURI("JBSWY3DPEHPK3PXP", "me@example.com")
+		want := "otpauth://totp/chirpy:me@example.com?algorithm=SHA1&digits=6&issuer=chirpy&period=30&secret=JBSWY3DPEHPK3PXP"
+		if uri != want {
+			t.Errorf("expected %s, got %s", want, uri)
+		}
+	})
+
+	t.Run("recovery codes", func(t *testing.T) {
+		codes, err := auth.GenerateRecoveryCodes(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{}
+		for _, c := range codes {
+			if len(c) != 11 || c[5] != '-' {
+				t.Errorf("unexpected code format %q", c)
+			}
+			if seen[c] {
+				t.Errorf("duplicate code %q", c)
+			}
+			seen[c] = true
+		}
+		if auth.HashRecoveryCode(codes[0]) != auth.HashRecoveryCode(" "+strings.ToUpper(codes[0])) {
+			t.Error("expected hash to ignore case and surrounding space")
+		}
+	})
+}
+
+func TestPasswordHasher(t *testing.T) {
+	argon, err := auth.NewPasswordHasher(auth.AlgorithmArgon2id, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHasher, err := auth.NewPasswordHasher(auth.AlgorithmBcrypt, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argonHash, err := argon.Hash("mySecret123")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("unexpected argon2id hash format %q", argonHash)
+	}
+	bcryptHash, err := bcryptHasher.Hash("mySecret123")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	t.Run("checks hashes from either algorithm", func(t *testing.T) {
+		for _, h := range []*auth.PasswordHasher{argon, bcryptHasher} {
+			for _, hash := range []string{argonHash, bcryptHash} {
+				if err := h.Check("mySecret123", hash); err != nil {
+					t.Errorf("%s hasher: expected %q to match, got %v", h.Algorithm, hash, err)
+				}
+				if err := h.Check("wrongPassword", hash); err == nil {
+					t.Errorf("%s hasher: expected wrong password to fail on %q", h.Algorithm, hash)
+				}
+			}
+		}
+	})
+
+	t.Run("needs rehash", func(t *testing.T) {
+		stronger, _ := auth.NewPasswordHasher(auth.AlgorithmBcrypt, 6)
+		tests := []struct {
+			name   string
+			hasher *auth.PasswordHasher
+			hash   string
+			want   bool
+		}{
+			{"argon2id current", argon, argonHash, false},
+			{"bcrypt to argon2id", argon, bcryptHash, true},
+			{"bcrypt current", bcryptHasher, bcryptHash, false},
+			{"bcrypt cost raised", stronger, bcryptHash, true},
+			{"argon2id to bcrypt", bcryptHasher, argonHash, true},
+		}
+		for _, tt := range tests {
+			if got := tt.hasher.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("%s: NeedsRehash = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+
+		weaker, _ := auth.NewPasswordHasher(auth.AlgorithmArgon2id, 10)
+		weaker.Argon2.Time = 1
+		oldHash, _ := weaker.Hash("mySecret123")
+		if !argon.NeedsRehash(oldHash) {
+			t.Error("expected argon2id hash with outdated parameters to need a rehash")
+		}
+	})
+
+	t.Run("rejects over-long passwords", func(t *testing.T) {
+		long := strings.Repeat("a", 73)
+		if _, err := bcryptHasher.Hash(long); !errors.Is(err, auth.ErrPasswordTooLong) {
+			t.Errorf("expected bcrypt to reject 73 bytes, got %v", err)
+		}
+		if _, err := argon.Hash(long); err != nil {
+			t.Errorf("expected argon2id to accept 73 bytes, got %v", err)
+		}
+		if _, err := argon.Hash(strings.Repeat("a", auth.MaxPasswordBytes+1)); !errors.Is(err, auth.ErrPasswordTooLong) {
+			t.Errorf("expected argon2id to reject %d bytes, got %v", auth.MaxPasswordBytes+1, err)
+		}
+	})
+
+	t.Run("long passwords with older bcrypt hashes", func(t *testing.T) {
+		long := strings.Repeat("a", 72) + "tail"
+		// bcrypt used to hash only the first 72 bytes of long passwords.
+		legacy, err := bcrypt.GenerateFromPassword([]byte(long[:72]), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range []*auth.PasswordHasher{argon, bcryptHasher} {
+			if err := h.Check(long, string(legacy)); err != nil {
+				t.Fatalf("%s hasher: expected the long password to still log in, got %v", h.Algorithm, err)
+			}
+			rehashed, ok, err := h.Rehash(long, string(legacy))
+			if err != nil || !ok || !strings.HasPrefix(rehashed, "$argon2id$") {
+				t.Fatalf("%s hasher: expected a rehash to argon2id, got %q, %v, %v", h.Algorithm, rehashed, ok, err)
+			}
+			if err := h.Check(long[:72], rehashed); err == nil {
+				t.Errorf("%s hasher: expected the new hash to cover the whole password", h.Algorithm)
+			}
+			if _, ok, _ := h.Rehash(long, rehashed); ok {
+				t.Errorf("%s hasher: expected the argon2id hash to stay", h.Algorithm)
+			}
+		}
+		if _, ok, _ := argon.Rehash("mySecret123", argonHash); ok {
+			t.Error("expected a current hash to stay")
+		}
+	})
+
+	t.Run("unknown hash format", func(t *testing.T) {
+		if err := argon.Check("mySecret123", "unset"); !errors.Is(err, auth.ErrUnknownHashFormat) {
+			t.Errorf("expected ErrUnknownHashFormat, got %v", err)
+		}
+	})
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8.
+	dir := t.TempDir()
+	corpus := "0018A45C4D1DEF81644B54AB7F969B88D65:1\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\n"
+	if err := os.WriteFile(filepath.Join(dir, "5BAA6"), []byte(corpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy := auth.DefaultPasswordPolicy()
+	policy.Breached = auth.BreachedPasswordDir{Dir: dir}
+
+	tests := []struct {
+		name     string
+		password string
+		email    string
+		want     []string
+	}{
+		{"strong password", "correct-Horse-battery-staple", "me@example.com", nil},
+		{"too short", "aB3$x", "me@example.com", []string{auth.RuleMinLength}},
+		{"low entropy", "aaaaaaaaaaaa", "me@example.com", []string{auth.RuleMinEntropy}},
+		{"email as password", "Walter.White@example.com", "walter.white@example.com", []string{auth.RuleNotEmail}},
+		{"email local part as password", "walter.white", "walter.white@example.com", []string{auth.RuleNotEmail}},
+		{"breached", "password", "me@example.com", []string{auth.RuleBreached}},
+		{"several rules", "1111", "me@example.com", []string{auth.RuleMinLength, auth.RuleMinEntropy}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := policy.Validate(tt.password, tt.email)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, v := range violations {
+				got = append(got, v.Rule)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected violations %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("missing prefix file means not breached", func(t *testing.T) {
+		breached, err := auth.BreachedPasswordDir{Dir: dir}.Contains("correct-Horse-battery-staple")
+		if err != nil || breached {
+			t.Errorf("expected not breached, got %v, %v", breached, err)
+		}
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	key, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.IsAPIKey(key) {
+		t.Errorf("expected %q to be recognised as an API key", key)
+	}
+	if auth.HashAPIKey(key) != hash {
+		t.Error("expected hash to be reproducible from the key")
+	}
+	jwt, _ := auth.MakeJWT(uuid.New(), "mySecret123", time.Minute)
+	if auth.IsAPIKey(jwt) {
+		t.Error("expected a JWT not to be recognised as an API key")
+	}
+
+	if err := auth.ValidateScopes([]string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite}); err != nil {
+		t.Errorf("expected valid scopes, got %v", err)
+	}
+	if err := auth.ValidateScopes([]string{"admin"}); err == nil {
+		t.Error("expected unknown scope to be rejected")
+	}
+	if err := auth.ValidateScopes(nil); err == nil {
+		t.Error("expected empty scopes to be rejected")
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	userID, clientID := uuid.New(), uuid.New()
+	token, err := auth.MakeOAuthAccessToken(userID, auth.RoleUser, clientID, []string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite}, "mySecret123", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auth.ValidateJWTWithOptions(token, "mySecret123", auth.DefaultValidatorOptions())
+	if err != nil {
+		t.Fatalf("expected token to validate: %v", err)
+	}
+	if !claims.IsThirdParty() || claims.ClientID != clientID.String() || claims.ID == "" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if got := claims.Scopes(); len(got) != 2 || got[0] != auth.ScopeChirpsRead || got[1] != auth.ScopeChirpsWrite {
+		t.Errorf("unexpected scopes %v", got)
+	}
+
+	session, _ := auth.MakeJWT(userID, "mySecret123", time.Minute)
+	claims, _ = auth.ValidateJWTWithOptions(session, "mySecret123", auth.DefaultValidatorOptions())
+	if claims.IsThirdParty() {
+		t.Error("expected a login token not to be third-party")
+	}
+
+	secret, hash, err := auth.GenerateOAuthSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.CheckOAuthSecret(secret, hash) || auth.CheckOAuthSecret(secret+"x", hash) {
+		t.Error("expected only the generated secret to match its hash")
+	}
+
+	// Verifier and challenge from RFC 7636 appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{"matching verifier", verifier, challenge, true},
+		{"wrong verifier", verifier[:42] + "Y", challenge, false},
+		{"verifier too short", "short", auth.HashOAuthSecret("short"), false},
+		{"empty challenge", verifier, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := auth.VerifyPKCE(tt.verifier, tt.challenge); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWebhookVerifier(t *testing.T) {
+	body := []byte(`{"id":"evt_1","event":"user.upgraded"}`)
+	v := auth.NewWebhookVerifier("new-key, old-key", auth.DefaultWebhookTolerance)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		wantErr   error
+	}{
+		{"current key", now, auth.SignWebhook("new-key", now, body), nil},
+		{"key being rotated out", now, auth.SignWebhook("old-key", now, body), nil},
+		{"one of several signatures", now, "v1=deadbeef, " + auth.SignWebhook("new-key", now, body), nil},
+		{"unknown key", now, auth.SignWebhook("other-key", now, body), auth.ErrWebhookSignatureInvalid},
+		{"replayed old webhook", stale, auth.SignWebhook("new-key", stale, body), auth.ErrWebhookTimestamp},
+		{"timestamp swapped", now, auth.SignWebhook("new-key", stale, body), auth.ErrWebhookSignatureInvalid},
+		{"unsigned", "", "", auth.ErrWebhookUnsigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.timestamp != "" {
+				h.Set(auth.WebhookTimestampHeader, tt.timestamp)
+			}
+			if tt.signature != "" {
+				h.Set(auth.WebhookSignatureHeader, tt.signature)
+			}
+			if err := v.Verify(h, body); !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	h := http.Header{}
+	h.Set(auth.WebhookTimestampHeader, now)
+	h.Set(auth.WebhookSignatureHeader, auth.SignWebhook("new-key", now, body))
+	if err := v.Verify(h, append(body, ' ')); !errors.Is(err, auth.ErrWebhookSignatureInvalid) {
+		t.Errorf("expected a modified body to be rejected, got %v", err)
+	}
+}
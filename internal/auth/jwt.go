@@ -12,13 +12,91 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	TokenIssuer   = "chirpy"
+	TokenAudience = "chirpy-api"
+)
+
+type TokenType string
+
+const (
+	TokenTypeAccess       TokenType = "access"
+	TokenTypeMFAChallenge TokenType = "mfa_challenge"
+)
+
+var (
+	ErrInvalidTokenType = errors.New("token has invalid token_type")
+	ErrTokenTooOld      = errors.New("token exceeds max age")
+)
+
+// Claims are the claims carried by every token chirpy signs.
+type Claims struct {
+	TokenType TokenType `json:"token_type"`
+	Role      Role      `json:"role,omitempty"`
+	// ClientID and Scope are only set on tokens issued to third-party
+	// OAuth clients, which are limited to the space-separated scopes.
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// ValidatorOptions describes what a token has to look like to be accepted.
+// Empty fields are not checked.
+type ValidatorOptions struct {
+	Issuer    string
+	Audience  string
+	Leeway    time.Duration
+	TokenType TokenType
+	MaxAge    time.Duration
+}
+
+// DefaultValidatorOptions accepts access tokens issued by MakeJWT, with no
+// clock-skew leeway.
+func DefaultValidatorOptions() ValidatorOptions {
+	return ValidatorOptions{
+		Issuer:    TokenIssuer,
+		Audience:  TokenAudience,
+		TokenType: TokenTypeAccess,
+		MaxAge:    24 * time.Hour,
+	}
+}
+
 func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	claims := &jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		Subject:   userID.String(),
+	return MakeAccessToken(userID, RoleUser, tokenSecret, expiresIn)
+}
+
+// MakeAccessToken signs an access token carrying the user's role.
+func MakeAccessToken(userID uuid.UUID, role Role, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return makeToken(userID, TokenTypeAccess, role, tokenSecret, expiresIn)
+}
+
+// MakeMFAChallengeToken signs the token handed out after a correct password
+// for a user with two-factor authentication. It is only good for
+// exchanging, together with a code, for an access token.
+func MakeMFAChallengeToken(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return makeToken(userID, TokenTypeMFAChallenge, "", tokenSecret, expiresIn)
+}
+
+func makeToken(userID uuid.UUID, tokenType TokenType, role Role, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return signClaims(newClaims(userID, tokenType, role, expiresIn), tokenSecret)
+}
+
+func newClaims(userID uuid.UUID, tokenType TokenType, role Role, expiresIn time.Duration) *Claims {
+	now := time.Now()
+	return &Claims{
+		TokenType: tokenType,
+		Role:      role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Issuer:    TokenIssuer,
+			Audience:  jwt.ClaimStrings{TokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			Subject:   userID.String(),
+		},
 	}
+}
+
+func signClaims(claims *Claims, tokenSecret string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	ss, err := token.SignedString([]byte(tokenSecret))
@@ -42,21 +120,57 @@ func MakeRefreshToken() (string, error) {
 }
 
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(tokenSecret), nil
-	})
+	claims, err := ValidateJWTWithOptions(tokenString, tokenSecret, DefaultValidatorOptions())
 	if err != nil {
 		return uuid.UUID{}, err
 	}
-	userID, err := token.Claims.GetSubject()
-	if err != nil {
-		return uuid.UUID{}, err
+	return claims.UserID()
+}
+
+// ValidateJWTWithOptions checks the signature, expiry and every claim
+// required by opts, returning the parsed claims.
+func ValidateJWTWithOptions(tokenString, tokenSecret string, opts ValidatorOptions) (*Claims, error) {
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
 	}
-	parsedID, err := uuid.Parse(userID)
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(tokenSecret), nil
+	}, parserOpts...)
 	if err != nil {
-		return uuid.UUID{}, err
+		return nil, err
+	}
+
+	if opts.TokenType != "" && claims.TokenType != opts.TokenType {
+		return nil, ErrInvalidTokenType
+	}
+	if opts.MaxAge > 0 {
+		if claims.IssuedAt == nil {
+			return nil, jwt.ErrTokenRequiredClaimMissing
+		}
+		if time.Since(claims.IssuedAt.Time) > opts.MaxAge+opts.Leeway {
+			return nil, ErrTokenTooOld
+		}
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, err
 	}
-	return parsedID, nil
+	return claims, nil
+}
+
+// UserID parses the subject claim.
+func (c *Claims) UserID() (uuid.UUID, error) {
+	return uuid.Parse(c.Subject)
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
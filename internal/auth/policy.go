@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy rule names, reported back to clients.
+const (
+	RuleMinLength  = "min_length"
+	RuleMaxLength  = "max_length"
+	RuleMinEntropy = "min_entropy"
+	RuleNotEmail   = "not_email"
+	RuleBreached   = "breached"
+)
+
+type PolicyViolation struct {
+	Rule    string
+	Message string
+}
+
+// BreachedPasswords reports whether a password appears in a corpus of
+// leaked passwords.
+type BreachedPasswords interface {
+	Contains(password string) (bool, error)
+}
+
+type PasswordPolicy struct {
+	MinLength int
+	// MinEntropyBits is checked against EstimateEntropy; 0 disables it.
+	MinEntropyBits float64
+	DisallowEmail  bool
+	// Breached is optional.
+	Breached BreachedPasswords
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:      8,
+		MinEntropyBits: 30,
+		DisallowEmail:  true,
+	}
+}
+
+// Validate returns every rule password breaks. An error is only returned
+// if the breached password corpus couldn't be read.
+func (p PasswordPolicy) Validate(password, email string) ([]PolicyViolation, error) {
+	var violations []PolicyViolation
+
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("must be at least %d characters", p.MinLength),
+		})
+	}
+	if len(password) > MaxPasswordBytes {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleMaxLength,
+			Message: fmt.Sprintf("must be at most %d bytes", MaxPasswordBytes),
+		})
+	}
+	if p.MinEntropyBits > 0 && EstimateEntropy(password) < p.MinEntropyBits {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleMinEntropy,
+			Message: "is too easy to guess; use a longer or more varied password",
+		})
+	}
+	if p.DisallowEmail && matchesEmail(password, email) {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleNotEmail,
+			Message: "must not be your email address",
+		})
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations, PolicyViolation{
+				Rule:    RuleBreached,
+				Message: "has appeared in a data breach",
+			})
+		}
+	}
+	return violations, nil
+}
+
+// EstimateEntropy is a rough strength estimate in bits: the number of
+// distinct characters times the bits per character of the character
+// classes used. Repeating a character adds nothing.
+func EstimateEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	distinct := map[rune]struct{}{}
+	for _, r := range password {
+		distinct[r] = struct{}{}
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLower(r):
+			lower = true
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			upper = true
+		case r < unicode.MaxASCII && unicode.IsDigit(r):
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			pool += c.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(len(distinct)) * math.Log2(float64(pool))
+}
+
+func matchesEmail(password, email string) bool {
+	if email == "" {
+		return false
+	}
+	password = strings.ToLower(password)
+	email = strings.ToLower(email)
+	if password == email {
+		return true
+	}
+	local, _, found := strings.Cut(email, "@")
+	return found && password == local
+}
+
+// BreachedPasswordDir is a local corpus laid out like the Have I Been Pwned
+// range API: one file per five-character uppercase SHA-1 prefix, holding
+// "SUFFIX:COUNT" lines. Only the file for a password's prefix is read.
+type BreachedPasswordDir struct {
+	Dir string
+}
+
+func (d BreachedPasswordDir) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(d.Dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -1,23 +1,88 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func GetPolkaApiKey(headers http.Header) (string, error) {
-	authHeader := headers.Get("Authorization")
+// Headers Polka signs its webhooks with. The signature header holds one or
+// more comma-separated "v1=<hex>" entries, one per active signing key.
+const (
+	WebhookTimestampHeader = "Polka-Timestamp"
+	WebhookSignatureHeader = "Polka-Signature"
+)
+
+// DefaultWebhookTolerance is how far a webhook's timestamp may be from now.
+const DefaultWebhookTolerance = 5 * time.Minute
+
+var (
+	ErrWebhookUnsigned         = errors.New("webhook has no signature or timestamp")
+	ErrWebhookTimestamp        = errors.New("webhook timestamp outside the tolerance window")
+	ErrWebhookSignatureInvalid = errors.New("webhook signature doesn't match any key")
+)
 
-	if authHeader == "" {
-		return "", errors.New("empty authorization header")
+// WebhookVerifier checks HMAC-SHA256 signatures over "<timestamp>.<body>".
+// Several keys may be active at once so they can be rotated without
+// dropping webhooks.
+type WebhookVerifier struct {
+	Keys      []string
+	Tolerance time.Duration
+	now       func() time.Time
+}
+
+// NewWebhookVerifier returns a verifier for the comma-separated keys.
+func NewWebhookVerifier(keys string, tolerance time.Duration) WebhookVerifier {
+	v := WebhookVerifier{Tolerance: tolerance, now: time.Now}
+	for _, k := range strings.Split(keys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			v.Keys = append(v.Keys, k)
+		}
 	}
+	return v
+}
 
-	const prefix = "ApiKey "
-	if !strings.HasPrefix(authHeader, prefix) {
-		return "", errors.New("empty authorization header")
+// Verify checks the signature headers against the raw request body.
+func (v WebhookVerifier) Verify(headers http.Header, body []byte) error {
+	ts, sigs := headers.Get(WebhookTimestampHeader), headers.Get(WebhookSignatureHeader)
+	if ts == "" || sigs == "" {
+		return ErrWebhookUnsigned
 	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp: %w", err)
+	}
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+	if d := now().Sub(time.Unix(unix, 0)).Abs(); d > v.Tolerance {
+		return ErrWebhookTimestamp
+	}
+
+	for _, key := range v.Keys {
+		want := SignWebhook(key, ts, body)
+		for _, sig := range strings.Split(sigs, ",") {
+			if hmac.Equal([]byte(strings.TrimSpace(sig)), []byte(want)) {
+				return nil
+			}
+		}
+	}
+	return ErrWebhookSignatureInvalid
+}
 
-	key := authHeader[len(prefix):]
-	return key, nil
+// SignWebhook returns the signature header entry for body sent at
+// timestamp, as Polka computes it.
+func SignWebhook(key, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
 }
@@ -1,15 +1,249 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+// MaxPasswordBytes bounds the work a single login can cause. bcrypt has a
+// lower limit of its own, see bcryptMaxPasswordBytes, which only applies
+// to new hashes.
+const (
+	MaxPasswordBytes       = 1024
+	bcryptMaxPasswordBytes = 72
+)
+
+var (
+	ErrPasswordTooLong   = errors.New("password is too long")
+	ErrUnknownHashFormat = errors.New("unknown password hash format")
+	ErrPasswordMismatch  = errors.New("password does not match")
+)
+
+type Argon2Params struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// PasswordHasher creates hashes with one algorithm but checks hashes made
+// by any supported one, so the algorithm and its cost can be changed
+// without invalidating stored passwords.
+//
+// Hashes are self-describing: bcrypt's own $2a$ format, and the PHC string
+// format for argon2id ($argon2id$v=19$m=...,t=...,p=...$salt$key).
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+// DefaultArgon2Params follows the OWASP password storage recommendation.
+var DefaultArgon2Params = Argon2Params{
+	Memory:  19 * 1024,
+	Time:    2,
+	Threads: 1,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+func NewPasswordHasher(algorithm string, bcryptCost int) (*PasswordHasher, error) {
+	switch algorithm {
+	case AlgorithmArgon2id, AlgorithmBcrypt:
+	default:
+		return nil, fmt.Errorf("unsupported password hash algorithm %q", algorithm)
+	}
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost %d outside [%d, %d]", bcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return &PasswordHasher{
+		Algorithm:  algorithm,
+		BcryptCost: bcryptCost,
+		Argon2:     DefaultArgon2Params,
+	}, nil
+}
+
+var defaultHasher = &PasswordHasher{
+	Algorithm:  AlgorithmArgon2id,
+	BcryptCost: bcrypt.DefaultCost,
+	Argon2:     DefaultArgon2Params,
+}
 
 func HashPassword(password string) (string, error) {
-	hpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return defaultHasher.Hash(password)
+}
+
+func CheckPasswordHash(password, hash string) error {
+	return defaultHasher.Check(password, hash)
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if len(password) > MaxPasswordBytes {
+		return "", ErrPasswordTooLong
+	}
+	switch h.Algorithm {
+	case AlgorithmBcrypt:
+		if len(password) > bcryptMaxPasswordBytes {
+			return "", ErrPasswordTooLong
+		}
+		hpw, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hpw), nil
+	case AlgorithmArgon2id:
+		p := h.Argon2
+		salt := make([]byte, p.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.Memory, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	default:
+		return "", fmt.Errorf("unsupported password hash algorithm %q", h.Algorithm)
+	}
+}
+
+// Check returns nil if password matches hash, whatever supported algorithm
+// hash was made with.
+func (h *PasswordHasher) Check(password, hash string) error {
+	if isBcryptHash(hash) {
+		// Older bcrypt hashes of long passwords were made from the first
+		// 72 bytes, so compare just those. Rehash moves them to argon2id.
+		if len(password) > bcryptMaxPasswordBytes {
+			password = password[:bcryptMaxPasswordBytes]
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+	if len(password) > MaxPasswordBytes {
+		return ErrPasswordTooLong
+	}
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return err
+		}
+		got := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	default:
+		return ErrUnknownHashFormat
+	}
+}
+
+// NeedsRehash reports whether hash was made with a different algorithm or
+// different parameters than h would use now.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	switch h.Algorithm {
+	case AlgorithmBcrypt:
+		if !isBcryptHash(hash) {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BcryptCost
+	case AlgorithmArgon2id:
+		p, _, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return true
+		}
+		return p.Memory != h.Argon2.Memory ||
+			p.Time != h.Argon2.Time ||
+			p.Threads != h.Argon2.Threads ||
+			uint32(len(key)) != h.Argon2.KeyLen
+	default:
+		return false
+	}
+}
+
+// Rehash returns a replacement for hash, which password has just matched,
+// when h would hash it differently now or when bcrypt only covered part of
+// it. Passwords too long for bcrypt go to argon2id whatever h.Algorithm
+// is. ok is false when hash should stay.
+func (h *PasswordHasher) Rehash(password, hash string) (newHash string, ok bool, err error) {
+	tooLongForBcrypt := len(password) > bcryptMaxPasswordBytes
+	switch {
+	case tooLongForBcrypt && isBcryptHash(hash):
+	case tooLongForBcrypt && h.Algorithm == AlgorithmBcrypt:
+		// argon2id is as good as this password's hash gets.
+		return "", false, nil
+	case !h.NeedsRehash(hash):
+		return "", false, nil
+	}
+	hasher := h
+	if tooLongForBcrypt && h.Algorithm == AlgorithmBcrypt {
+		hasher = &PasswordHasher{Algorithm: AlgorithmArgon2id, Argon2: h.Argon2}
+	}
+	newHash, err = hasher.Hash(password)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
-	return string(hpw), nil
+	return newHash, true, nil
 }
 
-func CheckPasswordHash(password, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+// CheckDummy does the same work as Check against a hash no password
+// matches, so a login for an unknown email takes as long as one with a
+// wrong password. It always returns an error.
+func (h *PasswordHasher) CheckDummy(password string) error {
+	h.dummyOnce.Do(func() {
+		h.dummyHash, _ = h.Hash("chirpy-dummy-password")
+	})
+	if err := h.Check(password, h.dummyHash); err != nil {
+		return err
+	}
+	return errors.New("dummy password hash matched")
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func parseArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	var p Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
 }
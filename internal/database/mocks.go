@@ -2,6 +2,9 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,17 +13,180 @@ import (
 // DBInterface defines just the methods we need in our handlers.
 // *database.Queries already implements these, so no changes needed there.
 type DBInterface interface {
+	InTx(ctx context.Context, fn func(q DBInterface) error) error
 	CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp, error)
 	GetAllChirps(ctx context.Context) ([]Chirp, error)
+	GetAllChirpsFromAuthor(ctx context.Context, userID uuid.UUID) ([]Chirp, error)
 	GetChirpById(ctx context.Context, id uuid.UUID) (Chirp, error)
+	DeleteChirpById(ctx context.Context, id uuid.UUID) error
+	UpdateChirpBody(ctx context.Context, arg UpdateChirpBodyParams) (Chirp, error)
+	HideChirp(ctx context.Context, id uuid.UUID) (Chirp, error)
 	CreateUser(ctx context.Context, arg CreateUserParams) (User, error)
 	GetUserByEmail(ctx context.Context, email string) (User, error)
+	GetUserByID(ctx context.Context, id uuid.UUID) (User, error)
+	UpdateUser(ctx context.Context, arg UpdateUserParams) (User, error)
+	UpdateUserRole(ctx context.Context, arg UpdateUserRoleParams) (User, error)
+	UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error
+	SuspendUser(ctx context.Context, arg SuspendUserParams) (int64, error)
+	UnsuspendUser(ctx context.Context, id uuid.UUID) (int64, error)
+	SyncUserChirpyRed(ctx context.Context, id uuid.UUID) error
+	SetUserTOTPSecret(ctx context.Context, arg SetUserTOTPSecretParams) error
+	EnableUserTOTP(ctx context.Context, id uuid.UUID) error
+	DisableUserTOTP(ctx context.Context, id uuid.UUID) error
+	UseUserTOTPStep(ctx context.Context, arg UseUserTOTPStepParams) (int64, error)
+	CreateRecoveryCode(ctx context.Context, arg CreateRecoveryCodeParams) error
+	UseRecoveryCode(ctx context.Context, arg UseRecoveryCodeParams) (int64, error)
+	DeleteRecoveryCodes(ctx context.Context, userID uuid.UUID) error
+	CreateUserIdentity(ctx context.Context, arg CreateUserIdentityParams) (UserIdentity, error)
+	GetUserIdentity(ctx context.Context, arg GetUserIdentityParams) (UserIdentity, error)
+	CreateAPIKey(ctx context.Context, arg CreateAPIKeyParams) (ApiKey, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (ApiKey, error)
+	ListAPIKeysForUser(ctx context.Context, userID uuid.UUID) ([]ApiKey, error)
+	RevokeAPIKey(ctx context.Context, arg RevokeAPIKeyParams) (int64, error)
+	TouchAPIKey(ctx context.Context, id uuid.UUID) error
+	CreateOAuthClient(ctx context.Context, arg CreateOAuthClientParams) (OauthClient, error)
+	GetOAuthClient(ctx context.Context, id uuid.UUID) (OauthClient, error)
+	ListOAuthClientsForOwner(ctx context.Context, ownerID uuid.UUID) ([]OauthClient, error)
+	DeleteOAuthClient(ctx context.Context, arg DeleteOAuthClientParams) (int64, error)
+	CreateAuthorizationCode(ctx context.Context, arg CreateAuthorizationCodeParams) error
+	UseAuthorizationCode(ctx context.Context, codeHash string) (OauthAuthorizationCode, error)
+	RevokeOAuthToken(ctx context.Context, arg RevokeOAuthTokenParams) error
+	IsOAuthTokenRevoked(ctx context.Context, arg IsOAuthTokenRevokedParams) (bool, error)
+	UpsertSubscription(ctx context.Context, arg UpsertSubscriptionParams) (Subscription, error)
+	SetSubscriptionStatus(ctx context.Context, arg SetSubscriptionStatusParams) (int64, error)
+	GetSubscriptionByUser(ctx context.Context, userID uuid.UUID) (Subscription, error)
+	ExpireLapsedSubscriptions(ctx context.Context) ([]uuid.UUID, error)
+	CreateOutboxEvent(ctx context.Context, arg CreateOutboxEventParams) (OutboxEvent, error)
+	ClaimOutboxEvents(ctx context.Context, arg ClaimOutboxEventsParams) ([]OutboxEvent, error)
+	ListOutboxEventsAfter(ctx context.Context, arg ListOutboxEventsAfterParams) ([]OutboxEvent, error)
+	MarkOutboxEventProcessed(ctx context.Context, id uuid.UUID) (int64, error)
+	MarkOutboxEventFailed(ctx context.Context, arg MarkOutboxEventFailedParams) error
+	CreateWebhookEndpoint(ctx context.Context, arg CreateWebhookEndpointParams) (WebhookEndpoint, error)
+	GetWebhookEndpoint(ctx context.Context, id uuid.UUID) (WebhookEndpoint, error)
+	ListWebhookEndpointsForOwner(ctx context.Context, ownerID uuid.UUID) ([]WebhookEndpoint, error)
+	ListWebhookEndpointsForEvent(ctx context.Context, arg ListWebhookEndpointsForEventParams) ([]WebhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, arg DeleteWebhookEndpointParams) (int64, error)
+	CreateWebhookDelivery(ctx context.Context, arg CreateWebhookDeliveryParams) error
+	ListWebhookDeliveries(ctx context.Context, arg ListWebhookDeliveriesParams) ([]WebhookDelivery, error)
+	ClaimDueWebhookDeliveries(ctx context.Context, arg ClaimDueWebhookDeliveriesParams) ([]WebhookDelivery, error)
+	MarkWebhookDeliverySucceeded(ctx context.Context, arg MarkWebhookDeliverySucceededParams) error
+	MarkWebhookDeliveryFailed(ctx context.Context, arg MarkWebhookDeliveryFailedParams) error
+	RecordWebhookEvent(ctx context.Context, arg RecordWebhookEventParams) (int64, error)
+	AddNotification(ctx context.Context, arg AddNotificationParams) error
+	ListNotifications(ctx context.Context, arg ListNotificationsParams) ([]Notification, error)
+	CountUnreadNotifications(ctx context.Context, userID uuid.UUID) (int64, error)
+	MarkNotificationRead(ctx context.Context, arg MarkNotificationReadParams) (int64, error)
+	MarkAllNotificationsRead(ctx context.Context, userID uuid.UUID) (int64, error)
+	CreateConversation(ctx context.Context, createdBy uuid.NullUUID) (Conversation, error)
+	AddConversationMember(ctx context.Context, arg AddConversationMemberParams) error
+	CreateDirectConversation(ctx context.Context, arg CreateDirectConversationParams) (Conversation, error)
+	FindDirectConversation(ctx context.Context, arg FindDirectConversationParams) (Conversation, error)
+	GetConversationForMember(ctx context.Context, arg GetConversationForMemberParams) (Conversation, error)
+	ListConversationMembers(ctx context.Context, conversationID uuid.UUID) ([]ConversationMember, error)
+	ListConversationsForUser(ctx context.Context, userID uuid.UUID) ([]ListConversationsForUserRow, error)
+	TouchConversation(ctx context.Context, id uuid.UUID) error
+	MarkConversationRead(ctx context.Context, arg MarkConversationReadParams) error
+	CreateMessage(ctx context.Context, arg CreateMessageParams) (Message, error)
+	ListMessages(ctx context.Context, arg ListMessagesParams) ([]Message, error)
+	BlockUser(ctx context.Context, arg BlockUserParams) error
+	UnblockUser(ctx context.Context, arg UnblockUserParams) (int64, error)
+	ListBlockedUsers(ctx context.Context, blockerID uuid.UUID) ([]UserBlock, error)
+	IsBlockedBetween(ctx context.Context, arg IsBlockedBetweenParams) (bool, error)
+	ConversationHasBlock(ctx context.Context, arg ConversationHasBlockParams) (bool, error)
+	MuteUser(ctx context.Context, arg MuteUserParams) error
+	UnmuteUser(ctx context.Context, arg UnmuteUserParams) (int64, error)
+	ListMutedUsers(ctx context.Context, muterID uuid.UUID) ([]UserMute, error)
+	CreateKeywordMute(ctx context.Context, arg CreateKeywordMuteParams) (KeywordMute, error)
+	DeleteKeywordMute(ctx context.Context, arg DeleteKeywordMuteParams) (int64, error)
+	ListKeywordMutes(ctx context.Context, userID uuid.UUID) ([]KeywordMute, error)
+	ListHiddenUserIDs(ctx context.Context, viewerID uuid.UUID) ([]uuid.UUID, error)
+	IsUserHidden(ctx context.Context, arg IsUserHiddenParams) (bool, error)
+	CreateReport(ctx context.Context, arg CreateReportParams) (Report, error)
+	GetReport(ctx context.Context, id uuid.UUID) (Report, error)
+	ListReports(ctx context.Context, arg ListReportsParams) ([]Report, error)
+	ClaimReport(ctx context.Context, arg ClaimReportParams) (Report, error)
+	UnclaimReport(ctx context.Context, arg UnclaimReportParams) (Report, error)
+	ResolveReport(ctx context.Context, arg ResolveReportParams) (Report, error)
+	CreateModerationAction(ctx context.Context, arg CreateModerationActionParams) error
+	ListModerationActions(ctx context.Context, arg ListModerationActionsParams) ([]ModerationAction, error)
+	TakeRateLimitToken(ctx context.Context, arg TakeRateLimitTokenParams) (TakeRateLimitTokenRow, error)
+	DeleteIdleRateLimitBuckets(ctx context.Context) (int64, error)
+	ClaimIdempotencyKey(ctx context.Context, arg ClaimIdempotencyKeyParams) (int64, error)
+	GetIdempotencyKey(ctx context.Context, arg GetIdempotencyKeyParams) (IdempotencyKey, error)
+	CompleteIdempotencyKey(ctx context.Context, arg CompleteIdempotencyKeyParams) error
+	DeleteIdempotencyKey(ctx context.Context, arg DeleteIdempotencyKeyParams) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
 	ResetUsers(ctx context.Context) error
+	CreateRefreshToken(ctx context.Context, arg CreateRefreshTokenParams) (RefreshToken, error)
+	GetRefreshToken(ctx context.Context, token string) (RefreshToken, error)
+	RevokeToken(ctx context.Context, token string) error
 }
 
+// MockAPIKey is the only API key MockDB knows, stored as MockAPIKeyHash
+// (its SHA-256).
+const (
+	MockAPIKey     = "chirpy_mock"
+	MockAPIKeyHash = "c4fb020c24fa76843565ffc7e0266eb2b2345cc39a7c33a9e2f8664e3a664674"
+)
+
+// MockOAuthRedirectURI is the redirect URI of every client MockDB returns.
+const MockOAuthRedirectURI = "https://client.example/callback"
+
+// MockBlockedUser is blocked by, or has blocked, every other user.
+var MockBlockedUser = uuid.MustParse("00000000-0000-0000-0000-00000000b10c")
+
+// MockSuspendedUser is suspended indefinitely.
+var MockSuspendedUser = uuid.MustParse("00000000-0000-0000-0000-00000000005d")
+
+// MockClaimedReport is the one report GetReport returns claimed, by
+// MockModerator.
+var (
+	MockClaimedReport = uuid.MustParse("00000000-0000-0000-0000-0000000000c1")
+	MockModerator     = uuid.MustParse("00000000-0000-0000-0000-00000000000d")
+)
+
+// MockWebhookEndpoint is the one webhook endpoint MockDB knows.
+var MockWebhookEndpoint = uuid.MustParse("00000000-0000-0000-0000-0000000000e0")
+
+// MockChirpAuthor writes every chirp GetChirpById returns.
+var MockChirpAuthor = uuid.MustParse("00000000-0000-0000-0000-00000000a070")
+
+// MockUpdatedAt is when GetChirpById's chirps were posted and when they and
+// GetUserByID's users last changed, so their ETags are stable across
+// requests.
+var MockUpdatedAt = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// MockDuplicateWebhookEvent is a webhook event id MockDB has already seen.
+const MockDuplicateWebhookEvent = "evt_duplicate"
+
+// MockUnavailableEmail makes GetUserByEmail fail as if the database were
+// down.
+const MockUnavailableEmail = "unavailable@example.com"
+
+// MockDeletedUser doesn't exist, and GetUserByID for MockUnavailableUser
+// fails as if the database were down.
+var (
+	MockDeletedUser     = uuid.MustParse("00000000-0000-0000-0000-0000000000de")
+	MockUnavailableUser = uuid.MustParse("00000000-0000-0000-0000-0000000000ff")
+)
+
 // MockDB implements DBInterface, returning stubbed data or errors.
 type MockDB struct {
 	// You can store fields here that let you define behavior per test.
+
+	// idempotencyKeys is kept, unlike everything else, so that retries can
+	// be tested.
+	mu              sync.Mutex
+	idempotencyKeys map[string]IdempotencyKey
+	// deletedOAuthClients is kept so tokens can outlive their client.
+	deletedOAuthClients map[uuid.UUID]bool
+	// outbox is kept so the relay can be tested. Leases are ignored.
+	outbox []OutboxEvent
+}
+
+// InTx runs fn against the mock itself; nothing is rolled back.
+func (m *MockDB) InTx(ctx context.Context, fn func(q DBInterface) error) error {
+	return fn(m)
 }
 
 func (m *MockDB) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp, error) {
@@ -51,9 +217,9 @@ func (m *MockDB) GetChirpById(ctx context.Context, id uuid.UUID) (Chirp, error)
 	return Chirp{
 		ID:        id,
 		Body:      "Test chirp",
-		UserID:    uuid.New(),
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		UserID:    MockChirpAuthor,
+		CreatedAt: MockUpdatedAt,
+		UpdatedAt: MockUpdatedAt,
 	}, nil
 }
 
@@ -68,6 +234,9 @@ func (m *MockDB) CreateUser(ctx context.Context, arg CreateUserParams) (User, er
 }
 
 func (m *MockDB) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	if email == MockUnavailableEmail {
+		return User{}, errors.New("connection refused")
+	}
 	return User{
 		ID:             uuid.New(),
 		Email:          email,
@@ -80,3 +249,708 @@ func (m *MockDB) GetUserByEmail(ctx context.Context, email string) (User, error)
 func (m *MockDB) ResetUsers(ctx context.Context) error {
 	return nil
 }
+
+func (m *MockDB) GetAllChirpsFromAuthor(ctx context.Context, userID uuid.UUID) ([]Chirp, error) {
+	return []Chirp{
+		{
+			ID:        uuid.New(),
+			Body:      "Hello World",
+			UserID:    userID,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		},
+	}, nil
+}
+
+func (m *MockDB) DeleteChirpById(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (m *MockDB) UpdateChirpBody(ctx context.Context, arg UpdateChirpBodyParams) (Chirp, error) {
+	return Chirp{
+		ID:        arg.ID,
+		Body:      arg.Body,
+		UserID:    uuid.New(),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func (m *MockDB) GetUserByID(ctx context.Context, id uuid.UUID) (User, error) {
+	switch id {
+	case MockDeletedUser:
+		return User{}, sql.ErrNoRows
+	case MockUnavailableUser:
+		return User{}, errors.New("connection refused")
+	}
+	user := User{
+		ID:             id,
+		Email:          "test@example.com",
+		HashedPassword: "fake_hash",
+		Role:           "user",
+		CreatedAt:      time.Now(),
+		UpdatedAt:      MockUpdatedAt,
+	}
+	if id == MockSuspendedUser {
+		user.SuspendedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	return user, nil
+}
+
+func (m *MockDB) UpdateUser(ctx context.Context, arg UpdateUserParams) (User, error) {
+	return User{
+		ID:             arg.ID,
+		Email:          arg.Email,
+		HashedPassword: arg.HashedPassword,
+		Role:           "user",
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}, nil
+}
+
+func (m *MockDB) UpdateUserRole(ctx context.Context, arg UpdateUserRoleParams) (User, error) {
+	return User{
+		ID:        arg.ID,
+		Email:     "test@example.com",
+		Role:      arg.Role,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func (m *MockDB) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error {
+	return nil
+}
+
+func (m *MockDB) SuspendUser(ctx context.Context, arg SuspendUserParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) UnsuspendUser(ctx context.Context, id uuid.UUID) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) HideChirp(ctx context.Context, id uuid.UUID) (Chirp, error) {
+	chirp, err := m.GetChirpById(ctx, id)
+	chirp.HiddenAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return chirp, err
+}
+
+func (m *MockDB) SyncUserChirpyRed(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (m *MockDB) CreateRefreshToken(ctx context.Context, arg CreateRefreshTokenParams) (RefreshToken, error) {
+	return RefreshToken{
+		Token:     arg.Token,
+		UserID:    arg.UserID,
+		ExpiresAt: arg.ExpiresAt,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func (m *MockDB) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	return RefreshToken{
+		Token:     token,
+		UserID:    uuid.New(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func (m *MockDB) RevokeToken(ctx context.Context, token string) error {
+	return nil
+}
+
+func (m *MockDB) SetUserTOTPSecret(ctx context.Context, arg SetUserTOTPSecretParams) error {
+	return nil
+}
+
+func (m *MockDB) EnableUserTOTP(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (m *MockDB) DisableUserTOTP(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (m *MockDB) UseUserTOTPStep(ctx context.Context, arg UseUserTOTPStepParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) CreateRecoveryCode(ctx context.Context, arg CreateRecoveryCodeParams) error {
+	return nil
+}
+
+func (m *MockDB) UseRecoveryCode(ctx context.Context, arg UseRecoveryCodeParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) DeleteRecoveryCodes(ctx context.Context, userID uuid.UUID) error {
+	return nil
+}
+
+func (m *MockDB) CreateUserIdentity(ctx context.Context, arg CreateUserIdentityParams) (UserIdentity, error) {
+	return UserIdentity{
+		ID:        uuid.New(),
+		UserID:    arg.UserID,
+		Issuer:    arg.Issuer,
+		Subject:   arg.Subject,
+		Email:     arg.Email,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (m *MockDB) GetUserIdentity(ctx context.Context, arg GetUserIdentityParams) (UserIdentity, error) {
+	return UserIdentity{}, sql.ErrNoRows
+}
+
+func (m *MockDB) CreateAPIKey(ctx context.Context, arg CreateAPIKeyParams) (ApiKey, error) {
+	return ApiKey{
+		ID:        uuid.New(),
+		UserID:    arg.UserID,
+		Name:      arg.Name,
+		KeyPrefix: arg.KeyPrefix,
+		KeyHash:   arg.KeyHash,
+		Scopes:    arg.Scopes,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+// GetAPIKeyByHash knows a single read-only key, MockAPIKey.
+func (m *MockDB) GetAPIKeyByHash(ctx context.Context, keyHash string) (ApiKey, error) {
+	if keyHash != MockAPIKeyHash {
+		return ApiKey{}, sql.ErrNoRows
+	}
+	return ApiKey{
+		ID:        uuid.New(),
+		UserID:    uuid.New(),
+		Name:      "mock key",
+		KeyHash:   keyHash,
+		Scopes:    []string{"chirps:read"},
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func (m *MockDB) ListAPIKeysForUser(ctx context.Context, userID uuid.UUID) ([]ApiKey, error) {
+	return []ApiKey{}, nil
+}
+
+func (m *MockDB) RevokeAPIKey(ctx context.Context, arg RevokeAPIKeyParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (m *MockDB) CreateOAuthClient(ctx context.Context, arg CreateOAuthClientParams) (OauthClient, error) {
+	return OauthClient{
+		ID:           uuid.New(),
+		OwnerID:      arg.OwnerID,
+		Name:         arg.Name,
+		RedirectUris: arg.RedirectUris,
+		SecretHash:   arg.SecretHash,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}, nil
+}
+
+// GetOAuthClient returns a public client redirecting to
+// MockOAuthRedirectURI, whatever the id.
+func (m *MockDB) GetOAuthClient(ctx context.Context, id uuid.UUID) (OauthClient, error) {
+	return OauthClient{
+		ID:           id,
+		OwnerID:      uuid.New(),
+		Name:         "mock client",
+		RedirectUris: []string{MockOAuthRedirectURI},
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}, nil
+}
+
+func (m *MockDB) ListOAuthClientsForOwner(ctx context.Context, ownerID uuid.UUID) ([]OauthClient, error) {
+	return []OauthClient{}, nil
+}
+
+func (m *MockDB) DeleteOAuthClient(ctx context.Context, arg DeleteOAuthClientParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deletedOAuthClients == nil {
+		m.deletedOAuthClients = make(map[uuid.UUID]bool)
+	}
+	m.deletedOAuthClients[arg.ID] = true
+	return 1, nil
+}
+
+func (m *MockDB) CreateAuthorizationCode(ctx context.Context, arg CreateAuthorizationCodeParams) error {
+	return nil
+}
+
+func (m *MockDB) UseAuthorizationCode(ctx context.Context, codeHash string) (OauthAuthorizationCode, error) {
+	return OauthAuthorizationCode{}, sql.ErrNoRows
+}
+
+func (m *MockDB) RevokeOAuthToken(ctx context.Context, arg RevokeOAuthTokenParams) error {
+	return nil
+}
+
+// IsOAuthTokenRevoked only revokes tokens of deleted clients.
+func (m *MockDB) IsOAuthTokenRevoked(ctx context.Context, arg IsOAuthTokenRevokedParams) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deletedOAuthClients[arg.ClientID], nil
+}
+
+// RecordWebhookEvent treats MockDuplicateWebhookEvent as already seen.
+func (m *MockDB) RecordWebhookEvent(ctx context.Context, arg RecordWebhookEventParams) (int64, error) {
+	if arg.ID == MockDuplicateWebhookEvent {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func (m *MockDB) UpsertSubscription(ctx context.Context, arg UpsertSubscriptionParams) (Subscription, error) {
+	return Subscription{
+		ID:                 uuid.New(),
+		UserID:             arg.UserID,
+		Status:             arg.Status,
+		CurrentPeriodStart: arg.CurrentPeriodStart,
+		CurrentPeriodEnd:   arg.CurrentPeriodEnd,
+		CreatedAt:          time.Now(),
+		UpdatedAt:          time.Now(),
+	}, nil
+}
+
+func (m *MockDB) SetSubscriptionStatus(ctx context.Context, arg SetSubscriptionStatusParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) GetSubscriptionByUser(ctx context.Context, userID uuid.UUID) (Subscription, error) {
+	return Subscription{}, sql.ErrNoRows
+}
+
+func (m *MockDB) ExpireLapsedSubscriptions(ctx context.Context) ([]uuid.UUID, error) {
+	return []uuid.UUID{}, nil
+}
+
+func (m *MockDB) CreateOutboxEvent(ctx context.Context, arg CreateOutboxEventParams) (OutboxEvent, error) {
+	ev := OutboxEvent{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		EventType: arg.EventType,
+		UserID:    arg.UserID,
+		Payload:   arg.Payload,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outbox = append(m.outbox, ev)
+	return ev, nil
+}
+
+func (m *MockDB) ClaimOutboxEvents(ctx context.Context, arg ClaimOutboxEventsParams) ([]OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claimed := []OutboxEvent{}
+	for _, ev := range m.outbox {
+		if len(claimed) == int(arg.MaxEvents) {
+			break
+		}
+		if !ev.ProcessedAt.Valid && !ev.ParkedAt.Valid {
+			claimed = append(claimed, ev)
+		}
+	}
+	return claimed, nil
+}
+
+func (m *MockDB) MarkOutboxEventProcessed(ctx context.Context, id uuid.UUID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.outbox {
+		if m.outbox[i].ID == id && !m.outbox[i].ProcessedAt.Valid {
+			m.outbox[i].ProcessedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (m *MockDB) MarkOutboxEventFailed(ctx context.Context, arg MarkOutboxEventFailedParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.outbox {
+		if m.outbox[i].ID != arg.ID {
+			continue
+		}
+		m.outbox[i].Attempts++
+		m.outbox[i].LastError = sql.NullString{String: arg.LastError, Valid: true}
+		if m.outbox[i].Attempts >= arg.MaxAttempts {
+			m.outbox[i].ParkedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	return nil
+}
+
+func (m *MockDB) CreateWebhookEndpoint(ctx context.Context, arg CreateWebhookEndpointParams) (WebhookEndpoint, error) {
+	return WebhookEndpoint{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		OwnerID:   arg.OwnerID,
+		Url:       arg.Url,
+		Events:    arg.Events,
+		Secret:    arg.Secret,
+	}, nil
+}
+
+// GetWebhookEndpoint only finds MockWebhookEndpoint, which MockChirpAuthor
+// owns.
+func (m *MockDB) GetWebhookEndpoint(ctx context.Context, id uuid.UUID) (WebhookEndpoint, error) {
+	if id != MockWebhookEndpoint {
+		return WebhookEndpoint{}, sql.ErrNoRows
+	}
+	return WebhookEndpoint{
+		ID:        id,
+		CreatedAt: MockUpdatedAt,
+		UpdatedAt: MockUpdatedAt,
+		OwnerID:   MockChirpAuthor,
+		Url:       "https://hooks.example.com/chirpy",
+		Events:    []string{"chirp.created"},
+		Secret:    "whsec_mock",
+	}, nil
+}
+
+func (m *MockDB) ListWebhookEndpointsForOwner(ctx context.Context, ownerID uuid.UUID) ([]WebhookEndpoint, error) {
+	return []WebhookEndpoint{}, nil
+}
+
+func (m *MockDB) ListWebhookEndpointsForEvent(ctx context.Context, arg ListWebhookEndpointsForEventParams) ([]WebhookEndpoint, error) {
+	return []WebhookEndpoint{}, nil
+}
+
+func (m *MockDB) DeleteWebhookEndpoint(ctx context.Context, arg DeleteWebhookEndpointParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) CreateWebhookDelivery(ctx context.Context, arg CreateWebhookDeliveryParams) error {
+	return nil
+}
+
+func (m *MockDB) ListWebhookDeliveries(ctx context.Context, arg ListWebhookDeliveriesParams) ([]WebhookDelivery, error) {
+	return []WebhookDelivery{}, nil
+}
+
+func (m *MockDB) ClaimDueWebhookDeliveries(ctx context.Context, arg ClaimDueWebhookDeliveriesParams) ([]WebhookDelivery, error) {
+	return []WebhookDelivery{}, nil
+}
+
+func (m *MockDB) MarkWebhookDeliverySucceeded(ctx context.Context, arg MarkWebhookDeliverySucceededParams) error {
+	return nil
+}
+
+func (m *MockDB) MarkWebhookDeliveryFailed(ctx context.Context, arg MarkWebhookDeliveryFailedParams) error {
+	return nil
+}
+
+func (m *MockDB) AddNotification(ctx context.Context, arg AddNotificationParams) error {
+	return nil
+}
+
+func (m *MockDB) ListNotifications(ctx context.Context, arg ListNotificationsParams) ([]Notification, error) {
+	return []Notification{}, nil
+}
+
+func (m *MockDB) CountUnreadNotifications(ctx context.Context, userID uuid.UUID) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockDB) MarkNotificationRead(ctx context.Context, arg MarkNotificationReadParams) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockDB) MarkAllNotificationsRead(ctx context.Context, userID uuid.UUID) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockDB) ListOutboxEventsAfter(ctx context.Context, arg ListOutboxEventsAfterParams) ([]OutboxEvent, error) {
+	return []OutboxEvent{}, nil
+}
+
+func (m *MockDB) CreateConversation(ctx context.Context, createdBy uuid.NullUUID) (Conversation, error) {
+	return Conversation{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		CreatedBy: createdBy,
+	}, nil
+}
+
+func (m *MockDB) AddConversationMember(ctx context.Context, arg AddConversationMemberParams) error {
+	return nil
+}
+
+// CreateDirectConversation finds a conversation already under way with
+// MockChirpAuthor, as FindDirectConversation does.
+func (m *MockDB) CreateDirectConversation(ctx context.Context, arg CreateDirectConversationParams) (Conversation, error) {
+	if arg.OtherID == MockChirpAuthor {
+		return Conversation{}, sql.ErrNoRows
+	}
+	return Conversation{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		CreatedBy: uuid.NullUUID{UUID: arg.CreatedBy, Valid: true},
+	}, nil
+}
+
+func (m *MockDB) FindDirectConversation(ctx context.Context, arg FindDirectConversationParams) (Conversation, error) {
+	if arg.UserA != MockChirpAuthor && arg.UserB != MockChirpAuthor {
+		return Conversation{}, sql.ErrNoRows
+	}
+	return Conversation{
+		ID:        uuid.New(),
+		CreatedAt: MockUpdatedAt,
+		UpdatedAt: MockUpdatedAt,
+		CreatedBy: uuid.NullUUID{UUID: MockChirpAuthor, Valid: true},
+	}, nil
+}
+
+func (m *MockDB) GetConversationForMember(ctx context.Context, arg GetConversationForMemberParams) (Conversation, error) {
+	return Conversation{}, sql.ErrNoRows
+}
+
+func (m *MockDB) ListConversationMembers(ctx context.Context, conversationID uuid.UUID) ([]ConversationMember, error) {
+	return []ConversationMember{}, nil
+}
+
+func (m *MockDB) ListConversationsForUser(ctx context.Context, userID uuid.UUID) ([]ListConversationsForUserRow, error) {
+	return []ListConversationsForUserRow{}, nil
+}
+
+func (m *MockDB) TouchConversation(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (m *MockDB) MarkConversationRead(ctx context.Context, arg MarkConversationReadParams) error {
+	return nil
+}
+
+func (m *MockDB) CreateMessage(ctx context.Context, arg CreateMessageParams) (Message, error) {
+	return Message{
+		ID:             uuid.New(),
+		CreatedAt:      time.Now(),
+		ConversationID: arg.ConversationID,
+		SenderID:       arg.SenderID,
+		Body:           arg.Body,
+	}, nil
+}
+
+func (m *MockDB) ListMessages(ctx context.Context, arg ListMessagesParams) ([]Message, error) {
+	return []Message{}, nil
+}
+
+func (m *MockDB) BlockUser(ctx context.Context, arg BlockUserParams) error {
+	return nil
+}
+
+func (m *MockDB) UnblockUser(ctx context.Context, arg UnblockUserParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) ListBlockedUsers(ctx context.Context, blockerID uuid.UUID) ([]UserBlock, error) {
+	return []UserBlock{}, nil
+}
+
+func (m *MockDB) IsBlockedBetween(ctx context.Context, arg IsBlockedBetweenParams) (bool, error) {
+	return arg.UserB == MockBlockedUser || arg.UserA == MockBlockedUser, nil
+}
+
+func (m *MockDB) ConversationHasBlock(ctx context.Context, arg ConversationHasBlockParams) (bool, error) {
+	return false, nil
+}
+
+func (m *MockDB) MuteUser(ctx context.Context, arg MuteUserParams) error {
+	return nil
+}
+
+func (m *MockDB) UnmuteUser(ctx context.Context, arg UnmuteUserParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) ListMutedUsers(ctx context.Context, muterID uuid.UUID) ([]UserMute, error) {
+	return []UserMute{}, nil
+}
+
+func (m *MockDB) CreateKeywordMute(ctx context.Context, arg CreateKeywordMuteParams) (KeywordMute, error) {
+	return KeywordMute{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		UserID:    arg.UserID,
+		Keyword:   arg.Keyword,
+		ExpiresAt: arg.ExpiresAt,
+	}, nil
+}
+
+func (m *MockDB) DeleteKeywordMute(ctx context.Context, arg DeleteKeywordMuteParams) (int64, error) {
+	return 1, nil
+}
+
+func (m *MockDB) ListKeywordMutes(ctx context.Context, userID uuid.UUID) ([]KeywordMute, error) {
+	return []KeywordMute{}, nil
+}
+
+func (m *MockDB) ListHiddenUserIDs(ctx context.Context, viewerID uuid.UUID) ([]uuid.UUID, error) {
+	return []uuid.UUID{MockBlockedUser}, nil
+}
+
+func (m *MockDB) IsUserHidden(ctx context.Context, arg IsUserHiddenParams) (bool, error) {
+	return arg.OtherID == MockBlockedUser, nil
+}
+
+func (m *MockDB) CreateReport(ctx context.Context, arg CreateReportParams) (Report, error) {
+	return Report{
+		ID:             uuid.New(),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		ReporterID:     arg.ReporterID,
+		ReportedUserID: arg.ReportedUserID,
+		ChirpID:        arg.ChirpID,
+		Reason:         arg.Reason,
+		Details:        arg.Details,
+		Status:         "open",
+	}, nil
+}
+
+// GetReport returns an open report about a chirp for any id but
+// MockClaimedReport, which MockModerator holds.
+func (m *MockDB) GetReport(ctx context.Context, id uuid.UUID) (Report, error) {
+	if id == MockClaimedReport {
+		return Report{
+			ID:             id,
+			CreatedAt:      time.Now(),
+			UpdatedAt:      time.Now(),
+			ReporterID:     uuid.New(),
+			ReportedUserID: uuid.New(),
+			Reason:         "spam",
+			Status:         "claimed",
+			ClaimedBy:      uuid.NullUUID{UUID: MockModerator, Valid: true},
+			ClaimedAt:      sql.NullTime{Time: time.Now(), Valid: true},
+		}, nil
+	}
+	return Report{
+		ID:             id,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		ReporterID:     uuid.New(),
+		ReportedUserID: uuid.New(),
+		ChirpID:        uuid.NullUUID{UUID: uuid.New(), Valid: true},
+		Reason:         "spam",
+		Status:         "open",
+	}, nil
+}
+
+func (m *MockDB) ListReports(ctx context.Context, arg ListReportsParams) ([]Report, error) {
+	return []Report{}, nil
+}
+
+func (m *MockDB) ClaimReport(ctx context.Context, arg ClaimReportParams) (Report, error) {
+	report, _ := m.GetReport(ctx, arg.ID)
+	report.Status = "claimed"
+	report.ClaimedBy = arg.ClaimedBy
+	report.ClaimedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return report, nil
+}
+
+func (m *MockDB) UnclaimReport(ctx context.Context, arg UnclaimReportParams) (Report, error) {
+	report, _ := m.GetReport(ctx, arg.ID)
+	if report.Status != "claimed" || report.ClaimedBy != arg.ClaimedBy {
+		return Report{}, sql.ErrNoRows
+	}
+	report.Status = "open"
+	report.ClaimedBy = uuid.NullUUID{}
+	report.ClaimedAt = sql.NullTime{}
+	return report, nil
+}
+
+func (m *MockDB) ResolveReport(ctx context.Context, arg ResolveReportParams) (Report, error) {
+	report, _ := m.GetReport(ctx, arg.ID)
+	report.Status = "resolved"
+	report.ClaimedBy = arg.ModeratorID
+	report.Resolution = arg.Resolution
+	report.ResolvedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return report, nil
+}
+
+func (m *MockDB) CreateModerationAction(ctx context.Context, arg CreateModerationActionParams) error {
+	return nil
+}
+
+func (m *MockDB) ListModerationActions(ctx context.Context, arg ListModerationActionsParams) ([]ModerationAction, error) {
+	return []ModerationAction{}, nil
+}
+
+// TakeRateLimitToken always finds a full bucket.
+func (m *MockDB) TakeRateLimitToken(ctx context.Context, arg TakeRateLimitTokenParams) (TakeRateLimitTokenRow, error) {
+	return TakeRateLimitTokenRow{Tokens: arg.Capacity - 1, Allowed: true}, nil
+}
+
+func (m *MockDB) DeleteIdleRateLimitBuckets(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockDB) ClaimIdempotencyKey(ctx context.Context, arg ClaimIdempotencyKeyParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := arg.Scope + " " + arg.Key
+	if _, ok := m.idempotencyKeys[id]; ok {
+		return 0, nil
+	}
+	if m.idempotencyKeys == nil {
+		m.idempotencyKeys = map[string]IdempotencyKey{}
+	}
+	m.idempotencyKeys[id] = IdempotencyKey{
+		Scope:       arg.Scope,
+		Key:         arg.Key,
+		Fingerprint: arg.Fingerprint,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   arg.ExpiresAt,
+	}
+	return 1, nil
+}
+
+func (m *MockDB) GetIdempotencyKey(ctx context.Context, arg GetIdempotencyKeyParams) (IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.idempotencyKeys[arg.Scope+" "+arg.Key]
+	if !ok {
+		return IdempotencyKey{}, sql.ErrNoRows
+	}
+	return k, nil
+}
+
+func (m *MockDB) CompleteIdempotencyKey(ctx context.Context, arg CompleteIdempotencyKeyParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := arg.Scope + " " + arg.Key
+	k := m.idempotencyKeys[id]
+	k.StatusCode = arg.StatusCode
+	k.ResponseBody = arg.ResponseBody
+	k.ResponseHeaders = arg.ResponseHeaders
+	m.idempotencyKeys[id] = k
+	return nil
+}
+
+func (m *MockDB) DeleteIdempotencyKey(ctx context.Context, arg DeleteIdempotencyKeyParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.idempotencyKeys, arg.Scope+" "+arg.Key)
+	return nil
+}
+
+func (m *MockDB) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Store is the Queries handlers use, plus transactions.
+type Store struct {
+	*Queries
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{Queries: New(db), db: db}
+}
+
+// InTx runs fn with queries bound to one transaction, committing if fn
+// returns nil and rolling back otherwise. Calling InTx again from inside fn
+// joins the outer transaction.
+func (s *Store) InTx(ctx context.Context, fn func(q DBInterface) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(&Store{Queries: s.WithTx(tx)}); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// IsUniqueViolation reports whether err is Postgres refusing a duplicate
+// value in a unique column.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,122 @@
+// Package entitlements describes what each plan lets a user do. Plans are
+// configuration, so what Chirpy Red unlocks can change without a release.
+package entitlements
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+type Plan string
+
+const (
+	PlanFree Plan = "free"
+	PlanRed  Plan = "red"
+)
+
+// Entitlements are the limits and extras of one plan.
+type Entitlements struct {
+	MaxChirpLength int `json:"max_chirp_length"`
+	// EditWindow is how long after posting a chirp can still be edited.
+	// Zero means chirps can't be edited.
+	EditWindow Duration `json:"edit_window"`
+	// Badges are shown on the user's profile.
+	Badges []string `json:"badges"`
+	// RateLimits replace the server's rate limits, by policy name such as
+	// "chirps", for the plan's users.
+	RateLimits map[string]RateLimit `json:"rate_limits,omitempty"`
+}
+
+// RateLimit allows Limit requests per Period.
+type RateLimit struct {
+	Limit  int      `json:"limit"`
+	Period Duration `json:"period"`
+}
+
+// Checker tells handlers what a plan is entitled to.
+type Checker interface {
+	For(plan Plan) Entitlements
+}
+
+// Config maps each plan to its entitlements. Plans it doesn't list get the
+// free plan's.
+type Config map[Plan]Entitlements
+
+func (c Config) For(plan Plan) Entitlements {
+	if e, ok := c[plan]; ok {
+		return e
+	}
+	return c[PlanFree]
+}
+
+// Default is what the plans offer when no configuration is given.
+func Default() Config {
+	return Config{
+		PlanFree: {
+			MaxChirpLength: 140,
+		},
+		PlanRed: {
+			MaxChirpLength: 280,
+			EditWindow:     Duration{15 * time.Minute},
+			Badges:         []string{"chirpy_red"},
+			RateLimits: map[string]RateLimit{
+				"chirps": {Limit: 120, Period: Duration{time.Minute}},
+			},
+		},
+	}
+}
+
+// Load reads plans from a JSON file shaped like Config. Plans missing
+// from the file keep their defaults.
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file Config
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	cfg := Default()
+	for plan, e := range file {
+		if e.MaxChirpLength <= 0 {
+			return nil, fmt.Errorf("plan %q: max_chirp_length must be positive", plan)
+		}
+		if e.EditWindow.Duration < 0 {
+			return nil, fmt.Errorf("plan %q: edit_window can't be negative", plan)
+		}
+		for name, rl := range e.RateLimits {
+			if rl.Limit <= 0 || rl.Period.Duration <= 0 {
+				return nil, fmt.Errorf("plan %q: rate limit %q needs a positive limit and period", plan, name)
+			}
+		}
+		cfg[plan] = e
+	}
+	return cfg, nil
+}
+
+// Duration is a time.Duration written as a string such as "15m" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string such as \"15m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
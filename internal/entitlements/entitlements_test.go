@@ -0,0 +1,70 @@
+package entitlements_test
+
+import (
+	"chirpy/internal/entitlements"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		wantErr  bool
+		wantFree int
+		wantRed  int
+		wantEdit time.Duration
+	}{
+		{
+			name:     "overrides red only",
+			file:     `{"red": {"max_chirp_length": 500, "edit_window": "1h", "badges": ["red"]}}`,
+			wantFree: 140,
+			wantRed:  500,
+			wantEdit: time.Hour,
+		},
+		{
+			name:     "overrides both",
+			file:     `{"free": {"max_chirp_length": 100}, "red": {"max_chirp_length": 200}}`,
+			wantFree: 100,
+			wantRed:  200,
+		},
+		{name: "zero length", file: `{"free": {"max_chirp_length": 0}}`, wantErr: true},
+		{name: "bad duration", file: `{"red": {"max_chirp_length": 1, "edit_window": 60}}`, wantErr: true},
+		{name: "not json", file: `max_chirp_length = 1`, wantErr: true},
+		{name: "zero rate limit", file: `{"red": {"max_chirp_length": 1, "rate_limits": {"chirps": {"limit": 0, "period": "1m"}}}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "entitlements.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := entitlements.Load(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected config to load: %v", err)
+			}
+			if got := cfg.For(entitlements.PlanFree).MaxChirpLength; got != tt.wantFree {
+				t.Errorf("expected free length %d, got %d", tt.wantFree, got)
+			}
+			red := cfg.For(entitlements.PlanRed)
+			if red.MaxChirpLength != tt.wantRed || red.EditWindow.Duration != tt.wantEdit {
+				t.Errorf("unexpected red entitlements %+v", red)
+			}
+		})
+	}
+}
+
+func TestUnknownPlanGetsFree(t *testing.T) {
+	cfg := entitlements.Default()
+	if got := cfg.For("platinum"); got.MaxChirpLength != cfg.For(entitlements.PlanFree).MaxChirpLength {
+		t.Errorf("expected unknown plan to fall back to free, got %+v", got)
+	}
+}
@@ -0,0 +1,152 @@
+// Package events defines chirpy's domain events and an in-process bus that
+// features subscribe to instead of being called from handlers.
+//
+// Events are written to the outbox in the same transaction as the change
+// they describe and published once it has committed. Publishing is
+// at-least-once: a handler may see the same event again if another
+// handler failed, so handlers must be idempotent.
+package events
+
+import (
+	"chirpy/internal/database"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Type string
+
+const (
+	ChirpCreated   Type = "chirp.created"
+	ChirpUpdated   Type = "chirp.updated"
+	ChirpDeleted   Type = "chirp.deleted"
+	UserUpgraded   Type = "user.upgraded"
+	UserDowngraded Type = "user.downgraded"
+)
+
+// All lists every event type.
+var All = []Type{ChirpCreated, ChirpUpdated, ChirpDeleted, UserUpgraded, UserDowngraded}
+
+// Event is something that happened to, or was done by, UserID.
+type Event struct {
+	ID        uuid.UUID
+	Type      Type
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	Payload   json.RawMessage
+}
+
+// FromOutbox converts a stored outbox row.
+func FromOutbox(row database.OutboxEvent) Event {
+	return Event{
+		ID:        row.ID,
+		Type:      Type(row.EventType),
+		UserID:    row.UserID,
+		CreatedAt: row.CreatedAt,
+		Payload:   row.Payload,
+	}
+}
+
+// Decode unmarshals the payload into v, one of the payload types below.
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Chirp is the payload of the chirp events.
+type Chirp struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Body      string    `json:"body"`
+	UserID    uuid.UUID `json:"user_id"`
+}
+
+func ChirpFromDB(c database.Chirp) Chirp {
+	return Chirp{
+		ID:        c.ID,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		Body:      c.Body,
+		UserID:    c.UserID,
+	}
+}
+
+// User is the payload of the user events.
+type User struct {
+	ID          uuid.UUID `json:"id"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+}
+
+// Record writes an event about userID to the outbox. Call it with the
+// queries of the transaction that made the change, so the event exists if
+// and only if the change does.
+func Record(ctx context.Context, q database.DBInterface, t Type, userID uuid.UUID, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = q.CreateOutboxEvent(ctx, database.CreateOutboxEventParams{
+		EventType: string(t),
+		UserID:    userID,
+		Payload:   data,
+	})
+	return err
+}
+
+// Handler reacts to a published event.
+type Handler func(ctx context.Context, ev Event) error
+
+type subscription struct {
+	name    string
+	types   map[Type]bool
+	handler Handler
+}
+
+// Bus dispatches published events to the handlers subscribed to them.
+type Bus struct {
+	mu   sync.RWMutex
+	subs []subscription
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers handler for the given event types, or every type if
+// none are given. name identifies the handler in errors.
+func (b *Bus) Subscribe(name string, handler Handler, types ...Type) {
+	sub := subscription{name: name, handler: handler}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// Publish runs every matching handler in subscription order. All of them
+// run even if some fail; the failures are joined.
+func (b *Bus) Publish(ctx context.Context, ev Event) error {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, sub := range subs {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		if err := sub.handler(ctx, ev); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,52 @@
+package events_test
+
+import (
+	"chirpy/internal/events"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestBus(t *testing.T) {
+	bus := events.NewBus()
+	var got []string
+	record := func(name string, err error) events.Handler {
+		return func(ctx context.Context, ev events.Event) error {
+			got = append(got, name+":"+string(ev.Type))
+			return err
+		}
+	}
+	bus.Subscribe("chirps", record("chirps", nil), events.ChirpCreated, events.ChirpDeleted)
+	bus.Subscribe("failing", record("failing", errors.New("boom")), events.ChirpDeleted)
+	bus.Subscribe("everything", record("everything", nil))
+
+	tests := []struct {
+		name    string
+		typ     events.Type
+		want    []string
+		wantErr bool
+	}{
+		{"one subscriber plus catch-all", events.ChirpCreated, []string{"chirps:chirp.created", "everything:chirp.created"}, false},
+		{"failure doesn't stop the rest", events.ChirpDeleted, []string{"chirps:chirp.deleted", "failing:chirp.deleted", "everything:chirp.deleted"}, true},
+		{"only catch-all", events.UserUpgraded, []string{"everything:user.upgraded"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			err := bus.Publish(context.Background(), events.Event{ID: uuid.New(), Type: tt.typ})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Package lockout tracks failed attempts per key (an email, an IP address)
+// and locks a key out with exponential backoff once it fails too often.
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+type Policy struct {
+	// Threshold is how many failures are allowed before the key is locked.
+	Threshold int
+	// BaseDelay is the first lock duration; each further failure doubles it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Window is how long a failure is remembered without a new one, counted
+	// from when any lock it caused ends.
+	Window time.Duration
+}
+
+// LockDuration is how long a key with the given number of failures stays
+// locked.
+func (p Policy) LockDuration(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := p.Threshold; i < failures; i++ {
+		d *= 2
+		if d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return d
+}
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// forgotten reports whether e's failures no longer count at now. Timing
+// the window from the end of the lock keeps long locks escalating rather
+// than resetting as soon as they outlast the window.
+func (e *entry) forgotten(now time.Time, window time.Duration) bool {
+	return now.Sub(e.lastFailure) > window && now.Sub(e.lockedUntil) > window
+}
+
+// Tracker is an in-memory, per-process record of failures.
+type Tracker struct {
+	policy    Policy
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewTracker(policy Policy) *Tracker {
+	return &Tracker{
+		policy:  policy,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// Check reports whether key may attempt again, and if not, how long until
+// it may.
+func (t *Tracker) Check(key string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[key]
+	if !ok {
+		return 0, true
+	}
+	if wait := e.lockedUntil.Sub(t.now()); wait > 0 {
+		return wait, false
+	}
+	return 0, true
+}
+
+// Fail records a failed attempt and returns how long key is now locked for.
+func (t *Tracker) Fail(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+
+	e, ok := t.entries[key]
+	if !ok || e.forgotten(now, t.policy.Window) {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	lock := t.policy.LockDuration(e.failures)
+	if lock > 0 {
+		e.lockedUntil = now.Add(lock)
+	}
+	return lock
+}
+
+// Reset forgets every failure recorded for key, unlocking it.
+func (t *Tracker) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// sweep drops entries that are neither locked nor recent enough to count.
+// Callers must hold t.mu.
+func (t *Tracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.policy.Window {
+		return
+	}
+	t.lastSweep = now
+	for key, e := range t.entries {
+		if e.forgotten(now, t.policy.Window) {
+			delete(t.entries, key)
+		}
+	}
+}
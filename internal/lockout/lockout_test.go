@@ -0,0 +1,109 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	Threshold: 3,
+	BaseDelay: time.Second,
+	MaxDelay:  10 * time.Second,
+	Window:    time.Minute,
+}
+
+func TestLockDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := testPolicy.LockDuration(tt.failures); got != tt.want {
+			t.Errorf("LockDuration(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewTracker(testPolicy)
+	tracker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if lock := tracker.Fail("a@example.com"); lock != 0 {
+			t.Fatalf("expected no lock after %d failures, got %v", i+1, lock)
+		}
+	}
+	if _, ok := tracker.Check("a@example.com"); !ok {
+		t.Fatal("expected key to be allowed below threshold")
+	}
+
+	if lock := tracker.Fail("a@example.com"); lock != time.Second {
+		t.Fatalf("expected 1s lock, got %v", lock)
+	}
+	if wait, ok := tracker.Check("a@example.com"); ok || wait != time.Second {
+		t.Fatalf("expected key to be locked for 1s, got %v, %v", wait, ok)
+	}
+	if _, ok := tracker.Check("b@example.com"); !ok {
+		t.Fatal("expected other keys to be unaffected")
+	}
+
+	now = now.Add(2 * time.Second)
+	if _, ok := tracker.Check("a@example.com"); !ok {
+		t.Fatal("expected lock to expire")
+	}
+	if lock := tracker.Fail("a@example.com"); lock != 2*time.Second {
+		t.Fatalf("expected lock to double, got %v", lock)
+	}
+
+	tracker.Reset("a@example.com")
+	if _, ok := tracker.Check("a@example.com"); !ok {
+		t.Fatal("expected reset to unlock the key")
+	}
+
+	tracker.Fail("c@example.com")
+	tracker.Fail("c@example.com")
+	now = now.Add(2 * time.Minute)
+	if lock := tracker.Fail("c@example.com"); lock != 0 {
+		t.Fatalf("expected failures outside the window to be forgotten, got %v", lock)
+	}
+}
+
+// A lock longer than the window must not wipe the count, or the backoff
+// never reaches MaxDelay.
+func TestTrackerEscalatesPastWindow(t *testing.T) {
+	policy := Policy{
+		Threshold: 5,
+		BaseDelay: 30 * time.Second,
+		MaxDelay:  time.Hour,
+		Window:    15 * time.Minute,
+	}
+	now := time.Now()
+	tracker := NewTracker(policy)
+	tracker.now = func() time.Time { return now }
+
+	want := []time.Duration{0, 0, 0, 0, 30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute,
+		8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour}
+	for i, w := range want {
+		lock := tracker.Fail("a@example.com")
+		if lock != w {
+			t.Fatalf("failure %d: expected a %v lock, got %v", i+1, w, lock)
+		}
+		// Wait out each lock, then a little longer, before trying again.
+		now = now.Add(lock + time.Minute)
+	}
+
+	now = now.Add(time.Hour + policy.Window)
+	if lock := tracker.Fail("a@example.com"); lock != 0 {
+		t.Fatalf("expected failures to be forgotten a window after the lock, got %v", lock)
+	}
+}
@@ -0,0 +1,81 @@
+// Package moderation names the reasons users give for reports and the
+// actions moderators take on them.
+package moderation
+
+import "fmt"
+
+type Reason string
+
+const (
+	ReasonSpam           Reason = "spam"
+	ReasonHarassment     Reason = "harassment"
+	ReasonHateSpeech     Reason = "hate_speech"
+	ReasonViolence       Reason = "violence"
+	ReasonSexualContent  Reason = "sexual_content"
+	ReasonSelfHarm       Reason = "self_harm"
+	ReasonMisinformation Reason = "misinformation"
+	ReasonImpersonation  Reason = "impersonation"
+	ReasonOther          Reason = "other"
+)
+
+// Reasons lists every reason a report can give.
+var Reasons = []Reason{
+	ReasonSpam,
+	ReasonHarassment,
+	ReasonHateSpeech,
+	ReasonViolence,
+	ReasonSexualContent,
+	ReasonSelfHarm,
+	ReasonMisinformation,
+	ReasonImpersonation,
+	ReasonOther,
+}
+
+func ParseReason(s string) (Reason, error) {
+	for _, r := range Reasons {
+		if string(r) == s {
+			return r, nil
+		}
+	}
+	return "", fmt.Errorf("unknown reason %q", s)
+}
+
+// Status is where a report is in the queue. Open reports wait for a
+// moderator to claim them; claimed ones are being looked at.
+type Status string
+
+const (
+	StatusOpen     Status = "open"
+	StatusClaimed  Status = "claimed"
+	StatusResolved Status = "resolved"
+)
+
+func ParseStatus(s string) (Status, error) {
+	switch st := Status(s); st {
+	case StatusOpen, StatusClaimed, StatusResolved:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown status %q", s)
+}
+
+// Action is something a moderator did, as recorded in the audit trail.
+type Action string
+
+const (
+	ActionClaim         Action = "claim"
+	ActionUnclaim       Action = "unclaim"
+	ActionDismiss       Action = "dismiss"
+	ActionHideChirp     Action = "hide_chirp"
+	ActionSuspendUser   Action = "suspend_user"
+	ActionUnsuspendUser Action = "unsuspend_user"
+	ActionDeleteChirp   Action = "delete_chirp"
+)
+
+// ParseResolution parses an action that closes a report.
+func ParseResolution(s string) (Action, error) {
+	switch a := Action(s); a {
+	case ActionDismiss, ActionHideChirp, ActionSuspendUser:
+		return a, nil
+	}
+	return "", fmt.Errorf("%q doesn't resolve a report", s)
+}
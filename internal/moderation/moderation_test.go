@@ -0,0 +1,34 @@
+package moderation
+
+import "testing"
+
+func TestParseReason(t *testing.T) {
+	for _, r := range Reasons {
+		if got, err := ParseReason(string(r)); err != nil || got != r {
+			t.Errorf("ParseReason(%q) = %q, %v", r, got, err)
+		}
+	}
+	if _, err := ParseReason("boring"); err == nil {
+		t.Error("expected an unknown reason to be rejected")
+	}
+}
+
+func TestParseResolution(t *testing.T) {
+	tests := []struct {
+		action string
+		wantOK bool
+	}{
+		{"dismiss", true},
+		{"hide_chirp", true},
+		{"suspend_user", true},
+		{"claim", false},
+		{"unsuspend_user", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseResolution(tt.action)
+		if (err == nil) != tt.wantOK {
+			t.Errorf("ParseResolution(%q) error = %v, want ok %v", tt.action, err, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Package notifications turns domain events into in-app notifications.
+// Repeated events about the same subject coalesce into one notification
+// until the user reads it. Joining Chirpy Red is the only event that makes
+// one today; likes, follows and replies don't exist yet.
+package notifications
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type Kind string
+
+const KindRedUpgrade Kind = "red_upgrade"
+
+// Store is what the notifier needs from the database.
+type Store interface {
+	AddNotification(ctx context.Context, arg database.AddNotificationParams) error
+	IsUserHidden(ctx context.Context, arg database.IsUserHiddenParams) (bool, error)
+}
+
+// Notification is one thing to tell UserID about. SubjectID is the chirp
+// or user it's about; notifications of the same kind about the same
+// subject coalesce, collecting their actors.
+type Notification struct {
+	UserID    uuid.UUID
+	Kind      Kind
+	SubjectID uuid.UUID
+	ActorID   uuid.UUID
+	EventID   uuid.UUID
+}
+
+// Notifier records notifications for the events it's subscribed to.
+type Notifier struct {
+	store Store
+	// Live, if set, is called with each notification once it's recorded,
+	// to push it to connected clients.
+	Live func(Notification)
+}
+
+func NewNotifier(store Store) *Notifier {
+	return &Notifier{store: store}
+}
+
+// Types are the event types Handle makes notifications of.
+var Types = []events.Type{events.UserUpgraded}
+
+// Handle is an events.Handler. The event id is stored with the
+// notification, so a redelivered event isn't counted twice.
+func (n *Notifier) Handle(ctx context.Context, ev events.Event) error {
+	switch ev.Type {
+	case events.UserUpgraded:
+		return n.Add(ctx, Notification{
+			UserID:    ev.UserID,
+			Kind:      KindRedUpgrade,
+			SubjectID: ev.UserID,
+			EventID:   ev.ID,
+		})
+	}
+	return nil
+}
+
+// Add records a notification, coalescing it into an unread one of the
+// same kind and subject if there is one. Nothing is recorded if the user
+// has blocked or muted the actor, or the actor has blocked them.
+func (n *Notifier) Add(ctx context.Context, notification Notification) error {
+	// A user doesn't need telling about their own actions.
+	if notification.ActorID == notification.UserID {
+		notification.ActorID = uuid.Nil
+	}
+	if notification.ActorID != uuid.Nil {
+		hidden, err := n.store.IsUserHidden(ctx, database.IsUserHiddenParams{
+			ViewerID: notification.UserID,
+			OtherID:  notification.ActorID,
+		})
+		if err != nil || hidden {
+			return err
+		}
+	}
+	actors := []uuid.UUID{}
+	if notification.ActorID != uuid.Nil {
+		actors = append(actors, notification.ActorID)
+	}
+	err := n.store.AddNotification(ctx, database.AddNotificationParams{
+		UserID:    notification.UserID,
+		Kind:      string(notification.Kind),
+		SubjectID: notification.SubjectID,
+		ActorIds:  actors,
+		EventID:   notification.EventID,
+	})
+	if err == nil && n.Live != nil {
+		n.Live(notification)
+	}
+	return err
+}
+
+// Message describes a notification.
+func Message(kind Kind) string {
+	switch kind {
+	case KindRedUpgrade:
+		return "Welcome to Chirpy Red!"
+	}
+	return string(kind)
+}
@@ -0,0 +1,92 @@
+package notifications_test
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"chirpy/internal/notifications"
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type fakeStore struct {
+	added  []database.AddNotificationParams
+	hidden uuid.UUID
+}
+
+func (s *fakeStore) IsUserHidden(ctx context.Context, arg database.IsUserHiddenParams) (bool, error) {
+	return arg.OtherID == s.hidden, nil
+}
+
+func (s *fakeStore) AddNotification(ctx context.Context, arg database.AddNotificationParams) error {
+	s.added = append(s.added, arg)
+	return nil
+}
+
+func TestHandle(t *testing.T) {
+	store := &fakeStore{}
+	notifier := notifications.NewNotifier(store)
+	var live []notifications.Notification
+	notifier.Live = func(n notifications.Notification) { live = append(live, n) }
+	userID := uuid.New()
+
+	if err := notifier.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpCreated, UserID: userID}); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.added) != 0 {
+		t.Fatalf("expected no notification for chirp.created, got %+v", store.added)
+	}
+
+	ev := events.Event{ID: uuid.New(), Type: events.UserUpgraded, UserID: userID}
+	if err := notifier.Handle(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.added) != 1 {
+		t.Fatalf("expected a notification, got %+v", store.added)
+	}
+	got := store.added[0]
+	if got.UserID != userID || got.Kind != string(notifications.KindRedUpgrade) || got.EventID != ev.ID || len(got.ActorIds) != 0 {
+		t.Errorf("unexpected notification %+v", got)
+	}
+	if len(live) != 1 || live[0].EventID != ev.ID {
+		t.Errorf("expected the notification to be pushed live, got %+v", live)
+	}
+}
+
+// kindTest stands in for the kinds with actors that later features add.
+const kindTest notifications.Kind = "test"
+
+func TestAddActors(t *testing.T) {
+	store := &fakeStore{hidden: uuid.New()}
+	notifier := notifications.NewNotifier(store)
+	userID, other := uuid.New(), uuid.New()
+
+	notifier.Add(context.Background(), notifications.Notification{UserID: userID, Kind: kindTest, ActorID: userID})
+	notifier.Add(context.Background(), notifications.Notification{UserID: userID, Kind: kindTest, ActorID: other})
+	notifier.Add(context.Background(), notifications.Notification{UserID: userID, Kind: kindTest, ActorID: store.hidden})
+	if len(store.added) != 2 {
+		t.Fatalf("expected a blocked or muted actor's notification to be dropped, got %+v", store.added)
+	}
+	if len(store.added[0].ActorIds) != 0 {
+		t.Errorf("expected the user not to be their own actor, got %v", store.added[0].ActorIds)
+	}
+	if len(store.added[1].ActorIds) != 1 || store.added[1].ActorIds[0] != other {
+		t.Errorf("expected the other user as actor, got %v", store.added[1].ActorIds)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		kind notifications.Kind
+		want string
+	}{
+		{notifications.KindRedUpgrade, "Welcome to Chirpy Red!"},
+		{kindTest, "test"},
+	}
+	for _, tt := range tests {
+		if got := notifications.Message(tt.kind); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.kind, tt.want, got)
+		}
+	}
+}
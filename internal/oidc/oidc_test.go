@@ -0,0 +1,167 @@
+package oidc_test
+
+import (
+	"chirpy/internal/oidc"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// stubProvider is a minimal identity provider: discovery, a key set, and a
+// token endpoint that hands out one ID token per authorization code.
+type stubProvider struct {
+	t      *testing.T
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+	// challenge and nonce are captured from the authorization request.
+	challenge string
+	nonce     string
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &stubProvider{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.srv.URL,
+			"authorization_endpoint": p.srv.URL + "/authorize",
+			"token_endpoint":         p.srv.URL + "/token",
+			"jwks_uri":               p.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("code") != "good-code" {
+			http.Error(w, "bad code", http.StatusBadRequest)
+			return
+		}
+		if oidc.S256Challenge(r.PostForm.Get("code_verifier")) != p.challenge {
+			http.Error(w, "pkce mismatch", http.StatusBadRequest)
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":   p.srv.URL,
+			"aud":   "chirpy-client",
+			"sub":   "provider-user-1",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": p.nonce,
+		}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-key"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+// authorize plays the user's browser: it reads the authorization URL and
+// returns the state the provider would redirect back with.
+func (p *stubProvider) authorize(authURL string) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		p.t.Fatalf("expected S256 PKCE, got %q", q.Get("code_challenge_method"))
+	}
+	p.challenge = q.Get("code_challenge")
+	p.nonce = q.Get("nonce")
+	return q.Get("state")
+}
+
+func TestProviderLogin(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:      stub.srv.URL,
+		ClientID:    "chirpy-client",
+		RedirectURL: "http://localhost:8080/api/auth/oidc/callback",
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		code    string
+		wantErr bool
+	}{
+		{name: "valid login", claims: jwt.MapClaims{"email": "me@example.com", "email_verified": true}, code: "good-code"},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "another-client"}, code: "good-code", wantErr: true},
+		{name: "wrong nonce", claims: jwt.MapClaims{"nonce": "replayed"}, code: "good-code", wantErr: true},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, code: "good-code", wantErr: true},
+		{name: "bad code", code: "bad-code", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub.claims = tt.claims
+			authURL, err := provider.AuthCodeURL(ctx)
+			if err != nil {
+				t.Fatalf("expected an authorization url: %v", err)
+			}
+			state := stub.authorize(authURL)
+
+			idToken, err := provider.Exchange(ctx, state, tt.code)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected exchange to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected exchange to succeed: %v", err)
+			}
+			if idToken.Subject != "provider-user-1" || idToken.Email != "me@example.com" || !idToken.EmailVerified {
+				t.Errorf("unexpected id token %+v", idToken)
+			}
+		})
+	}
+
+	t.Run("state can only be used once", func(t *testing.T) {
+		stub.claims = nil
+		authURL, _ := provider.AuthCodeURL(ctx)
+		state := stub.authorize(authURL)
+		if _, err := provider.Exchange(ctx, state, "good-code"); err != nil {
+			t.Fatalf("expected first exchange to succeed: %v", err)
+		}
+		if _, err := provider.Exchange(ctx, state, "good-code"); err != oidc.ErrUnknownState {
+			t.Errorf("expected ErrUnknownState, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,23 @@
+package pagination_test
+
+import (
+	"chirpy/internal/pagination"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCursor(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC)
+	id := uuid.New()
+	gotTime, gotID, err := pagination.DecodeCursor(pagination.EncodeCursor(at, id))
+	if err != nil || !gotTime.Equal(at) || gotID != id {
+		t.Errorf("expected %v %v, got %v %v %v", at, id, gotTime, gotID, err)
+	}
+	for _, bad := range []string{"not base64!", "bm9waXBl", ""} {
+		if _, _, err := pagination.DecodeCursor(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"chirpy/internal/database"
+	"context"
+)
+
+// DB is what PostgresStore needs from the database.
+type DB interface {
+	TakeRateLimitToken(ctx context.Context, arg database.TakeRateLimitTokenParams) (database.TakeRateLimitTokenRow, error)
+	DeleteIdleRateLimitBuckets(ctx context.Context) (int64, error)
+}
+
+// PostgresStore keeps buckets in Postgres so that every instance of the
+// server shares them. Each Take is a single upsert.
+type PostgresStore struct {
+	db DB
+}
+
+func NewPostgresStore(db DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, p Policy, key string) (Result, error) {
+	row, err := s.db.TakeRateLimitToken(ctx, database.TakeRateLimitTokenParams{
+		Key:             p.Name + ":" + key,
+		Capacity:        float64(p.Limit),
+		RefillPerSecond: p.perSecond(),
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return p.result(row.Allowed, row.Tokens), nil
+}
+
+// Sweep deletes buckets that have been idle for their policy's period, and
+// so have refilled.
+func (s *PostgresStore) Sweep(ctx context.Context) error {
+	_, err := s.db.DeleteIdleRateLimitBuckets(ctx)
+	return err
+}
@@ -0,0 +1,129 @@
+// Package ratelimit limits how often a key (a user, an IP address) may do
+// something, using token buckets: a bucket holds up to Limit tokens, each
+// request takes one, and it refills evenly over Period.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+type Policy struct {
+	// Name tells policies apart, so the same key can be limited separately
+	// for logging in and for posting.
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+// perSecond is how many tokens the bucket gains a second.
+func (p Policy) perSecond() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+// String describes p in the RateLimit-Policy header's format.
+func (p Policy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(math.Ceil(p.Period.Seconds())))
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until a token is available, when none was.
+	RetryAfter time.Duration
+}
+
+// result describes a bucket left holding tokens after a request.
+func (p Policy) result(allowed bool, tokens float64) Result {
+	rate := p.perSecond()
+	r := Result{
+		Allowed:   allowed,
+		Limit:     p.Limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(p.Limit) - tokens) / rate),
+	}
+	if !allowed {
+		r.RetryAfter = seconds((1 - tokens) / rate)
+	}
+	return r
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Max(s, 0) * float64(time.Second))
+}
+
+// Store keeps buckets. Take removes a token from key's bucket for policy p
+// if it has one.
+type Store interface {
+	Take(ctx context.Context, p Policy, key string) (Result, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// expires is when the bucket is full again even if nothing takes
+	// from it, and can be dropped.
+	expires time.Time
+}
+
+// MemoryStore keeps buckets in memory, for a single instance.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, p Policy, key string) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	id := p.Name + ":" + key
+	b, ok := s.buckets[id]
+	if !ok {
+		b = &bucket{tokens: float64(p.Limit), updated: now}
+		s.buckets[id] = b
+	}
+	b.tokens = math.Min(float64(p.Limit), b.tokens+now.Sub(b.updated).Seconds()*p.perSecond())
+	b.updated = now
+	b.expires = now.Add(p.Period)
+	if b.tokens < 1 {
+		return p.result(false, b.tokens), nil
+	}
+	b.tokens--
+	return p.result(true, b.tokens), nil
+}
+
+// sweepInterval is how often idle buckets are dropped.
+const sweepInterval = time.Minute
+
+// sweep drops buckets that have been idle for their policy's period, and so
+// have refilled. Callers must hold s.mu.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for id, b := range s.buckets {
+		if now.After(b.expires) {
+			delete(s.buckets, id)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"chirpy/internal/database"
+	"context"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{Name: "test", Limit: 3, Period: 3 * time.Second}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 2; i >= 0; i-- {
+		res, err := s.Take(ctx, testPolicy, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != i {
+			t.Fatalf("expected to be allowed with %d remaining, got %+v", i, res)
+		}
+	}
+	res, _ := s.Take(ctx, testPolicy, "a")
+	if res.Allowed {
+		t.Fatal("expected an empty bucket to refuse")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("expected to retry after 1s, got %v", res.RetryAfter)
+	}
+	if res.Reset != 3*time.Second {
+		t.Errorf("expected the bucket to be full in 3s, got %v", res.Reset)
+	}
+
+	if res, _ := s.Take(ctx, testPolicy, "b"); !res.Allowed {
+		t.Error("expected another key to have its own bucket")
+	}
+	other := Policy{Name: "other", Limit: 1, Period: time.Minute}
+	if res, _ := s.Take(ctx, other, "a"); !res.Allowed {
+		t.Error("expected another policy to have its own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if res, _ := s.Take(ctx, testPolicy, "a"); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("expected one token to have refilled, got %+v", res)
+	}
+	now = now.Add(time.Hour)
+	if res, _ := s.Take(ctx, testPolicy, "a"); res.Remaining != testPolicy.Limit-1 {
+		t.Errorf("expected the bucket to refill no further than its limit, got %+v", res)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+	daily := Policy{Name: "daily", Limit: 1, Period: 24 * time.Hour}
+
+	s.Take(ctx, daily, "a")
+	s.Take(ctx, testPolicy, "a")
+	now = now.Add(2 * time.Hour)
+	if res, _ := s.Take(ctx, daily, "a"); res.Allowed {
+		t.Fatal("expected a bucket with a long period to outlive the sweep")
+	}
+	if _, ok := s.buckets["test:a"]; ok {
+		t.Error("expected an idle bucket that has refilled to be swept")
+	}
+}
+
+func TestPolicyString(t *testing.T) {
+	if got := (Policy{Limit: 10, Period: time.Minute}).String(); got != "10;w=60" {
+		t.Errorf("got %q", got)
+	}
+}
+
+type fakeDB struct {
+	got database.TakeRateLimitTokenParams
+	row database.TakeRateLimitTokenRow
+}
+
+func (f *fakeDB) TakeRateLimitToken(ctx context.Context, arg database.TakeRateLimitTokenParams) (database.TakeRateLimitTokenRow, error) {
+	f.got = arg
+	return f.row, nil
+}
+
+func (f *fakeDB) DeleteIdleRateLimitBuckets(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func TestPostgresStore(t *testing.T) {
+	db := &fakeDB{row: database.TakeRateLimitTokenRow{Tokens: 0.5, Allowed: false}}
+	res, err := NewPostgresStore(db).Take(context.Background(), testPolicy, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.got.Key != "test:a" || db.got.Capacity != 3 || db.got.RefillPerSecond != 1 {
+		t.Errorf("unexpected query parameters %+v", db.got)
+	}
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter != 500*time.Millisecond {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
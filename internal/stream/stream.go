@@ -0,0 +1,200 @@
+// Package stream fans chirp events out to live subscribers, such as the
+// Server-Sent Events endpoint. The hub is fed from the domain event bus;
+// with several instances, a Postgres LISTEN/NOTIFY listener could call
+// Publish on each instance's hub instead.
+package stream
+
+import (
+	"chirpy/internal/events"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// DefaultBuffer is how many messages a subscriber may fall behind by
+// before the hub drops it.
+const DefaultBuffer = 64
+
+// recentEvents is how many event ids the hub remembers to skip an event
+// the relay hands it again.
+const recentEvents = 1024
+
+var (
+	ErrClosed = errors.New("stream hub is shut down")
+	ErrLagged = errors.New("subscriber fell too far behind")
+)
+
+// Types are the event types the hub streams.
+var Types = []events.Type{events.ChirpCreated, events.ChirpUpdated, events.ChirpDeleted}
+
+// Message is one event as sent to subscribers. ID is the outbox event id,
+// which clients hand back to resume. AuthorID is the user the event is
+// about, and ChirpID and Body the chirp, if any.
+type Message struct {
+	ID       string
+	Event    string
+	AuthorID uuid.UUID
+	ChirpID  uuid.UUID
+	Body     string
+	Data     []byte
+}
+
+// FromEvent converts a domain event, reporting false for events the hub
+// doesn't stream.
+func FromEvent(ev events.Event) (Message, bool) {
+	if !slices.Contains(Types, ev.Type) {
+		return Message{}, false
+	}
+	// Every streamed event carries a chirp.
+	var chirp events.Chirp
+	ev.Decode(&chirp)
+	return Message{
+		ID:       ev.ID.String(),
+		Event:    string(ev.Type),
+		AuthorID: ev.UserID,
+		ChirpID:  chirp.ID,
+		Body:     chirp.Body,
+		Data:     ev.Payload,
+	}, true
+}
+
+// Filter picks the messages a subscriber wants: one author's, one
+// chirp's, or with the zero Filter, everything. Hide, if set, leaves out
+// messages the subscriber doesn't want to see; it runs on every publish
+// and mustn't block.
+type Filter struct {
+	AuthorID uuid.UUID
+	ChirpID  uuid.UUID
+	Hide     func(Message) bool
+}
+
+func (f Filter) Match(m Message) bool {
+	return (f.AuthorID == uuid.Nil || f.AuthorID == m.AuthorID) &&
+		(f.ChirpID == uuid.Nil || f.ChirpID == m.ChirpID) &&
+		(f.Hide == nil || !f.Hide(m))
+}
+
+// Subscriber receives matching messages on C until it's unsubscribed, the
+// hub shuts down or it falls behind; Err then says why C was closed.
+type Subscriber struct {
+	C      <-chan Message
+	ch     chan Message
+	filter Filter
+	err    error
+}
+
+// Err is only meaningful once C has been closed.
+func (s *Subscriber) Err() error {
+	return s.err
+}
+
+// Hub delivers published messages to every matching subscriber without
+// ever blocking the publisher.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscriber]struct{}
+	buffer int
+	closed bool
+
+	// sent and recent remember the last recentEvents ids handled, oldest
+	// first in recent.
+	seenMu sync.Mutex
+	sent   map[uuid.UUID]struct{}
+	recent []uuid.UUID
+}
+
+func NewHub(buffer int) *Hub {
+	return &Hub{
+		subs:   make(map[*Subscriber]struct{}),
+		buffer: buffer,
+		sent:   make(map[uuid.UUID]struct{}),
+	}
+}
+
+func (h *Hub) Subscribe(filter Filter) (*Subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	ch := make(chan Message, h.buffer)
+	s := &Subscriber{C: ch, ch: ch, filter: filter}
+	h.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Unsubscribe is safe to call more than once.
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(s, nil)
+}
+
+// drop must be called with h.mu held.
+func (h *Hub) drop(s *Subscriber, err error) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	s.err = err
+	close(s.ch)
+}
+
+// Publish hands m to every matching subscriber. One whose buffer is full
+// is dropped with ErrLagged rather than holding everyone else up; it can
+// reconnect and resume from the last message it got.
+func (h *Hub) Publish(m Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !s.filter.Match(m) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		default:
+			h.drop(s, ErrLagged)
+		}
+	}
+}
+
+// Handle is an events.Handler that publishes the events the hub streams.
+// The outbox is at-least-once, so an event comes round again whenever
+// another subscriber fails; one the hub has already sent is skipped.
+func (h *Hub) Handle(ctx context.Context, ev events.Event) error {
+	m, ok := FromEvent(ev)
+	if !ok || !h.firstSeen(ev.ID) {
+		return nil
+	}
+	h.Publish(m)
+	return nil
+}
+
+// firstSeen records id, reporting whether it's new.
+func (h *Hub) firstSeen(id uuid.UUID) bool {
+	h.seenMu.Lock()
+	defer h.seenMu.Unlock()
+	if _, ok := h.sent[id]; ok {
+		return false
+	}
+	if len(h.recent) == recentEvents {
+		delete(h.sent, h.recent[0])
+		h.recent = h.recent[1:]
+	}
+	h.sent[id] = struct{}{}
+	h.recent = append(h.recent, id)
+	return true
+}
+
+// Close disconnects every subscriber with ErrClosed and refuses new ones.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.drop(s, ErrClosed)
+	}
+}
@@ -0,0 +1,78 @@
+package stream_test
+
+import (
+	"chirpy/internal/events"
+	"chirpy/internal/stream"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestHub(t *testing.T) {
+	hub := stream.NewHub(2)
+	author := uuid.New()
+
+	global, _ := hub.Subscribe(stream.Filter{})
+	byAuthor, _ := hub.Subscribe(stream.Filter{AuthorID: author})
+
+	hub.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpCreated, UserID: uuid.New()})
+	hub.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpCreated, UserID: author})
+	hub.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.UserUpgraded, UserID: author})
+
+	if len(global.C) != 2 {
+		t.Errorf("expected the global subscriber to get both chirps, got %d", len(global.C))
+	}
+	if m := <-byAuthor.C; m.AuthorID != author || m.Event != string(events.ChirpCreated) {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if len(byAuthor.C) != 0 {
+		t.Errorf("expected nothing else for the author subscriber, got %d", len(byAuthor.C))
+	}
+
+	// The global subscriber's buffer is full, so the next message drops it.
+	hub.Publish(stream.Message{ID: "3", AuthorID: author})
+	<-global.C
+	<-global.C
+	if _, ok := <-global.C; ok || !errors.Is(global.Err(), stream.ErrLagged) {
+		t.Errorf("expected a lagging subscriber to be dropped, got %v", global.Err())
+	}
+	if m := <-byAuthor.C; m.ID != "3" {
+		t.Errorf("expected the author subscriber to keep receiving, got %+v", m)
+	}
+
+	chirpID := uuid.New()
+	thread, _ := hub.Subscribe(stream.Filter{ChirpID: chirpID})
+	hub.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpDeleted, UserID: uuid.New(), Payload: []byte(`{"id":"` + uuid.NewString() + `"}`)})
+	hub.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpUpdated, UserID: uuid.New(), Payload: []byte(`{"id":"` + chirpID.String() + `"}`)})
+	if len(thread.C) != 1 {
+		t.Errorf("expected only the chirp's own event, got %d", len(thread.C))
+	}
+	if m := <-thread.C; m.ChirpID != chirpID {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	hiding, _ := hub.Subscribe(stream.Filter{Hide: func(m stream.Message) bool { return m.Body == "spoiler" }})
+	hub.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpCreated, UserID: uuid.New(), Payload: []byte(`{"body":"spoiler"}`)})
+	hub.Handle(context.Background(), events.Event{ID: uuid.New(), Type: events.ChirpCreated, UserID: uuid.New(), Payload: []byte(`{"body":"fine"}`)})
+	if len(hiding.C) != 1 {
+		t.Errorf("expected the hidden message to be left out, got %d", len(hiding.C))
+	}
+
+	redelivered := events.Event{ID: uuid.New(), Type: events.ChirpCreated, UserID: uuid.New(), Payload: []byte(`{"body":"again"}`)}
+	hub.Handle(context.Background(), redelivered)
+	hub.Handle(context.Background(), redelivered)
+	if len(hiding.C) != 2 {
+		t.Errorf("expected a redelivered event to be sent once, got %d messages", len(hiding.C))
+	}
+
+	hub.Close()
+	if _, ok := <-byAuthor.C; ok || !errors.Is(byAuthor.Err(), stream.ErrClosed) {
+		t.Errorf("expected shutdown to close subscribers, got %v", byAuthor.Err())
+	}
+	if _, err := hub.Subscribe(stream.Filter{}); !errors.Is(err, stream.ErrClosed) {
+		t.Errorf("expected subscribing after shutdown to fail, got %v", err)
+	}
+	hub.Unsubscribe(byAuthor)
+}
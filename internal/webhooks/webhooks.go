@@ -0,0 +1,329 @@
+// Package webhooks delivers signed event notifications to the endpoints
+// integrators register, retrying failures with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers sent with every delivery. The signature uses the same scheme as
+// incoming Polka webhooks: "v1=" and the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the endpoint's secret.
+const (
+	EventHeader     = "Chirpy-Event"
+	DeliveryHeader  = "Chirpy-Delivery"
+	TimestampHeader = "Chirpy-Timestamp"
+	SignatureHeader = "Chirpy-Signature"
+)
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+var errPrivateAddress = errors.New("webhook endpoint resolves to a private address")
+
+// ValidateEvents checks that every event is a domain event type. Endpoints
+// only receive events about the user who owns them.
+func ValidateEvents(types []string) error {
+	if len(types) == 0 {
+		return errors.New("at least one event is required")
+	}
+	for _, t := range types {
+		if !slices.Contains(events.All, events.Type(t)) {
+			return fmt.Errorf("unknown event %q", t)
+		}
+	}
+	return nil
+}
+
+// FanoutStore is what Fanout needs from the database.
+type FanoutStore interface {
+	ListWebhookEndpointsForEvent(ctx context.Context, arg database.ListWebhookEndpointsForEventParams) ([]database.WebhookEndpoint, error)
+	CreateWebhookDelivery(ctx context.Context, arg database.CreateWebhookDeliveryParams) error
+}
+
+// Fanout returns an event handler that queues a delivery of each event to
+// every endpoint its user subscribed to it. A redelivered event doesn't
+// queue a second delivery to the same endpoint.
+func Fanout(store FanoutStore) events.Handler {
+	return func(ctx context.Context, ev events.Event) error {
+		endpoints, err := store.ListWebhookEndpointsForEvent(ctx, database.ListWebhookEndpointsForEventParams{
+			OwnerID:   ev.UserID,
+			EventType: string(ev.Type),
+		})
+		if err != nil {
+			return err
+		}
+		for _, endpoint := range endpoints {
+			err := store.CreateWebhookDelivery(ctx, database.CreateWebhookDeliveryParams{
+				EndpointID:     endpoint.ID,
+				EventID:        ev.ID,
+				EventType:      string(ev.Type),
+				Payload:        ev.Payload,
+				EventCreatedAt: ev.CreatedAt,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ValidateURL only accepts absolute https URLs, or http ones when
+// allowInsecure is set for local development.
+func ValidateURL(raw string, allowInsecure bool) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" || u.User != nil {
+		return fmt.Errorf("webhook url %q must be absolute and carry no credentials", raw)
+	}
+	if u.Scheme != "https" && !(allowInsecure && u.Scheme == "http") {
+		return fmt.Errorf("webhook url %q must use https", raw)
+	}
+	return nil
+}
+
+// GenerateSecret returns a new signing secret for an endpoint.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Store is what the worker needs from the database.
+type Store interface {
+	ClaimDueWebhookDeliveries(ctx context.Context, arg database.ClaimDueWebhookDeliveriesParams) ([]database.WebhookDelivery, error)
+	GetWebhookEndpoint(ctx context.Context, id uuid.UUID) (database.WebhookEndpoint, error)
+	MarkWebhookDeliverySucceeded(ctx context.Context, arg database.MarkWebhookDeliverySucceededParams) error
+	MarkWebhookDeliveryFailed(ctx context.Context, arg database.MarkWebhookDeliveryFailedParams) error
+}
+
+type Config struct {
+	// BatchSize is how many deliveries one Run sends at most.
+	BatchSize int32
+	// MaxAttempts is how many times a delivery is tried before it's
+	// marked failed.
+	MaxAttempts int32
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Timeout bounds each request. Deliveries are claimed one at a time,
+	// just before they're sent, and leased to this worker for twice that.
+	Timeout time.Duration
+	// AllowPrivateNetworks lets endpoints resolve to loopback and private
+	// addresses. It should only be set in development.
+	AllowPrivateNetworks bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		BatchSize:   50,
+		MaxAttempts: 8,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    6 * time.Hour,
+		Timeout:     10 * time.Second,
+	}
+}
+
+type Worker struct {
+	store  Store
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewWorker(store Store, cfg Config) *Worker {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivateNetworks {
+		dialer.Control = rejectPrivateAddresses
+	}
+	return &Worker{
+		store: store,
+		cfg:   cfg,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			// A redirect could point anywhere; treat it as a failure.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		now: time.Now,
+	}
+}
+
+// deniedPrefixes are the special-purpose ranges from the IANA registries
+// that no public webhook endpoint lives in.
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local, cloud metadata
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/128"),          // unspecified
+	netip.MustParsePrefix("::1/128"),         // loopback
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// rejectPrivateAddresses runs after DNS resolution, so a public hostname
+// can't be used to reach internal services. IPv4-mapped IPv6 addresses are
+// checked as the IPv4 address they map to.
+func rejectPrivateAddresses(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range deniedPrefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%w: %s", errPrivateAddress, ip)
+		}
+	}
+	return nil
+}
+
+// Backoff is how long to wait before retrying after attempt failures.
+func Backoff(attempt int32, base, max time.Duration) time.Duration {
+	d := base
+	for i := int32(1); i < attempt && d < max; i++ {
+		d *= 2
+	}
+	return min(d, max)
+}
+
+// Run sends up to BatchSize due deliveries, trying each once. Each is
+// claimed right before it's sent, so its lease only has to outlast one
+// request rather than the whole batch.
+func (w *Worker) Run(ctx context.Context) error {
+	var errs []error
+	for range w.cfg.BatchSize {
+		deliveries, err := w.store.ClaimDueWebhookDeliveries(ctx, database.ClaimDueWebhookDeliveriesParams{
+			LeaseUntil:    w.now().Add(2 * w.cfg.Timeout),
+			MaxDeliveries: 1,
+		})
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if len(deliveries) == 0 {
+			break
+		}
+		d := deliveries[0]
+		if err := w.deliver(ctx, d); err != nil {
+			errs = append(errs, fmt.Errorf("delivery %s: %w", d.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver sends d and records the outcome. It only returns an error when
+// the outcome couldn't be recorded.
+func (w *Worker) deliver(ctx context.Context, d database.WebhookDelivery) error {
+	endpoint, err := w.store.GetWebhookEndpoint(ctx, d.EndpointID)
+	if err != nil {
+		return err
+	}
+	code, sendErr := w.send(ctx, endpoint, d)
+	responseCode := sql.NullInt32{Int32: int32(code), Valid: code != 0}
+	if sendErr == nil {
+		return w.store.MarkWebhookDeliverySucceeded(ctx, database.MarkWebhookDeliverySucceededParams{
+			ID:               d.ID,
+			LastResponseCode: responseCode,
+		})
+	}
+
+	attempts := d.Attempts + 1
+	status := StatusPending
+	if attempts >= w.cfg.MaxAttempts {
+		status = StatusFailed
+	}
+	return w.store.MarkWebhookDeliveryFailed(ctx, database.MarkWebhookDeliveryFailedParams{
+		ID:               d.ID,
+		Status:           status,
+		NextAttemptAt:    w.now().Add(Backoff(attempts, w.cfg.BaseDelay, w.cfg.MaxDelay)),
+		LastResponseCode: responseCode,
+		LastError:        sql.NullString{String: sendErr.Error(), Valid: true},
+	})
+}
+
+// send posts d to endpoint, returning the response status if there was one.
+func (w *Worker) send(ctx context.Context, endpoint database.WebhookEndpoint, d database.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(struct {
+		ID        uuid.UUID       `json:"id"`
+		Type      string          `json:"type"`
+		CreatedAt time.Time       `json:"created_at"`
+		Data      json.RawMessage `json:"data"`
+	}{d.EventID, d.EventType, d.EventCreatedAt, d.Payload})
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(w.now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1.0")
+	req.Header.Set(EventHeader, d.EventType)
+	req.Header.Set(DeliveryHeader, d.ID.String())
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, auth.SignWebhook(endpoint.Secret, timestamp, body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("endpoint returned %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runEvery runs job straight away and then every interval until ctx is
+// cancelled. Failures are logged and retried on the next tick.
+func runEvery(ctx context.Context, interval time.Duration, name string, job func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := job(ctx); err != nil {
+			slog.Error("background job failed", "job", name, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,31 +1,108 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
+// problemValidation is the type of problems listing the request fields
+// that failed validation. Other problems are "about:blank", whose title is
+// the status text.
+const problemValidation = "/problems/validation"
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// response.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	// Err is what went wrong, for the logs only.
+	Err error `json:"-"`
+}
+
+// FieldError is one invalid request field. Code, when set, is a stable
+// name for the rule it broke.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+func newProblem(status int, detail string, err error) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Err:    err,
+	}
+}
+
+// validationProblem is a 400 for a request with invalid fields.
+func validationProblem(detail string, fields ...FieldError) *Problem {
+	return &Problem{
+		Type:   problemValidation,
+		Title:  "Your request has invalid fields",
+		Status: http.StatusBadRequest,
+		Detail: detail,
+		Errors: fields,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Err != nil {
+		return p.Detail + ": " + p.Err.Error()
+	}
+	return p.Detail
+}
+
+func (p *Problem) Unwrap() error {
+	return p.Err
+}
+
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
+	respondWithProblem(w, newProblem(code, msg, err))
+}
+
+// respondWithProblem logs p and sends it as application/problem+json,
+// tagged with the request id requestID set on the response.
+func respondWithProblem(w http.ResponseWriter, p *Problem) {
+	p.RequestID = w.Header().Get(requestIDHeader)
+	level := slog.LevelInfo
+	if p.Status > 499 {
+		level = slog.LevelError
+	}
+	attrs := []any{"status", p.Status, "detail", p.Detail}
+	if p.RequestID != "" {
+		attrs = append(attrs, "request_id", p.RequestID)
 	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+	if p.Err != nil {
+		attrs = append(attrs, "err", p.Err)
 	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	slog.Log(context.Background(), level, "responding with an error", attrs...)
+
+	dat, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("marshalling problem", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(dat)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("marshalling JSON", "err", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -1,15 +1,31 @@
 package main
 
 import (
+	"chirpy/internal/auth"
 	"chirpy/internal/database"
+	"chirpy/internal/entitlements"
+	"chirpy/internal/events"
+	"chirpy/internal/lockout"
+	"chirpy/internal/notifications"
+	"chirpy/internal/oidc"
+	"chirpy/internal/ratelimit"
+	"chirpy/internal/stream"
+	"chirpy/internal/webhooks"
+	"context"
 	"database/sql"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
@@ -32,39 +48,240 @@ func main() {
 		log.Fatal("couldn't ping database:", err)
 	}
 
-	dbQueries := database.New(db)
+	dbQueries := database.NewStore(db)
+
+	jwtOptions := auth.DefaultValidatorOptions()
+	if leeway := os.Getenv("JWT_LEEWAY"); leeway != "" {
+		jwtOptions.Leeway, err = time.ParseDuration(leeway)
+		if err != nil {
+			log.Fatal("couldn't parse JWT_LEEWAY:", err)
+		}
+	}
+
+	hashAlgorithm := os.Getenv("PASSWORD_HASH")
+	if hashAlgorithm == "" {
+		hashAlgorithm = auth.AlgorithmArgon2id
+	}
+	bcryptCost := bcrypt.DefaultCost
+	if cost := os.Getenv("BCRYPT_COST"); cost != "" {
+		bcryptCost, err = strconv.Atoi(cost)
+		if err != nil {
+			log.Fatal("couldn't parse BCRYPT_COST:", err)
+		}
+	}
+	passwords, err := auth.NewPasswordHasher(hashAlgorithm, bcryptCost)
+	if err != nil {
+		log.Fatal("couldn't configure password hashing:", err)
+	}
+
+	passwordPolicy := auth.DefaultPasswordPolicy()
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		passwordPolicy.MinLength, err = strconv.Atoi(minLength)
+		if err != nil {
+			log.Fatal("couldn't parse PASSWORD_MIN_LENGTH:", err)
+		}
+	}
+	if minEntropy := os.Getenv("PASSWORD_MIN_ENTROPY"); minEntropy != "" {
+		passwordPolicy.MinEntropyBits, err = strconv.ParseFloat(minEntropy, 64)
+		if err != nil {
+			log.Fatal("couldn't parse PASSWORD_MIN_ENTROPY:", err)
+		}
+	}
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		passwordPolicy.Breached = auth.BreachedPasswordDir{Dir: dir}
+	}
+
+	var plans entitlements.Checker = entitlements.Default()
+	if path := os.Getenv("ENTITLEMENTS_FILE"); path != "" {
+		plans, err = entitlements.Load(path)
+		if err != nil {
+			log.Fatal("couldn't load entitlements:", err)
+		}
+	}
+
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("couldn't parse TRUSTED_PROXIES:", err)
+	}
+
+	var rateLimits ratelimit.Store
+	var rateLimitSweep func(context.Context) error
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		rateLimits = ratelimit.NewMemoryStore()
+	case "postgres":
+		pg := ratelimit.NewPostgresStore(dbQueries)
+		rateLimits, rateLimitSweep = pg, pg.Sweep
+	case "off":
+	default:
+		log.Fatalf("unknown RATE_LIMIT_STORE %q", store)
+	}
+
+	idempotencyTTL := defaultIdempotencyTTL
+	if ttl := os.Getenv("IDEMPOTENCY_TTL"); ttl != "" {
+		idempotencyTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal("couldn't parse IDEMPOTENCY_TTL:", err)
+		}
+	}
 
 	apiCfg := apiConfig{
 		fileserverHits: atomic.Int32{},
 		db:             dbQueries,
 		platform:       os.Getenv("PLATFORM"),
 		secret:         os.Getenv("SECRET"),
-		polkaKey:       os.Getenv("POLKA_KEY"),
+		polka:          auth.NewWebhookVerifier(os.Getenv("POLKA_KEY"), auth.DefaultWebhookTolerance),
+		jwtOptions:     jwtOptions,
+		accountLockout: lockout.NewTracker(lockout.Policy{
+			Threshold: 5,
+			BaseDelay: 30 * time.Second,
+			MaxDelay:  time.Hour,
+			Window:    15 * time.Minute,
+		}),
+		ipLockout: lockout.NewTracker(lockout.Policy{
+			Threshold: 20,
+			BaseDelay: 30 * time.Second,
+			MaxDelay:  time.Hour,
+			Window:    15 * time.Minute,
+		}),
+		passwords:          passwords,
+		passwordPolicy:     passwordPolicy,
+		entitlements:       plans,
+		events:             events.NewBus(),
+		stream:             stream.NewHub(stream.DefaultBuffer),
+		notificationStream: stream.NewHub(stream.DefaultBuffer),
+		rateLimits:         rateLimits,
+		trustedProxies:     trustedProxies,
+		idempotencyTTL:     idempotencyTTL,
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		apiCfg.oidc = oidc.NewProvider(oidc.Config{
+			Issuer:       issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		})
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))))
 	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handleHits)
+	mux.Handle("GET /admin/metrics", apiCfg.middlewareRequireRole(auth.RoleAdmin, http.HandlerFunc(apiCfg.handleHits)))
 	mux.Handle("POST /admin/reset", apiCfg.middlewareDevMode(http.HandlerFunc(apiCfg.handleReset)))
-	mux.HandleFunc("POST /api/users", apiCfg.handlerCreateUser)
-	mux.HandleFunc("PUT /api/users", apiCfg.handlerUpdateUser)
-	mux.HandleFunc("POST /api/login", apiCfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefreshToken)
+	mux.Handle("PUT /admin/users/{userId}/role", apiCfg.middlewareRequireRole(auth.RoleAdmin, http.HandlerFunc(apiCfg.handlerUpdateUserRole)))
+	mux.Handle("POST /admin/users/{userId}/unlock", apiCfg.middlewareRequireRole(auth.RoleAdmin, http.HandlerFunc(apiCfg.handlerUnlockUser)))
+	mux.Handle("DELETE /admin/chirps/{chirpId}", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerModerateDeleteChirp)))
+	mux.Handle("GET /admin/reports", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerListReports)))
+	mux.Handle("GET /admin/reports/{reportId}", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerGetReport)))
+	mux.Handle("POST /admin/reports/{reportId}/claim", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerClaimReport)))
+	mux.Handle("POST /admin/reports/{reportId}/unclaim", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerUnclaimReport)))
+	mux.Handle("POST /admin/reports/{reportId}/resolve", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerResolveReport)))
+	mux.Handle("GET /admin/audit", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerListModerationActions)))
+	mux.Handle("POST /admin/users/{userId}/unsuspend", apiCfg.middlewareRequireRole(auth.RoleModerator, http.HandlerFunc(apiCfg.handlerUnsuspendUser)))
+	mux.Handle("POST /api/users", apiCfg.rateLimit(signupRateLimit, http.HandlerFunc(apiCfg.handlerCreateUser)))
+	mux.Handle("POST /api/webhooks", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerCreateWebhook))))
+	mux.Handle("GET /api/webhooks", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListWebhooks))))
+	mux.Handle("DELETE /api/webhooks/{webhookId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerDeleteWebhook))))
+	mux.Handle("GET /api/webhooks/{webhookId}/deliveries", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListWebhookDeliveries))))
+	mux.Handle("GET /api/notifications", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListNotifications))))
+	mux.Handle("POST /api/notifications/read", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerMarkAllNotificationsRead))))
+	mux.Handle("POST /api/notifications/{notificationId}/read", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerMarkNotificationRead))))
+	mux.Handle("POST /api/conversations", apiCfg.requireAuth(apiCfg.requireSession(apiCfg.idempotent(http.HandlerFunc(apiCfg.handlerCreateConversation)))))
+	mux.Handle("GET /api/conversations", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListConversations))))
+	mux.Handle("GET /api/conversations/{conversationId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerGetConversation))))
+	mux.Handle("GET /api/conversations/{conversationId}/messages", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListMessages))))
+	mux.Handle("POST /api/conversations/{conversationId}/messages", apiCfg.requireAuth(apiCfg.requireSession(apiCfg.idempotent(http.HandlerFunc(apiCfg.handlerSendMessage)))))
+	mux.Handle("POST /api/conversations/{conversationId}/read", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerMarkConversationRead))))
+	mux.Handle("POST /api/reports", apiCfg.requireAuth(apiCfg.requireSession(apiCfg.idempotent(http.HandlerFunc(apiCfg.handlerCreateReport)))))
+	mux.Handle("GET /api/blocks", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListBlocks))))
+	mux.Handle("PUT /api/blocks/{userId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerBlockUser))))
+	mux.Handle("DELETE /api/blocks/{userId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerUnblockUser))))
+	mux.Handle("GET /api/mutes", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListMutes))))
+	mux.Handle("PUT /api/mutes/{userId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerMuteUser))))
+	mux.Handle("DELETE /api/mutes/{userId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerUnmuteUser))))
+	mux.Handle("GET /api/mutes/keywords", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListKeywordMutes))))
+	mux.Handle("POST /api/mutes/keywords", apiCfg.requireAuth(apiCfg.requireSession(apiCfg.idempotent(http.HandlerFunc(apiCfg.handlerCreateKeywordMute)))))
+	mux.Handle("DELETE /api/mutes/keywords/{keywordMuteId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerDeleteKeywordMute))))
+	mux.Handle("GET /api/entitlements", apiCfg.requireAuth(http.HandlerFunc(apiCfg.handlerGetEntitlements)))
+	mux.Handle("GET /api/users/me", apiCfg.requireAuth(http.HandlerFunc(apiCfg.handlerGetCurrentUser)))
+	mux.Handle("PUT /api/users", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerUpdateUser))))
+	mux.Handle("POST /api/login", apiCfg.rateLimit(loginRateLimit, http.HandlerFunc(apiCfg.handlerLogin)))
+	mux.Handle("POST /api/login/mfa", apiCfg.rateLimit(loginRateLimit, http.HandlerFunc(apiCfg.handlerLoginMFA)))
+	mux.Handle("POST /api/mfa/totp/enroll", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerEnrollTOTP))))
+	mux.Handle("POST /api/mfa/totp/confirm", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerConfirmTOTP))))
+	mux.Handle("POST /api/mfa/totp/disable", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerDisableTOTP))))
+	mux.Handle("POST /api/keys", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerCreateAPIKey))))
+	mux.Handle("GET /api/keys", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListAPIKeys))))
+	mux.Handle("DELETE /api/keys/{keyId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerRevokeAPIKey))))
+	mux.Handle("POST /api/oauth/clients", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerCreateOAuthClient))))
+	mux.Handle("GET /api/oauth/clients", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerListOAuthClients))))
+	mux.Handle("DELETE /api/oauth/clients/{clientId}", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerDeleteOAuthClient))))
+	mux.HandleFunc("GET /oauth/authorize", apiCfg.handlerOAuthAuthorize)
+	mux.Handle("POST /oauth/authorize", apiCfg.rateLimit(loginRateLimit, http.HandlerFunc(apiCfg.handlerOAuthApprove)))
+	mux.Handle("POST /oauth/token", apiCfg.rateLimit(tokenRateLimit, http.HandlerFunc(apiCfg.handlerOAuthToken)))
+	mux.Handle("POST /oauth/introspect", apiCfg.rateLimit(tokenRateLimit, http.HandlerFunc(apiCfg.handlerOAuthIntrospect)))
+	mux.Handle("POST /oauth/revoke", apiCfg.rateLimit(tokenRateLimit, http.HandlerFunc(apiCfg.handlerOAuthRevoke)))
+	if apiCfg.oidc != nil {
+		mux.HandleFunc("GET /api/auth/oidc/login", apiCfg.handlerOIDCLogin)
+		mux.HandleFunc("GET /api/auth/oidc/callback", apiCfg.handlerOIDCCallback)
+	}
+	mux.Handle("POST /api/refresh", apiCfg.rateLimit(tokenRateLimit, http.HandlerFunc(apiCfg.handlerRefreshToken)))
 	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevoke)
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerCreateChirp)
-	mux.HandleFunc("DELETE /api/chirps/{chirpId}", apiCfg.handlerDeleteChirp)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handlerGetAllChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpId}", apiCfg.handlerGetChirpById)
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerUpgradeUser)
+	mux.Handle("POST /api/chirps", apiCfg.requireAuth(apiCfg.requireScope(auth.ScopeChirpsWrite, apiCfg.rateLimit(chirpRateLimit, apiCfg.idempotent(http.HandlerFunc(apiCfg.handlerCreateChirp))))))
+	mux.Handle("PUT /api/chirps/{chirpId}", apiCfg.requireAuth(apiCfg.requireScope(auth.ScopeChirpsWrite, http.HandlerFunc(apiCfg.handlerUpdateChirp))))
+	mux.Handle("DELETE /api/chirps/{chirpId}", apiCfg.requireAuth(apiCfg.requireScope(auth.ScopeChirpsWrite, http.HandlerFunc(apiCfg.handlerDeleteChirp))))
+	mux.Handle("GET /api/chirps", apiCfg.optionalAuth(apiCfg.requireScope(auth.ScopeChirpsRead, http.HandlerFunc(apiCfg.handlerGetAllChirps))))
+	mux.Handle("GET /api/chirps/{chirpId}", apiCfg.optionalAuth(apiCfg.requireScope(auth.ScopeChirpsRead, http.HandlerFunc(apiCfg.handlerGetChirpById))))
+	mux.Handle("GET /api/stream", apiCfg.optionalAuth(apiCfg.requireScope(auth.ScopeChirpsRead, http.HandlerFunc(apiCfg.handlerStream))))
+	mux.Handle("GET /api/ws", apiCfg.requireAuth(apiCfg.requireSession(http.HandlerFunc(apiCfg.handlerWebSocket))))
+	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerPolkaWebhook)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: apiCfg.requestID(mux),
 	}
+	// Shutdown waits for connections to go idle, which streams never do.
+	srv.RegisterOnShutdown(apiCfg.stream.Close)
+	srv.RegisterOnShutdown(apiCfg.notificationStream.Close)
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
-	log.Fatal(srv.ListenAndServe())
+	webhookConfig := webhooks.DefaultConfig()
+	webhookConfig.AllowPrivateNetworks = apiCfg.platform == "dev"
+	webhookWorker := webhooks.NewWorker(dbQueries, webhookConfig)
+
+	apiCfg.events.Subscribe("webhooks", webhooks.Fanout(dbQueries))
+	notifier := notifications.NewNotifier(dbQueries)
+	notifier.Live = apiCfg.liveNotification
+	apiCfg.events.Subscribe("notifications", notifier.Handle, notifications.Types...)
+	apiCfg.events.Subscribe("stream", apiCfg.stream.Handle, stream.Types...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runEvery(ctx, 24*time.Hour, "expiring subscriptions", apiCfg.expireSubscriptions)
+	go runEvery(ctx, 5*time.Second, "relaying outbox", apiCfg.relayOutbox)
+	go runEvery(ctx, 5*time.Second, "delivering webhooks", webhookWorker.Run)
+	go runEvery(ctx, time.Hour, "expiring idempotency keys", apiCfg.expireIdempotencyKeys)
+	if rateLimitSweep != nil {
+		go runEvery(ctx, time.Hour, "sweeping rate limits", rateLimitSweep)
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutting down", "err", err)
+		}
+	}()
+
+	slog.Info("serving", "root", filepathRoot, "port", port)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
 }
 
 func handlerReadiness(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// outboxBatchSize is how many events one relayOutbox pass handles.
+	outboxBatchSize = 100
+	// outboxLease is how long a pass holds the events it claimed. A failed
+	// event is retried once its lease runs out.
+	outboxLease = time.Minute
+	// outboxMaxAttempts is how many times an event is published before
+	// it's parked and left for an operator.
+	outboxMaxAttempts = 10
+)
+
+// relayOutbox publishes new outbox events to the event bus, oldest first.
+// Events are leased to the pass that claims them, so several instances can
+// relay at once. An event is only marked processed once every subscriber
+// has handled it, so a failing subscriber gets it again later, until it's
+// parked after outboxMaxAttempts.
+func (cfg *apiConfig) relayOutbox(ctx context.Context) error {
+	rows, err := cfg.db.ClaimOutboxEvents(ctx, database.ClaimOutboxEventsParams{
+		LeaseUntil: time.Now().Add(outboxLease),
+		MaxEvents:  outboxBatchSize,
+	})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, row := range rows {
+		if err := cfg.events.Publish(ctx, events.FromOutbox(row)); err != nil {
+			errs = append(errs, fmt.Errorf("outbox event %s: %w", row.ID, err))
+			if err := cfg.db.MarkOutboxEventFailed(ctx, database.MarkOutboxEventFailedParams{
+				ID:          row.ID,
+				LastError:   err.Error(),
+				MaxAttempts: outboxMaxAttempts,
+			}); err != nil {
+				errs = append(errs, fmt.Errorf("outbox event %s: %w", row.ID, err))
+			}
+			continue
+		}
+		if _, err := cfg.db.MarkOutboxEventProcessed(ctx, row.ID); err != nil {
+			errs = append(errs, fmt.Errorf("outbox event %s: %w", row.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/ratelimit"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	loginRateLimit  = ratelimit.Policy{Name: "login", Limit: 10, Period: time.Minute}
+	signupRateLimit = ratelimit.Policy{Name: "signup", Limit: 5, Period: time.Hour}
+	chirpRateLimit  = ratelimit.Policy{Name: "chirps", Limit: 30, Period: time.Minute}
+	// tokenRateLimit covers the token endpoints, which take credentials
+	// but no access token, so it's always per client IP.
+	tokenRateLimit = ratelimit.Policy{Name: "token", Limit: 30, Period: time.Minute}
+)
+
+// rateLimitFailures keeps an outage of the rate limit store from logging
+// once per request.
+var rateLimitFailures = &failureLog{every: time.Minute}
+
+// failureLog reports at most one failure every so often, counting the
+// ones in between.
+type failureLog struct {
+	every time.Duration
+
+	mu     sync.Mutex
+	last   time.Time
+	missed int
+}
+
+// record notes a failure at now. It reports whether to log this one and
+// how many went unlogged since the last.
+func (l *failureLog) record(now time.Time) (missed int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() && now.Sub(l.last) < l.every {
+		l.missed++
+		return 0, false
+	}
+	missed, l.missed, l.last = l.missed, 0, now
+	return missed, true
+}
+
+// rateLimit holds requests to policy, per user when there is one and per
+// client IP otherwise, so it goes after requireAuth to limit users. A
+// user's plan can replace the policy's limit. It sets the RateLimit-*
+// headers from the IETF draft on every response.
+func (cfg *apiConfig) rateLimit(policy ratelimit.Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.rateLimits == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := "ip:" + cfg.clientIP(r)
+		policy := policy
+		if user, ok := userFromContext(r.Context()); ok {
+			key = "user:" + user.ID.String()
+			policy = cfg.planRateLimit(user, policy)
+		}
+		res, err := cfg.rateLimits.Take(r.Context(), policy, key)
+		if err != nil {
+			// Better to let everyone through than no one while the store is
+			// unavailable.
+			if missed, ok := rateLimitFailures.record(time.Now()); ok {
+				slog.Warn("rate limit store unavailable, letting requests through", "policy", policy.Name, "missed", missed, "err", err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Policy", policy.String())
+		h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+		if !res.Allowed {
+			setRetryAfter(w, res.RetryAfter)
+			respondWithError(w, http.StatusTooManyRequests, "Too many requests, slow down", fmt.Errorf("%s rate limit hit by %s", policy.Name, key))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// planRateLimit is policy with the limit user's plan sets for it, if any.
+func (cfg *apiConfig) planRateLimit(user database.User, policy ratelimit.Policy) ratelimit.Policy {
+	if cfg.entitlements == nil {
+		return policy
+	}
+	if rl, ok := cfg.entitlementsFor(user).RateLimits[policy.Name]; ok {
+		policy.Limit = rl.Limit
+		policy.Period = rl.Period.Duration
+	}
+	return policy
+}
@@ -0,0 +1,76 @@
+-- name: BlockUser :exec
+INSERT INTO user_blocks (blocker_id, blocked_id, created_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT DO NOTHING;
+
+-- name: UnblockUser :execrows
+DELETE FROM user_blocks
+WHERE blocker_id = $1 AND blocked_id = $2;
+
+-- name: ListBlockedUsers :many
+SELECT * FROM user_blocks
+WHERE blocker_id = $1
+ORDER BY created_at DESC;
+
+-- name: IsBlockedBetween :one
+SELECT EXISTS (
+    SELECT 1 FROM user_blocks
+    WHERE (blocker_id = sqlc.arg(user_a) AND blocked_id = sqlc.arg(user_b))
+       OR (blocker_id = sqlc.arg(user_b) AND blocked_id = sqlc.arg(user_a))
+);
+
+-- name: ConversationHasBlock :one
+SELECT EXISTS (
+    SELECT 1 FROM conversation_members m
+    JOIN user_blocks b
+      ON (b.blocker_id = m.user_id AND b.blocked_id = sqlc.arg(user_id))
+      OR (b.blocker_id = sqlc.arg(user_id) AND b.blocked_id = m.user_id)
+    WHERE m.conversation_id = sqlc.arg(conversation_id)
+);
+
+-- name: MuteUser :exec
+INSERT INTO user_mutes (muter_id, muted_id, created_at, expires_at)
+VALUES ($1, $2, NOW(), $3)
+ON CONFLICT (muter_id, muted_id) DO UPDATE SET expires_at = EXCLUDED.expires_at;
+
+-- name: UnmuteUser :execrows
+DELETE FROM user_mutes
+WHERE muter_id = $1 AND muted_id = $2;
+
+-- name: ListMutedUsers :many
+SELECT * FROM user_mutes
+WHERE muter_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+ORDER BY created_at DESC;
+
+-- name: CreateKeywordMute :one
+INSERT INTO keyword_mutes (id, created_at, user_id, keyword, expires_at)
+VALUES (gen_random_uuid(), NOW(), $1, $2, $3)
+RETURNING *;
+
+-- name: DeleteKeywordMute :execrows
+DELETE FROM keyword_mutes
+WHERE id = $1 AND user_id = $2;
+
+-- name: ListKeywordMutes :many
+SELECT * FROM keyword_mutes
+WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+ORDER BY created_at DESC;
+
+-- name: ListHiddenUserIDs :many
+SELECT blocked_id AS user_id FROM user_blocks WHERE user_blocks.blocker_id = sqlc.arg(viewer_id)
+UNION
+SELECT blocker_id FROM user_blocks WHERE user_blocks.blocked_id = sqlc.arg(viewer_id)
+UNION
+SELECT muted_id FROM user_mutes
+WHERE user_mutes.muter_id = sqlc.arg(viewer_id) AND (user_mutes.expires_at IS NULL OR user_mutes.expires_at > NOW());
+
+-- name: IsUserHidden :one
+SELECT (EXISTS (
+    SELECT 1 FROM user_blocks
+    WHERE (blocker_id = sqlc.arg(viewer_id) AND blocked_id = sqlc.arg(other_id))
+       OR (blocker_id = sqlc.arg(other_id) AND blocked_id = sqlc.arg(viewer_id))
+) OR EXISTS (
+    SELECT 1 FROM user_mutes
+    WHERE muter_id = sqlc.arg(viewer_id) AND muted_id = sqlc.arg(other_id)
+      AND (expires_at IS NULL OR expires_at > NOW())
+))::bool AS hidden;
@@ -15,17 +15,30 @@ RETURNING *;
 
 -- name: GetAllChirps :many
 SELECT * FROM chirps
+WHERE hidden_at IS NULL
 ORDER BY created_at ASC;
 
 -- name: GetAllChirpsFromAuthor :many
 SELECT * FROM chirps
-WHERE user_id = $1
+WHERE user_id = $1 AND hidden_at IS NULL
 ORDER BY created_at ASC;
 
 -- name: GetChirpById :one
 SELECT * FROM chirps
-WHERE id = $1
+WHERE id = $1 AND hidden_at IS NULL
 LIMIT 1;
 
 -- name: DeleteChirpById :exec
 DELETE FROM chirps WHERE id = $1;
+
+-- name: UpdateChirpBody :one
+UPDATE chirps
+SET body = $2, updated_at = NOW()
+WHERE id = $1 AND updated_at = $3
+RETURNING *;
+
+-- name: HideChirp :one
+UPDATE chirps
+SET hidden_at = NOW()
+WHERE id = $1 AND hidden_at IS NULL
+RETURNING *;
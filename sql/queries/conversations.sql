@@ -0,0 +1,66 @@
+-- name: CreateConversation :one
+INSERT INTO conversations (id, created_at, updated_at, created_by)
+VALUES (gen_random_uuid(), NOW(), NOW(), $1)
+RETURNING *;
+
+-- name: AddConversationMember :exec
+INSERT INTO conversation_members (conversation_id, user_id, joined_at)
+VALUES ($1, $2, NOW());
+
+-- name: CreateDirectConversation :one
+-- Returns no row if the pair already has a conversation.
+INSERT INTO conversations (id, created_at, updated_at, created_by, direct_key)
+VALUES (gen_random_uuid(), NOW(), NOW(), sqlc.arg(created_by)::uuid,
+    LEAST(sqlc.arg(created_by)::uuid, sqlc.arg(other_id)::uuid)::text || ':' ||
+    GREATEST(sqlc.arg(created_by)::uuid, sqlc.arg(other_id)::uuid)::text)
+ON CONFLICT (direct_key) DO NOTHING
+RETURNING *;
+
+-- name: FindDirectConversation :one
+SELECT * FROM conversations
+WHERE direct_key = LEAST(sqlc.arg(user_a)::uuid, sqlc.arg(user_b)::uuid)::text || ':' ||
+    GREATEST(sqlc.arg(user_a)::uuid, sqlc.arg(user_b)::uuid)::text;
+
+-- name: GetConversationForMember :one
+SELECT c.* FROM conversations c
+JOIN conversation_members m ON m.conversation_id = c.id
+WHERE c.id = $1 AND m.user_id = $2;
+
+-- name: ListConversationMembers :many
+SELECT * FROM conversation_members
+WHERE conversation_id = $1
+ORDER BY joined_at ASC, user_id ASC;
+
+-- name: ListConversationsForUser :many
+SELECT c.id, c.created_at, c.updated_at, c.created_by,
+    (SELECT COUNT(*) FROM messages msg
+     WHERE msg.conversation_id = c.id
+       AND msg.sender_id <> m.user_id
+       AND (m.last_read_at IS NULL OR msg.created_at > m.last_read_at))::bigint AS unread_count
+FROM conversations c
+JOIN conversation_members m ON m.conversation_id = c.id
+WHERE m.user_id = $1
+ORDER BY c.updated_at DESC;
+
+-- name: TouchConversation :exec
+UPDATE conversations
+SET updated_at = NOW()
+WHERE id = $1;
+
+-- name: MarkConversationRead :exec
+UPDATE conversation_members
+SET last_read_at = GREATEST(COALESCE(last_read_at, sqlc.arg(read_at)::timestamp), sqlc.arg(read_at)::timestamp)
+WHERE conversation_id = sqlc.arg(conversation_id) AND user_id = sqlc.arg(user_id);
+
+-- name: CreateMessage :one
+INSERT INTO messages (id, created_at, conversation_id, sender_id, body)
+VALUES (gen_random_uuid(), NOW(), $1, $2, $3)
+RETURNING *;
+
+-- name: ListMessages :many
+SELECT * FROM messages
+WHERE conversation_id = sqlc.arg(conversation_id)
+  AND (sqlc.narg(before_time)::timestamp IS NULL
+       OR (created_at, id) < (sqlc.narg(before_time)::timestamp, sqlc.narg(before_id)::uuid))
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(max_results);
@@ -0,0 +1,25 @@
+-- name: ClaimIdempotencyKey :execrows
+INSERT INTO idempotency_keys (scope, key, fingerprint, created_at, expires_at)
+VALUES ($1, $2, $3, NOW(), $4)
+ON CONFLICT (scope, key) DO UPDATE
+SET fingerprint = EXCLUDED.fingerprint, created_at = NOW(), expires_at = EXCLUDED.expires_at,
+    status_code = NULL, response_body = NULL, response_headers = '{}'
+WHERE idempotency_keys.expires_at < NOW()
+   OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < sqlc.arg(abandoned_before));
+
+-- name: GetIdempotencyKey :one
+SELECT * FROM idempotency_keys
+WHERE scope = $1 AND key = $2;
+
+-- name: CompleteIdempotencyKey :exec
+UPDATE idempotency_keys
+SET status_code = $3, response_body = $4, response_headers = $5
+WHERE scope = $1 AND key = $2;
+
+-- name: DeleteIdempotencyKey :exec
+DELETE FROM idempotency_keys
+WHERE scope = $1 AND key = $2;
+
+-- name: DeleteExpiredIdempotencyKeys :execrows
+DELETE FROM idempotency_keys
+WHERE expires_at < NOW();
@@ -0,0 +1,12 @@
+-- name: CreateRecoveryCode :exec
+INSERT INTO mfa_recovery_codes (id, created_at, user_id, code_hash, used_at)
+VALUES (gen_random_uuid(), NOW(), $1, $2, NULL);
+
+-- name: UseRecoveryCode :execrows
+UPDATE mfa_recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM mfa_recovery_codes
+WHERE user_id = $1;
@@ -0,0 +1,36 @@
+-- name: AddNotification :exec
+INSERT INTO notifications (id, created_at, updated_at, user_id, kind, subject_id, actor_ids, event_ids)
+SELECT gen_random_uuid(), NOW(), NOW(), sqlc.arg(user_id), sqlc.arg(kind), sqlc.arg(subject_id),
+    sqlc.arg(actor_ids)::uuid[], ARRAY[sqlc.arg(event_id)::uuid]
+WHERE NOT EXISTS (
+    SELECT 1 FROM notifications
+    WHERE user_id = sqlc.arg(user_id) AND sqlc.arg(event_id)::uuid = ANY(event_ids)
+)
+ON CONFLICT (user_id, kind, subject_id) WHERE read_at IS NULL
+DO UPDATE SET
+    actor_ids = ARRAY(SELECT DISTINCT unnest(notifications.actor_ids || EXCLUDED.actor_ids)),
+    event_ids = notifications.event_ids || EXCLUDED.event_ids,
+    updated_at = NOW();
+
+-- name: ListNotifications :many
+SELECT * FROM notifications
+WHERE user_id = sqlc.arg(user_id)
+  AND (sqlc.narg(before_time)::timestamp IS NULL
+       OR (updated_at, id) < (sqlc.narg(before_time)::timestamp, sqlc.narg(before_id)::uuid))
+  AND (NOT sqlc.arg(unread_only)::bool OR read_at IS NULL)
+ORDER BY updated_at DESC, id DESC
+LIMIT sqlc.arg(max_results);
+
+-- name: CountUnreadNotifications :one
+SELECT COUNT(*) FROM notifications
+WHERE user_id = $1 AND read_at IS NULL;
+
+-- name: MarkNotificationRead :execrows
+UPDATE notifications
+SET read_at = COALESCE(read_at, NOW())
+WHERE id = $1 AND user_id = $2;
+
+-- name: MarkAllNotificationsRead :execrows
+UPDATE notifications
+SET read_at = NOW()
+WHERE user_id = $1 AND read_at IS NULL;
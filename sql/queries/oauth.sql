@@ -0,0 +1,40 @@
+-- name: CreateOAuthClient :one
+INSERT INTO oauth_clients (id, created_at, updated_at, owner_id, name, redirect_uris, secret_hash)
+VALUES (gen_random_uuid(), NOW(), NOW(), $1, $2, $3, $4)
+RETURNING *;
+
+-- name: GetOAuthClient :one
+SELECT * FROM oauth_clients
+WHERE id = $1;
+
+-- name: ListOAuthClientsForOwner :many
+SELECT * FROM oauth_clients
+WHERE owner_id = $1
+ORDER BY created_at ASC;
+
+-- name: DeleteOAuthClient :execrows
+DELETE FROM oauth_clients
+WHERE id = $1 AND owner_id = $2;
+
+-- name: CreateAuthorizationCode :exec
+INSERT INTO oauth_authorization_codes (code_hash, created_at, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at)
+VALUES ($1, NOW(), $2, $3, $4, $5, $6, $7);
+
+-- name: UseAuthorizationCode :one
+UPDATE oauth_authorization_codes
+SET used_at = NOW()
+WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+RETURNING *;
+
+-- name: RevokeOAuthToken :exec
+INSERT INTO oauth_revoked_tokens (jti, revoked_at, expires_at)
+VALUES ($1, NOW(), $2)
+ON CONFLICT (jti) DO NOTHING;
+
+-- name: IsOAuthTokenRevoked :one
+-- Deleting a client revokes every token it was issued.
+SELECT EXISTS (
+    SELECT 1 FROM oauth_revoked_tokens WHERE jti = sqlc.arg(jti)
+) OR NOT EXISTS (
+    SELECT 1 FROM oauth_clients WHERE id = sqlc.arg(client_id)
+);
@@ -0,0 +1,50 @@
+-- name: CreateOutboxEvent :one
+INSERT INTO outbox_events (id, created_at, event_type, user_id, payload)
+VALUES (gen_random_uuid(), NOW(), $1, $2, $3)
+RETURNING *;
+
+-- name: ClaimOutboxEvents :many
+-- ClaimOutboxEvents leases the oldest unprocessed events that no other
+-- relay holds, returning them oldest first.
+WITH claimed AS (
+    UPDATE outbox_events
+    SET locked_until = sqlc.arg(lease_until)::timestamp
+    WHERE id IN (
+        SELECT id FROM outbox_events
+        WHERE processed_at IS NULL AND parked_at IS NULL
+          AND (locked_until IS NULL OR locked_until <= NOW())
+        ORDER BY created_at ASC
+        LIMIT sqlc.arg(max_events)
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING *
+)
+SELECT * FROM claimed
+ORDER BY created_at ASC;
+
+-- name: MarkOutboxEventProcessed :execrows
+UPDATE outbox_events
+SET processed_at = NOW()
+WHERE id = $1 AND processed_at IS NULL;
+
+-- name: MarkOutboxEventFailed :exec
+-- MarkOutboxEventFailed records a failed attempt. The event is retried
+-- once its lease runs out, or parked after max_attempts.
+UPDATE outbox_events
+SET attempts = attempts + 1, last_error = sqlc.arg(last_error)::text,
+    parked_at = CASE WHEN attempts + 1 >= sqlc.arg(max_attempts)::int THEN NOW() END
+WHERE id = sqlc.arg(id);
+
+-- name: ListOutboxEventsAfter :many
+-- Events carrying a chirp that has since been hidden or deleted are left
+-- out, so a replay never serves a body that moderation took down.
+SELECT * FROM outbox_events
+WHERE event_type = ANY(sqlc.arg(event_types)::text[])
+  AND (sqlc.narg(user_id)::uuid IS NULL OR user_id = sqlc.narg(user_id))
+  AND processed_at IS NOT NULL
+  AND (event_type NOT IN ('chirp.created', 'chirp.updated') OR EXISTS (
+      SELECT 1 FROM chirps c WHERE c.id = (payload->>'id')::uuid AND c.hidden_at IS NULL
+  ))
+  AND (created_at, id) > (SELECT o.created_at, o.id FROM outbox_events o WHERE o.id = sqlc.arg(after_id))
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg(max_events);
@@ -0,0 +1,18 @@
+-- name: TakeRateLimitToken :one
+INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at, expires_at)
+VALUES (sqlc.arg(key), sqlc.arg(capacity)::float8 - 1, true, NOW(), NOW() + make_interval(secs => sqlc.arg(capacity)::float8 / sqlc.arg(refill_per_second)::float8))
+ON CONFLICT (key) DO UPDATE SET
+    tokens = LEAST(sqlc.arg(capacity)::float8,
+                   b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::float8 * sqlc.arg(refill_per_second)::float8)
+        - CASE WHEN LEAST(sqlc.arg(capacity)::float8,
+                          b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::float8 * sqlc.arg(refill_per_second)::float8) >= 1
+               THEN 1 ELSE 0 END,
+    allowed = LEAST(sqlc.arg(capacity)::float8,
+                    b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::float8 * sqlc.arg(refill_per_second)::float8) >= 1,
+    updated_at = NOW(),
+    expires_at = NOW() + make_interval(secs => sqlc.arg(capacity)::float8 / sqlc.arg(refill_per_second)::float8)
+RETURNING tokens, allowed;
+
+-- name: DeleteIdleRateLimitBuckets :execrows
+DELETE FROM rate_limit_buckets
+WHERE expires_at < NOW();
@@ -0,0 +1,49 @@
+-- name: CreateReport :one
+INSERT INTO reports (id, created_at, updated_at, reporter_id, reported_user_id, chirp_id, reason, details)
+VALUES (gen_random_uuid(), NOW(), NOW(), $1, $2, $3, $4, $5)
+RETURNING *;
+
+-- name: GetReport :one
+SELECT * FROM reports
+WHERE id = $1;
+
+-- name: ListReports :many
+SELECT * FROM reports
+WHERE (sqlc.narg(status)::text IS NULL OR status = sqlc.narg(status))
+  AND (sqlc.narg(after_time)::timestamp IS NULL
+       OR (created_at, id) > (sqlc.narg(after_time)::timestamp, sqlc.narg(after_id)::uuid))
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg(max_results);
+
+-- name: ClaimReport :one
+UPDATE reports
+SET status = 'claimed', claimed_by = $2, claimed_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND status = 'open'
+RETURNING *;
+
+-- name: UnclaimReport :one
+-- UnclaimReport puts a report claimed by claimed_by back in the queue.
+UPDATE reports
+SET status = 'open', claimed_by = NULL, claimed_at = NULL, updated_at = NOW()
+WHERE id = $1 AND status = 'claimed' AND claimed_by = $2
+RETURNING *;
+
+-- name: ResolveReport :one
+UPDATE reports
+SET status = 'resolved', resolution = sqlc.arg(resolution), resolved_at = NOW(), updated_at = NOW(),
+    claimed_by = COALESCE(claimed_by, sqlc.arg(moderator_id)), claimed_at = COALESCE(claimed_at, NOW())
+WHERE id = sqlc.arg(id)
+  AND (status = 'open' OR (status = 'claimed' AND claimed_by = sqlc.arg(moderator_id)))
+RETURNING *;
+
+-- name: CreateModerationAction :exec
+INSERT INTO moderation_actions (id, created_at, moderator_id, action, report_id, target_user_id, chirp_id, note)
+VALUES (gen_random_uuid(), NOW(), $1, $2, $3, $4, $5, $6);
+
+-- name: ListModerationActions :many
+SELECT * FROM moderation_actions
+WHERE (sqlc.narg(target_user_id)::uuid IS NULL OR target_user_id = sqlc.narg(target_user_id))
+  AND (sqlc.narg(before_time)::timestamp IS NULL
+       OR (created_at, id) < (sqlc.narg(before_time)::timestamp, sqlc.narg(before_id)::uuid))
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(max_results);
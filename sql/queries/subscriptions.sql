@@ -0,0 +1,24 @@
+-- name: UpsertSubscription :one
+INSERT INTO subscriptions (id, created_at, updated_at, user_id, status, current_period_start, current_period_end)
+VALUES (gen_random_uuid(), NOW(), NOW(), $1, $2, $3, $4)
+ON CONFLICT (user_id) DO UPDATE
+SET status = EXCLUDED.status,
+    current_period_start = EXCLUDED.current_period_start,
+    current_period_end = EXCLUDED.current_period_end,
+    updated_at = NOW()
+RETURNING *;
+
+-- name: SetSubscriptionStatus :execrows
+UPDATE subscriptions
+SET status = $2, updated_at = NOW()
+WHERE user_id = $1;
+
+-- name: GetSubscriptionByUser :one
+SELECT * FROM subscriptions
+WHERE user_id = $1;
+
+-- name: ExpireLapsedSubscriptions :many
+UPDATE subscriptions
+SET status = 'expired', updated_at = NOW()
+WHERE status IN ('active', 'past_due') AND current_period_end <= NOW()
+RETURNING user_id;
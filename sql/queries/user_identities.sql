@@ -0,0 +1,8 @@
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities (id, created_at, user_id, issuer, subject, email)
+VALUES (gen_random_uuid(), NOW(), $1, $2, $3, $4)
+RETURNING *;
+
+-- name: GetUserIdentity :one
+SELECT * FROM user_identities
+WHERE issuer = $1 AND subject = $2;
@@ -9,14 +9,64 @@ WHERE email = $1;
 
 -- name: UpdateUser :one
 UPDATE users
-SET email = $2, hashed_password = $3
-WHERE id = $1
+SET email = $2, hashed_password = $3, updated_at = NOW()
+WHERE id = $1 AND updated_at = $4
 RETURNING *;
 
 -- name: ResetUsers :exec
 DELETE FROM users;
 
--- name: UpgradeUser :exec
+-- name: SyncUserChirpyRed :exec
+UPDATE users
+SET is_chirpy_red = EXISTS (
+    SELECT 1 FROM subscriptions
+    WHERE subscriptions.user_id = users.id
+      AND subscriptions.status IN ('active', 'past_due')
+      AND subscriptions.current_period_end > NOW()
+), updated_at = NOW()
+WHERE id = $1;
+
+-- name: GetUserByID :one
+SELECT * FROM users
+WHERE id = $1;
+
+-- name: UpdateUserRole :one
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: SetUserTOTPSecret :exec
+UPDATE users
+SET totp_secret = $2, totp_enabled = false, totp_last_step = NULL, updated_at = NOW()
+WHERE id = $1;
+
+-- name: EnableUserTOTP :exec
 UPDATE users
-SET is_chirpy_red = true
+SET totp_enabled = true, updated_at = NOW()
 WHERE id = $1;
+
+-- name: DisableUserTOTP :exec
+UPDATE users
+SET totp_secret = NULL, totp_enabled = false, totp_last_step = NULL, updated_at = NOW()
+WHERE id = $1;
+
+-- name: UseUserTOTPStep :execrows
+UPDATE users
+SET totp_last_step = $2
+WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2);
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: SuspendUser :execrows
+UPDATE users
+SET suspended_at = NOW(), suspended_until = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: UnsuspendUser :execrows
+UPDATE users
+SET suspended_at = NULL, suspended_until = NULL, updated_at = NOW()
+WHERE id = $1 AND suspended_at IS NOT NULL;
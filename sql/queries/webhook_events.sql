@@ -0,0 +1,4 @@
+-- name: RecordWebhookEvent :execrows
+INSERT INTO webhook_events (id, source, event, received_at)
+VALUES ($1, $2, $3, NOW())
+ON CONFLICT (source, id) DO NOTHING;
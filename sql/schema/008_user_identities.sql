@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE user_identities (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL,
+    UNIQUE (issuer, subject)
+);
+
+-- +goose Down
+DROP TABLE user_identities;
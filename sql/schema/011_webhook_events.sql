@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE webhook_events (
+    id TEXT NOT NULL,
+    source TEXT NOT NULL,
+    event TEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (source, id)
+);
+
+-- +goose Down
+DROP TABLE webhook_events;
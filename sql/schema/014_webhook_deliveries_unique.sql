@@ -0,0 +1,7 @@
+-- +goose Up
+-- Outbox events may be published more than once; each endpoint should
+-- still get one delivery per event.
+CREATE UNIQUE INDEX webhook_deliveries_endpoint_event ON webhook_deliveries (endpoint_id, event_id);
+
+-- +goose Down
+DROP INDEX webhook_deliveries_endpoint_event;
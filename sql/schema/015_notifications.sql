@@ -0,0 +1,20 @@
+-- +goose Up
+-- Repeated events about the same subject coalesce into one unread
+-- notification; subject_id is the chirp or user it's about.
+CREATE TABLE notifications (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    subject_id UUID NOT NULL,
+    actor_ids UUID[] NOT NULL DEFAULT '{}',
+    event_ids UUID[] NOT NULL,
+    read_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX notifications_unread_group ON notifications (user_id, kind, subject_id) WHERE read_at IS NULL;
+CREATE INDEX notifications_user_recent ON notifications (user_id, updated_at DESC, id DESC);
+
+-- +goose Down
+DROP TABLE notifications;
@@ -0,0 +1,34 @@
+-- +goose Up
+-- A block hides both users from each other; a mute only hides muted_id
+-- from muter_id, until expires_at if it's set.
+CREATE TABLE user_blocks (
+    blocker_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    blocked_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id)
+);
+
+CREATE INDEX user_blocks_blocked ON user_blocks (blocked_id);
+
+CREATE TABLE user_mutes (
+    muter_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    muted_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    PRIMARY KEY (muter_id, muted_id)
+);
+
+CREATE TABLE keyword_mutes (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    keyword TEXT NOT NULL,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX keyword_mutes_user ON keyword_mutes (user_id);
+
+-- +goose Down
+DROP TABLE keyword_mutes;
+DROP TABLE user_mutes;
+DROP TABLE user_blocks;
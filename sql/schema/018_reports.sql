@@ -0,0 +1,53 @@
+-- +goose Up
+-- A suspended user can't log in or use the API until suspended_until, or
+-- at all while it's NULL.
+ALTER TABLE users
+ADD suspended_at TIMESTAMP,
+ADD suspended_until TIMESTAMP;
+
+-- Hidden chirps are kept for the record but no longer shown.
+ALTER TABLE chirps
+ADD hidden_at TIMESTAMP;
+
+CREATE TABLE reports (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    reporter_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reported_user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    chirp_id UUID REFERENCES chirps(id) ON DELETE SET NULL,
+    reason TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'open'
+        CHECK (status IN ('open', 'claimed', 'resolved')),
+    claimed_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    claimed_at TIMESTAMP,
+    resolved_at TIMESTAMP,
+    resolution TEXT
+);
+
+CREATE INDEX reports_queue ON reports (status, created_at, id);
+
+-- The audit trail outlives the users and chirps it mentions, so it doesn't
+-- reference them.
+CREATE TABLE moderation_actions (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    moderator_id UUID NOT NULL,
+    action TEXT NOT NULL,
+    report_id UUID REFERENCES reports(id) ON DELETE SET NULL,
+    target_user_id UUID,
+    chirp_id UUID,
+    note TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX moderation_actions_created ON moderation_actions (created_at, id);
+
+-- +goose Down
+DROP TABLE moderation_actions;
+DROP TABLE reports;
+ALTER TABLE chirps
+DROP COLUMN hidden_at;
+ALTER TABLE users
+DROP COLUMN suspended_until,
+DROP COLUMN suspended_at;
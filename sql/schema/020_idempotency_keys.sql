@@ -0,0 +1,19 @@
+-- +goose Up
+-- A response to replay when a request is retried with the same
+-- Idempotency-Key. status_code is NULL while the first request is running.
+CREATE TABLE idempotency_keys (
+    scope TEXT NOT NULL,
+    key TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    status_code INTEGER,
+    content_type TEXT,
+    response_body BYTEA,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_expires ON idempotency_keys (expires_at);
+
+-- +goose Down
+DROP TABLE idempotency_keys;
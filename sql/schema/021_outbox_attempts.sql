@@ -0,0 +1,22 @@
+-- +goose Up
+-- Relays lease the events they claim until locked_until, so several can
+-- run at once. An event that keeps failing is parked instead of being
+-- retried forever.
+ALTER TABLE outbox_events
+    ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN last_error TEXT,
+    ADD COLUMN locked_until TIMESTAMP,
+    ADD COLUMN parked_at TIMESTAMP;
+
+DROP INDEX outbox_events_unprocessed;
+CREATE INDEX outbox_events_unprocessed ON outbox_events (created_at) WHERE processed_at IS NULL AND parked_at IS NULL;
+
+-- +goose Down
+DROP INDEX outbox_events_unprocessed;
+CREATE INDEX outbox_events_unprocessed ON outbox_events (created_at) WHERE processed_at IS NULL;
+
+ALTER TABLE outbox_events
+    DROP COLUMN parked_at,
+    DROP COLUMN locked_until,
+    DROP COLUMN last_error,
+    DROP COLUMN attempts;
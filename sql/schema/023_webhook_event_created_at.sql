@@ -0,0 +1,9 @@
+-- +goose Up
+-- Deliveries carry when their event happened, not only when they were
+-- queued, so the payload's created_at doesn't drift with relay lag.
+ALTER TABLE webhook_deliveries ADD COLUMN event_created_at TIMESTAMP;
+UPDATE webhook_deliveries SET event_created_at = created_at;
+ALTER TABLE webhook_deliveries ALTER COLUMN event_created_at SET NOT NULL;
+
+-- +goose Down
+ALTER TABLE webhook_deliveries DROP COLUMN event_created_at;
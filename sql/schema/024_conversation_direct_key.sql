@@ -0,0 +1,26 @@
+-- +goose Up
+-- A one-to-one conversation is keyed by its sorted pair of members, so two
+-- requests racing to start the same one can't both create it. Existing
+-- duplicates keep the key on the oldest conversation.
+ALTER TABLE conversations ADD COLUMN direct_key TEXT;
+
+UPDATE conversations c
+SET direct_key = pairs.direct_key
+FROM (
+    SELECT DISTINCT ON (p.direct_key) p.conversation_id, p.direct_key
+    FROM (
+        SELECT conversation_id, string_agg(user_id::text, ':' ORDER BY user_id) AS direct_key
+        FROM conversation_members
+        GROUP BY conversation_id
+        HAVING COUNT(*) = 2
+    ) p
+    JOIN conversations oldest ON oldest.id = p.conversation_id
+    ORDER BY p.direct_key, oldest.created_at ASC, oldest.id ASC
+) pairs
+WHERE c.id = pairs.conversation_id;
+
+CREATE UNIQUE INDEX conversations_direct_key ON conversations (direct_key);
+
+-- +goose Down
+DROP INDEX conversations_direct_key;
+ALTER TABLE conversations DROP COLUMN direct_key;
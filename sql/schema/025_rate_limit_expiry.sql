@@ -0,0 +1,16 @@
+-- +goose Up
+-- A bucket is full again at most one policy period after it was last
+-- used, and only then can it be forgotten. Buckets are cheap to lose, so
+-- existing ones are given the longest built-in period.
+ALTER TABLE rate_limit_buckets ADD COLUMN expires_at TIMESTAMP;
+UPDATE rate_limit_buckets SET expires_at = updated_at + INTERVAL '1 hour';
+ALTER TABLE rate_limit_buckets ALTER COLUMN expires_at SET NOT NULL;
+
+DROP INDEX rate_limit_buckets_updated;
+CREATE INDEX rate_limit_buckets_expires ON rate_limit_buckets (expires_at);
+
+-- +goose Down
+DROP INDEX rate_limit_buckets_expires;
+CREATE INDEX rate_limit_buckets_updated ON rate_limit_buckets (updated_at);
+
+ALTER TABLE rate_limit_buckets DROP COLUMN expires_at;
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"chirpy/internal/database"
+	"chirpy/internal/events"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Subscription statuses. Active and past-due subscriptions grant Chirpy Red
+// until their current period ends.
+const (
+	subscriptionActive   = "active"
+	subscriptionPastDue  = "past_due"
+	subscriptionCanceled = "canceled"
+	subscriptionRefunded = "refunded"
+	subscriptionExpired  = "expired"
+)
+
+// defaultSubscriptionPeriod is used when Polka doesn't say when a period
+// ends.
+const defaultSubscriptionPeriod = 30 * 24 * time.Hour
+
+// polkaEventStatus maps the Polka events chirpy handles to the status they
+// leave the subscription in.
+var polkaEventStatus = map[string]string{
+	"user.upgraded":       subscriptionActive,
+	"user.renewed":        subscriptionActive,
+	"user.payment_failed": subscriptionPastDue,
+	"user.downgraded":     subscriptionCanceled,
+	"user.refunded":       subscriptionRefunded,
+}
+
+var (
+	errUnknownPolkaEvent     = errors.New("unhandled polka event")
+	errDuplicateWebhookEvent = errors.New("webhook event was already handled")
+)
+
+// subscriptionPeriod is the billing period a Polka event starts, defaulting
+// to one that starts now.
+func subscriptionPeriod(start, end *time.Time, now time.Time) (time.Time, time.Time) {
+	periodStart := now
+	if start != nil {
+		periodStart = *start
+	}
+	periodEnd := periodStart.Add(defaultSubscriptionPeriod)
+	if end != nil {
+		periodEnd = *end
+	}
+	return periodStart, periodEnd
+}
+
+// applySubscriptionEvent updates userID's subscription for Polka event
+// eventID and rederives their Chirpy Red status from it. An event that was
+// already handled is errDuplicateWebhookEvent.
+func (cfg *apiConfig) applySubscriptionEvent(ctx context.Context, eventID string, userID uuid.UUID, event string, periodStart, periodEnd *time.Time) error {
+	status, ok := polkaEventStatus[event]
+	if !ok {
+		return fmt.Errorf("%w: %q", errUnknownPolkaEvent, event)
+	}
+
+	return cfg.db.InTx(ctx, func(q database.DBInterface) error {
+		// Recording the event in the same transaction drops redeliveries,
+		// even ones racing this one, and forgets it again if this fails so
+		// Polka's retry goes through.
+		n, err := q.RecordWebhookEvent(ctx, database.RecordWebhookEventParams{
+			ID:     eventID,
+			Source: polkaWebhookSource,
+			Event:  event,
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errDuplicateWebhookEvent
+		}
+		// Unknown users are sql.ErrNoRows, so Polka can be told.
+		if _, err := q.GetUserByID(ctx, userID); err != nil {
+			return err
+		}
+
+		if status == subscriptionActive {
+			start, end := subscriptionPeriod(periodStart, periodEnd, time.Now())
+			_, err := q.UpsertSubscription(ctx, database.UpsertSubscriptionParams{
+				UserID:             userID,
+				Status:             status,
+				CurrentPeriodStart: start,
+				CurrentPeriodEnd:   end,
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			// Without a subscription there's nothing to downgrade.
+			n, err := q.SetSubscriptionStatus(ctx, database.SetSubscriptionStatusParams{
+				UserID: userID,
+				Status: status,
+			})
+			if err != nil || n == 0 {
+				return err
+			}
+		}
+		return syncChirpyRed(ctx, q, userID)
+	})
+}
+
+// syncChirpyRed rederives userID's Chirpy Red status from their
+// subscription and records user.upgraded or user.downgraded if it changed.
+func syncChirpyRed(ctx context.Context, q database.DBInterface, userID uuid.UUID) error {
+	before, err := q.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := q.SyncUserChirpyRed(ctx, userID); err != nil {
+		return err
+	}
+	after, err := q.GetUserByID(ctx, userID)
+	if err != nil || after.IsChirpyRed == before.IsChirpyRed {
+		return err
+	}
+	eventType := events.UserDowngraded
+	if after.IsChirpyRed {
+		eventType = events.UserUpgraded
+	}
+	return events.Record(ctx, q, eventType, userID, events.User{ID: userID, IsChirpyRed: after.IsChirpyRed})
+}
+
+// expireSubscriptions ends subscriptions whose period has lapsed without a
+// renewal and takes Chirpy Red away from their users.
+func (cfg *apiConfig) expireSubscriptions(ctx context.Context) error {
+	userIDs, err := cfg.db.ExpireLapsedSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range userIDs {
+		err := cfg.db.InTx(ctx, func(q database.DBInterface) error {
+			return syncChirpyRed(ctx, q, id)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
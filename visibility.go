@@ -0,0 +1,59 @@
+package main
+
+import (
+	"chirpy/internal/stream"
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// visibility is what a viewer has chosen not to see: users blocked either
+// way or muted, and chirps containing a muted keyword.
+type visibility struct {
+	hiddenUsers map[uuid.UUID]bool
+	keywords    []string
+}
+
+// visibilityFor loads viewerID's blocks and mutes. Anonymous viewers, with
+// a nil id, see everything.
+func (cfg *apiConfig) visibilityFor(ctx context.Context, viewerID uuid.UUID) (visibility, error) {
+	v := visibility{hiddenUsers: map[uuid.UUID]bool{}}
+	if viewerID == uuid.Nil {
+		return v, nil
+	}
+	hidden, err := cfg.db.ListHiddenUserIDs(ctx, viewerID)
+	if err != nil {
+		return v, err
+	}
+	for _, id := range hidden {
+		v.hiddenUsers[id] = true
+	}
+	mutes, err := cfg.db.ListKeywordMutes(ctx, viewerID)
+	if err != nil {
+		return v, err
+	}
+	for _, m := range mutes {
+		v.keywords = append(v.keywords, strings.ToLower(m.Keyword))
+	}
+	return v, nil
+}
+
+// hides reports whether a chirp by authorID with body should be left out.
+func (v visibility) hides(authorID uuid.UUID, body string) bool {
+	if v.hiddenUsers[authorID] {
+		return true
+	}
+	lower := strings.ToLower(body)
+	for _, k := range v.keywords {
+		if strings.Contains(lower, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidesMessage applies hides to a streamed chirp event.
+func (v visibility) hidesMessage(m stream.Message) bool {
+	return v.hides(m.AuthorID, m.Body)
+}